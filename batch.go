@@ -0,0 +1,137 @@
+package fileindexer
+
+import (
+	"sync"
+)
+
+// Number of applied files or dirs written to the db in one leveldb batch.
+const DEFAULT_BATCH_SIZE = 256
+
+// writeBatch collects writes until they are written to the db at once. Reads
+// see the pending writes. Writes of a file and its hash, size and quick hash
+// entries always go into the same batch, so the entries stay in step even if
+// the process dies.
+type writeBatch struct {
+	lock  sync.Mutex
+	batch Batch
+	// Pending values by key, nil for deleted keys.
+	pending map[string][]byte
+	// Tasks applied since the last write.
+	tasks int
+}
+
+// Returns the pending value of key. ok is false if key has no pending write.
+func (b *writeBatch) get(key string) (value []byte, ok bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	value, ok = b.pending[key]
+	return value, ok
+}
+
+// Returns the value of a key read from the db as it is with the pending
+// writes. deleted is true if it has a pending delete.
+func (v *Indexer) withPending(key []byte, value []byte) (pendingValue []byte, deleted bool) {
+	batch := v.getBatch()
+	if batch == nil {
+		return value, false
+	}
+	if pending, ok := batch.get(string(key)); ok {
+		return pending, pending == nil
+	}
+	return value, false
+}
+
+func (b *writeBatch) put(key string, value []byte) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.pending[key] = value
+	b.batch.Put([]byte(key), value)
+}
+
+func (b *writeBatch) delete(key string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.pending[key] = nil
+	b.batch.Delete([]byte(key))
+}
+
+// Starts collecting writes into a batch. Returns false if a batch is already
+// started, whose owner ends it.
+func (v *Indexer) beginBatch() bool {
+	v.batchLock.Lock()
+	defer v.batchLock.Unlock()
+	if v.batch != nil {
+		return false
+	}
+	v.batch = &writeBatch{pending: make(map[string][]byte)}
+	return true
+}
+
+// Returns the started batch, nil if writes go to the db directly. Lookups
+// may come from other goroutines while Watch writes.
+func (v *Indexer) getBatch() *writeBatch {
+	v.batchLock.Lock()
+	defer v.batchLock.Unlock()
+	return v.batch
+}
+
+// Writes the pending batch to the store.
+func (v *Indexer) flushBatch() error {
+	b := v.getBatch()
+	if b == nil {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.tasks = 0
+	if b.batch.Len() == 0 {
+		return nil
+	}
+	if err := v.db.Write(&b.batch); err != nil {
+		return newDbError("write", "batch", err)
+	}
+	b.batch.Reset()
+	b.pending = make(map[string][]byte)
+	v.crash("flush")
+	return nil
+}
+
+// Writes the pending batch and stops batching.
+func (v *Indexer) endBatch() error {
+	err := v.flushBatch()
+	v.batchLock.Lock()
+	v.batch = nil
+	v.batchLock.Unlock()
+	return err
+}
+
+// Called after a task is applied. Tasks are only complete between calls, so
+// this is where the batch is written once it is big enough.
+func (v *Indexer) taskApplied() error {
+	b := v.getBatch()
+	if b == nil {
+		return nil
+	}
+	b.lock.Lock()
+	b.tasks++
+	full := b.tasks >= v.getBatchSize()
+	b.lock.Unlock()
+	if full {
+		return v.flushBatch()
+	}
+	return nil
+}
+
+func (v *Indexer) getBatchSize() int {
+	if v.batchSize <= 0 {
+		return DEFAULT_BATCH_SIZE
+	}
+	return v.batchSize
+}
+
+// Lets tests simulate a crash at the given point.
+func (v *Indexer) crash(point string) {
+	if v.crashHook != nil {
+		v.crashHook(point)
+	}
+}
@@ -0,0 +1,57 @@
+package fileindexer
+
+import (
+	"github.com/idlecat/fileindexer/protos"
+)
+
+// Returns the entries directly under relativePath, in name order, with their
+// RelativePath set. A file has no entries.
+func (v *Indexer) ListDir(relativePath string) ([]*protos.FileMeta, error) {
+	meta, err := v.GetFileOrDirMeta(relativePath)
+	if err != nil {
+		return nil, err
+	}
+	return v.listChildren(relativePath, meta)
+}
+
+func (v *Indexer) listChildren(relativePath string, meta *protos.FileMeta) ([]*protos.FileMeta, error) {
+	children := []*protos.FileMeta{}
+	if !meta.IsDir {
+		return children, nil
+	}
+	err := v.iterChildren(relativePath, func(path string, meta *protos.FileMeta) bool {
+		meta.RelativePath = path
+		children = append(children, meta)
+		return true
+	})
+	return children, err
+}
+
+// Returns NORMAL, or STOP_SCAN_THIS_DIR to skip the entries under a dir.
+type WalkFunc func(path string, meta *protos.FileMeta) int
+
+// Walks relativePath and everything under it as indexed, a dir before its
+// entries and entries in name order. The disk is not read.
+func (v *Indexer) Walk(relativePath string, walkFunc WalkFunc) error {
+	meta, err := v.GetFileOrDirMeta(relativePath)
+	if err != nil {
+		return err
+	}
+	return v.walk(relativePath, meta, walkFunc)
+}
+
+func (v *Indexer) walk(relativePath string, meta *protos.FileMeta, walkFunc WalkFunc) error {
+	if walkFunc(relativePath, meta) == STOP_SCAN_THIS_DIR {
+		return nil
+	}
+	children, err := v.listChildren(relativePath, meta)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := v.walk(child.RelativePath, child, walkFunc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
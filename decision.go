@@ -0,0 +1,41 @@
+package fileindexer
+
+import (
+	"github.com/idlecat/fileindexer/protos"
+	"time"
+)
+
+// Decisions on a group of copies.
+const (
+	// Dedups the group, keeping DedupDecision.KeepPath.
+	DECISION_DEDUP = 1
+	// Keeps all copies.
+	DECISION_KEEP_ALL = 2
+)
+
+func keyForDecision(digest string) string {
+	return string(PREFIX_DECISION) + digest
+}
+
+// Saves a decision on the copies with digest, replacing any earlier one.
+func (v *Indexer) SaveDecision(digest string, action int, keepPath string, paths []string) error {
+	decision := protos.DedupDecision{
+		Hash:     digest,
+		Action:   int32(action),
+		KeepPath: keepPath,
+		Paths:    paths,
+		TimeNs:   time.Now().UnixNano(),
+	}
+	return v.putKeyValue(keyForDecision(digest), &decision)
+}
+
+// Returns the decision saved on the copies with digest, nil if there is
+// none or if paths are not the copies it was made on.
+func (v *Indexer) GetDecision(digest string, paths []string) (*protos.DedupDecision, error) {
+	var decision protos.DedupDecision
+	found, err := v.getProto(keyForDecision(digest), &decision)
+	if err != nil || !found || !samePaths(decision.Paths, paths) {
+		return nil, err
+	}
+	return &decision, nil
+}
@@ -0,0 +1,305 @@
+package fileindexer
+
+import (
+	"fmt"
+	"github.com/idlecat/fileindexer/protos"
+	"path"
+	"sort"
+	"strings"
+)
+
+func keyForDirHash(hash string) string {
+	return string(PREFIX_DIR_HASH) + hash
+}
+
+// Returns the dir relativePath is in, "" for the root and its entries.
+func parentDir(relativePath string) string {
+	if i := strings.LastIndexByte(relativePath, '/'); i >= 0 {
+		return relativePath[:i]
+	}
+	return ""
+}
+
+// Returns how many dirs deep dir is, 0 for the root.
+func dirDepth(dir string) int {
+	if dir == "" {
+		return 0
+	}
+	return strings.Count(dir, "/") + 1
+}
+
+// Returns the content hash of a dir from its entries, in name order. Dirs
+// with the same names, file contents and subdirs, recursively, get the same
+// hash. An unhashed file has a unique size, so it stands for itself.
+func (v *Indexer) dirContentHash(children []*protos.FileMeta) string {
+	h := v.hasher.New()
+	for _, child := range children {
+		name := path.Base(child.RelativePath)
+		switch {
+		case child.IsDir && child.DirInfo != nil:
+			fmt.Fprintf(h, "d %s %s\n", child.DirInfo.ContentHash, name)
+		case child.IsDir:
+			fmt.Fprintf(h, "d - %s\n", name)
+		case child.Hash != "":
+			fmt.Fprintf(h, "f %s %s\n", child.Hash, name)
+		default:
+			fmt.Fprintf(h, "u %s %s\n", child.RelativePath, name)
+		}
+	}
+	return TagDigest(v.hasher.Name(), h.Sum(nil))
+}
+
+// Sets the content hash of a dir and moves it in the dir hash index. Returns
+// false if the hash is unchanged. meta is written by the caller.
+func (v *Indexer) setDirHash(relativePath string, meta *protos.FileMeta, hash string) (bool, error) {
+	dirInfo := meta.DirInfo
+	if dirInfo.ContentHash == hash {
+		return false, nil
+	}
+	if dirInfo.ContentHash != "" {
+		if _, err := v.removePath(keyForDirHash(dirInfo.ContentHash), relativePath); err != nil {
+			return false, err
+		}
+	}
+	dirInfo.ContentHash = hash
+	return true, v.addPath(keyForDirHash(hash), dirInfo.TotalFileSize, relativePath)
+}
+
+// Marks the dir of relativePath for its content hash to be recomputed by
+// updateDirHashes.
+func (v *Indexer) dirChanged(relativePath string) {
+	if v.deferDirStats || relativePath == "" {
+		return
+	}
+	if v.dirtyDirs == nil {
+		v.dirtyDirs = make(map[string]bool)
+	}
+	v.dirtyDirs[parentDir(relativePath)] = true
+}
+
+// Recomputes the content hashes of dirs marked by dirChanged and of the dirs
+// above them, deepest first.
+func (v *Indexer) updateDirHashes() error {
+	if len(v.dirtyDirs) == 0 {
+		return nil
+	}
+	// entries are iterated from the db.
+	if err := v.flushBatch(); err != nil {
+		return err
+	}
+	dirs := make(map[string]bool)
+	for dir := range v.dirtyDirs {
+		for !dirs[dir] {
+			dirs[dir] = true
+			if dir == "" {
+				break
+			}
+			dir = parentDir(dir)
+		}
+	}
+	v.dirtyDirs = nil
+	sorted := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return dirDepth(sorted[i]) > dirDepth(sorted[j])
+	})
+	for _, dir := range sorted {
+		meta, err := v.getFileMeta(dir)
+		if err != nil {
+			return err
+		}
+		if meta == nil || !meta.IsDir || meta.DirInfo == nil {
+			continue
+		}
+		children, err := v.listChildren(dir, meta)
+		if err != nil {
+			return err
+		}
+		changed, err := v.setDirHash(dir, meta, v.dirContentHash(children))
+		if err == nil && changed {
+			err = v.putKeyValue(keyForPath(dir), meta)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return v.flushBatch()
+}
+
+func (v *Indexer) IterDirHash(iterFunc IterHashFunc) error {
+	return v.iterPaths(PREFIX_DIR_HASH, func(key string, paths *protos.FilePaths) bool {
+		return iterFunc(key[1:], paths.FileSize, paths.Paths)
+	})
+}
+
+// DirGroup is a set of dirs with the same content.
+type DirGroup struct {
+	Hash string
+	// Total size of the files in each dir.
+	TotalFileSize int64
+	Paths         []string
+}
+
+// Returns groups of dirs with the same content, most space taken by copies
+// first. Dirs without files are left out, and so are groups inside the dirs
+// of another group.
+func (v *Indexer) IdenticalDirs() ([]*DirGroup, error) {
+	groups := []*DirGroup{}
+	err := v.IterDirHash(func(hash string, totalFileSize int64, paths []string) bool {
+		if len(paths) > 1 && totalFileSize > 0 {
+			groups = append(groups, &DirGroup{hash, totalFileSize, paths})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	groupOf := make(map[string]*DirGroup)
+	for _, group := range groups {
+		sort.Strings(group.Paths)
+		for _, path := range group.Paths {
+			groupOf[path] = group
+		}
+	}
+	top := []*DirGroup{}
+	for _, group := range groups {
+		if !insideGroup(group, groupOf) {
+			top = append(top, group)
+		}
+	}
+	sort.SliceStable(top, func(i, j int) bool {
+		return top[i].TotalFileSize*int64(len(top[i].Paths)-1) > top[j].TotalFileSize*int64(len(top[j].Paths)-1)
+	})
+	return top, nil
+}
+
+// Returns whether the dirs of group are each in a different dir of one
+// other group, which contains them all.
+func insideGroup(group *DirGroup, groupOf map[string]*DirGroup) bool {
+	parents := make(map[string]bool)
+	var parentGroup *DirGroup
+	for _, path := range group.Paths {
+		parent := parentDir(path)
+		if path == "" || parents[parent] {
+			return false
+		}
+		parents[parent] = true
+		if parentGroup == nil {
+			parentGroup = groupOf[parent]
+		}
+		if parentGroup == nil || groupOf[parent] != parentGroup {
+			return false
+		}
+	}
+	return true
+}
+
+// SimilarDirs is a pair of dirs sharing most of their content.
+type SimilarDirs struct {
+	Paths [2]string
+	// Size of the files of one dir with a copy in the other.
+	SharedFileSize int64
+	// SharedFileSize relative to the total file size of the bigger dir.
+	Similarity float64
+}
+
+// Returns pairs of dirs with different content whose shared files make up
+// at least minSimilarity of the bigger dir, most shared first. Dirs are
+// compared when they hold copies of the same files, along with their
+// ancestors as long as those have the same names, so copies of a tree
+// placed elsewhere are found. Pairs inside a similar or identical pair are
+// left out.
+func (v *Indexer) SimilarDirs(minSimilarity float64) ([]*SimilarDirs, error) {
+	shared := make(map[[2]string]int64)
+	err := v.IterHash(func(hash string, fileSize int64, paths []string) bool {
+		if fileSize == 0 {
+			return true
+		}
+		for i := range paths {
+			for j := i + 1; j < len(paths); j++ {
+				addSharedSize(shared, parentDir(paths[i]), parentDir(paths[j]), fileSize)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	metas := make(map[string]*protos.FileMeta)
+	getMeta := func(relativePath string) (*protos.FileMeta, error) {
+		if meta, ok := metas[relativePath]; ok {
+			return meta, nil
+		}
+		meta, err := v.getFileMeta(relativePath)
+		metas[relativePath] = meta
+		return meta, err
+	}
+	similar := make(map[[2]string]*SimilarDirs)
+	identical := make(map[[2]string]bool)
+	for pair, size := range shared {
+		a, err := getMeta(pair[0])
+		if err != nil {
+			return nil, err
+		}
+		b, err := getMeta(pair[1])
+		if err != nil {
+			return nil, err
+		}
+		if a == nil || b == nil || a.DirInfo == nil || b.DirInfo == nil {
+			continue
+		}
+		if a.DirInfo.ContentHash == b.DirInfo.ContentHash {
+			identical[pair] = true
+			continue
+		}
+		total := a.DirInfo.TotalFileSize
+		if b.DirInfo.TotalFileSize > total {
+			total = b.DirInfo.TotalFileSize
+		}
+		similarity := float64(size) / float64(total)
+		if similarity > 1 {
+			// more copies on one side.
+			similarity = 1
+		}
+		if similarity >= minSimilarity {
+			similar[pair] = &SimilarDirs{pair, size, similarity}
+		}
+	}
+	pairs := []*SimilarDirs{}
+	for pair, dirs := range similar {
+		parents := dirPair(parentDir(pair[0]), parentDir(pair[1]))
+		if similar[parents] == nil && !identical[parents] {
+			pairs = append(pairs, dirs)
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].SharedFileSize != pairs[j].SharedFileSize {
+			return pairs[i].SharedFileSize > pairs[j].SharedFileSize
+		}
+		return pairs[i].Paths[0] < pairs[j].Paths[0]
+	})
+	return pairs, nil
+}
+
+func dirPair(a string, b string) [2]string {
+	if a > b {
+		return [2]string{b, a}
+	}
+	return [2]string{a, b}
+}
+
+// Adds fileSize to the dirs a and b of two copies of a file, and to their
+// ancestors while the names match. A dir is not compared with its own
+// ancestors.
+func addSharedSize(shared map[[2]string]int64, a string, b string, fileSize int64) {
+	for a != b && a != "" && b != "" &&
+		!strings.HasPrefix(a, b+"/") && !strings.HasPrefix(b, a+"/") {
+		shared[dirPair(a, b)] += fileSize
+		if path.Base(a) != path.Base(b) {
+			return
+		}
+		a, b = parentDir(a), parentDir(b)
+	}
+}
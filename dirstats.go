@@ -0,0 +1,317 @@
+package fileindexer
+
+import (
+	"github.com/idlecat/fileindexer/protos"
+	"path/filepath"
+	"strings"
+)
+
+// Calls update with each dir above relativePath, up to the root, and its
+// DirInfo, and writes it. Dirs not indexed are skipped.
+func (v *Indexer) updateAncestors(relativePath string, update func(dir string, dirInfo *protos.DirInfo)) error {
+	dir := relativePath
+	for dir != "" {
+		dir = filepath.Dir(dir)
+		if dir == "." {
+			dir = ""
+		}
+		meta, err := v.getFileMeta(dir)
+		if err != nil {
+			return err
+		}
+		if meta == nil || meta.DirInfo == nil {
+			continue
+		}
+		update(dir, meta.DirInfo)
+		meta.DirInfo.UniqueFileSize = meta.DirInfo.TotalFileSize - meta.DirInfo.DuplicateFileSize
+		if err := v.putKeyValue(keyForPath(dir), meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Counts relativePath as having a copy in the dirs above it for sign 1, and
+// stops counting it for sign -1.
+func (v *Indexer) addCopied(relativePath string, fileSize int64, sign int32) error {
+	return v.updateAncestors(relativePath, func(dir string, dirInfo *protos.DirInfo) {
+		dirInfo.CopiedFileCount += sign
+		dirInfo.CopiedFileSize += int64(sign) * fileSize
+	})
+}
+
+// Updates duplicate totals after relativePath joined, for sign 1, or left,
+// for sign -1, the files with the same digest. others are the other paths
+// with the digest. Paths have a copy if they are links of at least two
+// different files. Besides, a dir counts all but one of the files with a
+// digest under it as duplicates, links of one file being one file, which
+// is what deduping the dir alone would reclaim. So relativePath is a
+// duplicate in the dirs above it holding another file with the digest but
+// no link of its own file.
+func (v *Indexer) hashGroupChanged(others []string, meta *protos.FileMeta, relativePath string, sign int32) error {
+	if v.deferDirStats || len(others) == 0 {
+		return nil
+	}
+	id := linkId(relativePath, meta)
+	files := make(map[fileId]bool)
+	// depths of the deepest dirs holding another file and a link.
+	otherDepth, linkDepth := -1, -1
+	for _, other := range others {
+		otherMeta, err := v.getFileMeta(other)
+		if err != nil {
+			return err
+		}
+		otherId := linkId(other, otherMeta)
+		files[otherId] = true
+		depth := commonDirDepth(relativePath, other)
+		if otherId == id {
+			if depth > linkDepth {
+				linkDepth = depth
+			}
+		} else if depth > otherDepth {
+			otherDepth = depth
+		}
+	}
+	without := len(files)
+	files[id] = true
+	if without < 2 && len(files) >= 2 {
+		// the other paths have a copy from now on, or not any more.
+		for _, other := range others {
+			if err := v.addCopied(other, meta.Size, sign); err != nil {
+				return err
+			}
+		}
+	}
+	copied := len(files) >= 2
+	if !copied && otherDepth <= linkDepth {
+		return nil
+	}
+	return v.updateAncestors(relativePath, func(dir string, dirInfo *protos.DirInfo) {
+		if copied {
+			dirInfo.CopiedFileCount += sign
+			dirInfo.CopiedFileSize += int64(sign) * meta.Size
+		}
+		if depth := dirDepth(dir); depth <= otherDepth && depth > linkDepth {
+			dirInfo.DuplicateFileCount += sign
+			dirInfo.DuplicateFileSize += int64(sign) * meta.Size
+		}
+	})
+}
+
+// Returns the files paths are links of.
+func (v *Indexer) linkIds(paths []string) (map[fileId]bool, error) {
+	files := make(map[fileId]bool)
+	for _, path := range paths {
+		meta, err := v.getFileMeta(path)
+		if err != nil {
+			return nil, err
+		}
+		files[linkId(path, meta)] = true
+	}
+	return files, nil
+}
+
+// Returns the depth of the deepest dir holding both files a and b.
+func commonDirDepth(a string, b string) int {
+	dirsA := strings.Split(parentDir(a), "/")
+	dirsB := strings.Split(parentDir(b), "/")
+	depth := 0
+	for depth < len(dirsA) && depth < len(dirsB) && dirsA[depth] != "" && dirsA[depth] == dirsB[depth] {
+		depth++
+	}
+	return depth
+}
+
+// Returns the paths with digest other than relativePath, and whether
+// relativePath is one of them. Nothing while dir totals are deferred.
+func (v *Indexer) otherPaths(digest string, relativePath string) ([]string, bool, error) {
+	if v.deferDirStats {
+		return nil, false, nil
+	}
+	var paths protos.FilePaths
+	if _, err := v.getProto(keyForHash(digest), &paths); err != nil {
+		return nil, false, err
+	}
+	others := make([]string, 0, len(paths.Paths))
+	found := false
+	for _, path := range paths.Paths {
+		if path == relativePath {
+			found = true
+		} else {
+			others = append(others, path)
+		}
+	}
+	return others, found, nil
+}
+
+// Recomputes the totals and content hashes of relativePath and of the dirs
+// under it from their file entries, and writes those which changed. Nothing
+// for a file.
+func (v *Indexer) updateDirStats(relativePath string) error {
+	meta, err := v.getFileMeta(relativePath)
+	if err != nil || meta == nil || !meta.IsDir {
+		return err
+	}
+	_, _, err = v.computeDirStats(relativePath, meta, map[string]bool{})
+	return err
+}
+
+// Files under a dir with a digest other files have too, see
+// hashGroupChanged.
+type dupFiles struct {
+	groups map[string]*dupGroup
+	// All but one file of each group.
+	count int32
+	size  int64
+}
+
+type dupGroup struct {
+	size  int64
+	files map[fileId]bool
+}
+
+func newDupFiles() *dupFiles {
+	return &dupFiles{groups: make(map[string]*dupGroup)}
+}
+
+func (d *dupFiles) add(digest string, id fileId, size int64) {
+	group := d.groups[digest]
+	if group == nil {
+		group = &dupGroup{size, make(map[fileId]bool)}
+		d.groups[digest] = group
+	}
+	if group.files[id] {
+		return
+	}
+	if len(group.files) > 0 {
+		d.count++
+		d.size += size
+	}
+	group.files[id] = true
+}
+
+// Returns the files of a and b, in the bigger of them.
+func mergeDupFiles(a *dupFiles, b *dupFiles) *dupFiles {
+	if len(a.groups) < len(b.groups) {
+		a, b = b, a
+	}
+	for digest, group := range b.groups {
+		for id := range group.files {
+			a.add(digest, id, group.size)
+		}
+	}
+	return a
+}
+
+func (v *Indexer) computeDirStats(relativePath string, meta *protos.FileMeta, duplicates map[string]bool) (*protos.DirInfo, *dupFiles, error) {
+	children, err := v.listChildren(relativePath, meta)
+	if err != nil {
+		return nil, nil, err
+	}
+	totals := protos.DirInfo{}
+	dups := newDupFiles()
+	for _, child := range children {
+		if child.IsDir {
+			childTotals, childDups, err := v.computeDirStats(child.RelativePath, child, duplicates)
+			if err != nil {
+				return nil, nil, err
+			}
+			totals.TotalFileCount += childTotals.TotalFileCount
+			totals.TotalFileSize += childTotals.TotalFileSize
+			totals.TotalDirCount += childTotals.TotalDirCount + 1
+			totals.CopiedFileCount += childTotals.CopiedFileCount
+			totals.CopiedFileSize += childTotals.CopiedFileSize
+			dups = mergeDupFiles(dups, childDups)
+			continue
+		}
+		totals.TotalFileCount++
+		totals.TotalFileSize += child.Size
+		duplicate, err := v.isDuplicate(child.Hash, duplicates)
+		if err != nil {
+			return nil, nil, err
+		}
+		if duplicate {
+			totals.CopiedFileCount++
+			totals.CopiedFileSize += child.Size
+			dups.add(child.Hash, linkId(child.RelativePath, child), child.Size)
+		}
+	}
+	totals.DuplicateFileCount = dups.count
+	totals.DuplicateFileSize = dups.size
+	totals.UniqueFileSize = totals.TotalFileSize - totals.DuplicateFileSize
+
+	dirInfo := meta.DirInfo
+	if dirInfo == nil {
+		dirInfo = &protos.DirInfo{}
+		meta.DirInfo = dirInfo
+	}
+	changed := dirInfo.TotalFileCount != totals.TotalFileCount || dirInfo.TotalFileSize != totals.TotalFileSize ||
+		dirInfo.TotalDirCount != totals.TotalDirCount || dirInfo.DuplicateFileCount != totals.DuplicateFileCount ||
+		dirInfo.DuplicateFileSize != totals.DuplicateFileSize || dirInfo.UniqueFileSize != totals.UniqueFileSize ||
+		dirInfo.CopiedFileCount != totals.CopiedFileCount || dirInfo.CopiedFileSize != totals.CopiedFileSize
+	dirInfo.TotalFileCount = totals.TotalFileCount
+	dirInfo.TotalFileSize = totals.TotalFileSize
+	dirInfo.TotalDirCount = totals.TotalDirCount
+	dirInfo.DuplicateFileCount = totals.DuplicateFileCount
+	dirInfo.DuplicateFileSize = totals.DuplicateFileSize
+	dirInfo.UniqueFileSize = totals.UniqueFileSize
+	dirInfo.CopiedFileCount = totals.CopiedFileCount
+	dirInfo.CopiedFileSize = totals.CopiedFileSize
+	// after the totals, which go into the dir hash index.
+	hashChanged, err := v.setDirHash(relativePath, meta, v.dirContentHash(children))
+	if err != nil {
+		return nil, nil, err
+	}
+	if changed || hashChanged {
+		// the parent hashes the name.
+		name := meta.RelativePath
+		meta.RelativePath = ""
+		err = v.putKeyValue(keyForPath(relativePath), meta)
+		meta.RelativePath = name
+	}
+	return &totals, dups, err
+}
+
+// Returns whether files other than links of one file have digest.
+// duplicates caches the digests looked up.
+func (v *Indexer) isDuplicate(digest string, duplicates map[string]bool) (bool, error) {
+	if digest == "" {
+		return false, nil
+	}
+	if duplicate, ok := duplicates[digest]; ok {
+		return duplicate, nil
+	}
+	var paths protos.FilePaths
+	if _, err := v.getProto(keyForHash(digest), &paths); err != nil {
+		return false, err
+	}
+	duplicate := false
+	if len(paths.Paths) > 1 {
+		files, err := v.linkIds(paths.Paths)
+		if err != nil {
+			return false, err
+		}
+		duplicate = len(files) > 1
+	}
+	duplicates[digest] = duplicate
+	return duplicate, nil
+}
+
+// Recomputes the totals and content hashes of all dirs, for indexes created
+// before they were kept.
+func (v *Indexer) buildDirStats() error {
+	// migrations run before the index is opened.
+	hasher, err := GetHasher(v.dbMeta.HashAlgorithm)
+	if err != nil {
+		return err
+	}
+	v.hasher = hasher
+	batching := v.beginBatch()
+	err = v.updateDirStats("")
+	if batching {
+		if endErr := v.endBatch(); err == nil {
+			err = endErr
+		}
+	}
+	return err
+}
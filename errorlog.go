@@ -0,0 +1,158 @@
+package fileindexer
+
+import (
+	"errors"
+	"github.com/golang/protobuf/proto"
+	"github.com/idlecat/fileindexer/protos"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func keyForError(relativePath string) string {
+	return string(PREFIX_ERROR) + relativePath
+}
+
+// Records a failed path in the db, then skips or aborts as the error policy
+// says.
+func (v *Indexer) failPath(err *PathError) error {
+	if dbErr := v.recordError(err); dbErr != nil {
+		return dbErr
+	}
+	return v.skipOrAbort(err)
+}
+
+// Records a failed path in the db, until it is indexed again.
+func (v *Indexer) recordError(err *PathError) error {
+	relativePath := v.getRelativePath(err.Path)
+	record := protos.ErrorRecord{
+		Path:     relativePath,
+		Op:       err.Op,
+		Kind:     err.Kind.Error(),
+		Message:  err.Err.Error(),
+		TimeNs:   time.Now().UnixNano(),
+		Sequence: v.writingSequence,
+	}
+	if dbErr := v.putKeyValue(keyForError(relativePath), &record); dbErr != nil {
+		return dbErr
+	}
+	v.skippedLock.Lock()
+	delete(v.staleErrors, relativePath)
+	v.skippedLock.Unlock()
+	return nil
+}
+
+// Loads paths recorded as failed before an update. The ones not failing
+// again are removed when the update is committed.
+func (v *Indexer) loadStaleErrors() error {
+	v.staleErrors = make(map[string]bool)
+	return v.IterErrors(func(record *protos.ErrorRecord) bool {
+		v.staleErrors[record.Path] = true
+		return true
+	})
+}
+
+func (v *Indexer) removeStaleErrors() error {
+	for relativePath := range v.staleErrors {
+		if err := v.deleteKey(keyForError(relativePath)); err != nil {
+			return err
+		}
+	}
+	v.staleErrors = nil
+	return nil
+}
+
+type IterErrorFunc func(record *protos.ErrorRecord) bool
+
+// Iterates paths which failed and are not indexed since.
+func (v *Indexer) IterErrors(iterFunc IterErrorFunc) error {
+	return v.iterPrefix(string(PREFIX_ERROR), func(key string, value []byte) (bool, error) {
+		var record protos.ErrorRecord
+		if err := proto.Unmarshal(value, &record); err != nil {
+			return false, newCorruptRecordError(key, err)
+		}
+		return iterFunc(&record), nil
+	})
+}
+
+// Indexes only the paths recorded as failed, without walking the base dir.
+// Totals of their ancestor dirs are updated as well.
+func (v *Indexer) RetryFailed() error {
+	if v.readingSequence == 0 {
+		return errors.New("index has not been updated yet")
+	}
+	records := []*protos.ErrorRecord{}
+	err := v.IterErrors(func(record *protos.ErrorRecord) bool {
+		records = append(records, record)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	v.skippedLock.Lock()
+	v.skipped = nil
+	v.skippedLock.Unlock()
+
+	return v.withCommittedSequence(func() error {
+		deltas := make([]RepositoryInfo, len(records))
+		err := v.runPipeline(func() error {
+			for i, record := range records {
+				if err := v.retryPath(record.Path, &deltas[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i, record := range records {
+			if err := v.addToAncestors(record.Path, &deltas[i]); err != nil {
+				return err
+			}
+			// duplicates in a dir indexed now.
+			if err := v.updateDirStats(record.Path); err != nil {
+				return err
+			}
+		}
+		return v.updateDirHashes()
+	})
+}
+
+func (v *Indexer) retryPath(relativePath string, delta *RepositoryInfo) error {
+	if err := v.deleteKey(keyForError(relativePath)); err != nil {
+		return err
+	}
+	path := filepath.Join(v.baseDir, relativePath)
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return v.failPath(newPathError("lstat", path, err))
+	}
+	if v.rules.Excluded(relativePath, info.IsDir()) {
+		return nil
+	}
+	meta, err := v.getFileMeta(relativePath)
+	if err != nil || meta != nil {
+		// indexed since it failed.
+		return err
+	}
+	if info.IsDir() {
+		_, err = v.updateDir(path, info, delta)
+		return err
+	}
+	return v.updateFile(path, info, delta)
+}
+
+// Adds totals of a newly indexed path to its ancestor dirs.
+func (v *Indexer) addToAncestors(relativePath string, delta *RepositoryInfo) error {
+	if delta.FileCount == 0 && delta.FileSize == 0 && delta.DirCount == 0 {
+		return nil
+	}
+	return v.updateAncestors(relativePath, func(dir string, dirInfo *protos.DirInfo) {
+		dirInfo.TotalFileCount += delta.FileCount
+		dirInfo.TotalFileSize += delta.FileSize
+		dirInfo.TotalDirCount += delta.DirCount
+	})
+}
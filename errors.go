@@ -0,0 +1,67 @@
+package fileindexer
+
+import (
+	"errors"
+	"os"
+)
+
+// Kinds of errors returned by the package. Use errors.Is to check them.
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrPermission    = errors.New("permission denied")
+	ErrCorruptRecord = errors.New("corrupt record")
+	ErrIO            = errors.New("i/o error")
+	ErrDb            = errors.New("index db error")
+	// The index was written by a newer version of the package.
+	ErrSchemaTooNew = errors.New("index schema too new")
+	// A file changed since it was indexed, or is not a copy of another.
+	ErrMismatch = errors.New("files differ")
+)
+
+// PathError records an operation that failed on a file or on a db key.
+type PathError struct {
+	Op   string
+	Path string
+	// One of the Err* kinds.
+	Kind error
+	Err  error
+}
+
+func (e *PathError) Error() string {
+	return e.Op + " " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *PathError) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *PathError) Unwrap() error {
+	return e.Err
+}
+
+// Returns a PathError for a failed file system operation.
+func newPathError(op string, path string, err error) *PathError {
+	kind := ErrIO
+	if os.IsPermission(err) {
+		kind = ErrPermission
+	} else if os.IsNotExist(err) {
+		kind = ErrNotFound
+	}
+	return &PathError{Op: op, Path: path, Kind: kind, Err: err}
+}
+
+func newDbError(op string, key string, err error) *PathError {
+	return &PathError{Op: op, Path: key, Kind: ErrDb, Err: err}
+}
+
+func newCorruptRecordError(key string, err error) *PathError {
+	return &PathError{Op: "unmarshal", Path: key, Kind: ErrCorruptRecord, Err: err}
+}
+
+// Policies for unreadable paths during Update.
+const (
+	// Aborts Update with the error.
+	ON_ERROR_ABORT = 0
+	// Skips the path and records the error, see SkippedPaths.
+	ON_ERROR_SKIP = 1
+)
@@ -0,0 +1,10 @@
+package fileindexer
+
+// Calls hook at points where a crash is simulated, see crash.
+func SetCrashHook(v *Indexer, hook func(point string)) {
+	v.crashHook = hook
+}
+
+func SetBatchSize(v *Indexer, size int) {
+	v.batchSize = size
+}
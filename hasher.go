@@ -0,0 +1,115 @@
+package fileindexer
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"github.com/cespare/xxhash"
+	"golang.org/x/crypto/blake2b"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Hasher computes file digests for one hash algorithm. The algorithm name is
+// stored in DbMeta and used to tag every digest in the index, e.g.
+// "sha256:9f86d0...".
+type Hasher interface {
+	Name() string
+	New() hash.Hash
+}
+
+const DEFAULT_HASH = "md5"
+
+type simpleHasher struct {
+	name    string
+	newFunc func() hash.Hash
+}
+
+func (h *simpleHasher) Name() string {
+	return h.name
+}
+
+func (h *simpleHasher) New() hash.Hash {
+	return h.newFunc()
+}
+
+var hashers = make(map[string]Hasher)
+
+// Registers a hash algorithm so it can be selected by name. Names must not
+// contain ':' since it separates the algorithm from the digest.
+func RegisterHasher(name string, newFunc func() hash.Hash) {
+	if strings.Contains(name, ":") {
+		panic("invalid hasher name: " + name)
+	}
+	hashers[name] = &simpleHasher{name, newFunc}
+}
+
+func GetHasher(name string) (Hasher, error) {
+	if name == "" {
+		name = DEFAULT_HASH
+	}
+	hasher, ok := hashers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash algorithm %q, available: %s",
+			name, strings.Join(HasherNames(), ", "))
+	}
+	return hasher, nil
+}
+
+func HasherNames() []string {
+	names := make([]string, 0, len(hashers))
+	for name := range hashers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterHasher("md5", md5.New)
+	RegisterHasher("sha1", sha1.New)
+	RegisterHasher("sha256", sha256.New)
+	RegisterHasher("sha512", sha512.New)
+	RegisterHasher("blake2b", func() hash.Hash {
+		h, _ := blake2b.New256(nil)
+		return h
+	})
+	RegisterHasher("xxhash", func() hash.Hash {
+		return xxhash.New()
+	})
+}
+
+// Returns digest tagged with its algorithm, e.g. "md5:900150983cd24fb0...".
+func TagDigest(algorithm string, sum []byte) string {
+	return algorithm + ":" + hex.EncodeToString(sum)
+}
+
+// Splits a tagged digest into algorithm and hex digest. Untagged digests are
+// legacy md5 sums.
+func SplitDigest(digest string) (string, string) {
+	if i := strings.IndexByte(digest, ':'); i >= 0 {
+		return digest[:i], digest[i+1:]
+	}
+	return DEFAULT_HASH, digest
+}
+
+func HashFile(filePath string, hasher Hasher) (string, error) {
+	var ret string
+	file, err := os.Open(filePath)
+	if err != nil {
+		return ret, err
+	}
+	defer file.Close()
+	hash := hasher.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return ret, err
+	}
+	ret = TagDigest(hasher.Name(), hash.Sum(nil))
+	return ret, nil
+}
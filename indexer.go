@@ -1,26 +1,49 @@
 package fileindexer
 
 import (
+	"errors"
 	"fmt"
 	"github.com/golang/protobuf/proto"
 	"github.com/idlecat/fileindexer/protos"
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/opt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"sync"
 	"time"
 )
 
 type Indexer struct {
 	baseDir         string
-	db              *leveldb.DB
+	backend         string
+	db              Store
 	err             error
 	dbMeta          *protos.DbMeta
 	readingSequence int32
 	writingSequence int32
+	hasher          Hasher
+	rules           *Rules
+	workers         int
+	hashMode        int
+	errorPolicy     int
+	watchDelay      time.Duration
+	pipeline        *updatePipeline
+	// Set while Update resumes an interrupted update.
+	resuming    bool
+	batchLock   sync.Mutex
+	batch       *writeBatch
+	batchSize   int
+	crashHook   func(point string)
+	skippedLock sync.Mutex
+	skipped     []*PathError
+	// Paths failed before the running Update which have not failed again.
+	staleErrors map[string]bool
+	// Set while duplicate totals and content hashes of dirs are not kept up
+	// to date, as they are recomputed after.
+	deferDirStats bool
+	// Dirs whose content hash is to be recomputed, see dirChanged.
+	dirtyDirs map[string]bool
 }
 
 type RepositoryInfo struct {
@@ -49,86 +72,154 @@ func (v *RepositoryInfo) Add(other *RepositoryInfo) {
 }
 
 const (
-	PREFIX_FILE = 'f'
-	PREFIX_HASH = 'h'
-	KEY_DB_META = "."
+	PREFIX_FILE       = 'f'
+	PREFIX_HASH       = 'h'
+	PREFIX_SIZE       = 's'
+	PREFIX_QUICK_HASH = 'q'
+	PREFIX_ERROR      = 'e'
+	PREFIX_DIR_HASH   = 'd'
+	PREFIX_JOURNAL    = 'j'
+	PREFIX_DECISION   = 'r'
+	KEY_DB_META       = "."
 )
 
+// Hash modes of Update.
+const (
+	// Hashes every new or changed file.
+	HASH_ALL = 0
+	// Hashes only files whose size collides with another file. Other files
+	// are indexed as unhashed.
+	HASH_SIZE_FIRST = 1
+	// Like HASH_SIZE_FIRST, but files whose size collides are quick hashed
+	// first and only files whose quick hash collides are hashed.
+	HASH_QUICK_FIRST = 2
+)
+
+// Sets the backend the index is opened with, one of BACKEND_*. Defaults to
+// BACKEND_LEVELDB.
+func (v *Indexer) SetBackend(backend string) {
+	v.backend = backend
+}
+
+func (v *Indexer) openStore(indexDir string, options *StoreOptions) error {
+	backend := v.backend
+	if backend == "" {
+		backend = BACKEND_LEVELDB
+	}
+	db, err := OpenStore(backend, indexDir, options)
+	if err != nil {
+		return err
+	}
+	v.db = db
+	return nil
+}
+
 func (v *Indexer) OpenOrCreate(indexDir string) {
-	v.db, v.err = leveldb.OpenFile(indexDir, nil)
+	if err := v.openStore(indexDir, nil); err != nil {
+		v.err = newDbError("open", indexDir, err)
+		return
+	}
+	v.dbMeta, v.err = v.getDbMeta()
 	if v.err != nil {
 		return
 	}
-	v.dbMeta = v.getDbMeta()
 
 	if v.dbMeta == nil {
 		v.dbMeta = &protos.DbMeta{
-			BaseDir:  v.baseDir,
-			Sequence: 0,
+			BaseDir:       v.baseDir,
+			Sequence:      0,
+			HashAlgorithm: DEFAULT_HASH,
+			SizeIndexed:   true,
+			QuickHashKiB:  DEFAULT_QUICK_HASH_KIB,
+			Rules:         DefaultRules().Lines(),
+			NsTimes:       true,
+			SchemaVersion: SCHEMA_VERSION,
 		}
+	} else if v.err = v.upgrade(indexDir); v.err != nil {
+		return
+	}
+	v.hasher, v.err = GetHasher(v.dbMeta.HashAlgorithm)
+	if v.err != nil {
+		return
 	}
+	v.rules, v.err = ParseRules(v.dbMeta.Rules)
 	v.readingSequence = v.dbMeta.Sequence
 	v.writingSequence = v.readingSequence + 1
 	log.Printf("Open indexer db with sequence %d", v.readingSequence)
 }
 
-func (v *Indexer) OpenOrDie(indexDir string) {
-	options := opt.Options{
-		ErrorIfMissing: true,
+// Opens an existing index. Its base dir is read from the index.
+func (v *Indexer) Open(indexDir string) error {
+	if err := v.openStore(indexDir, &StoreOptions{MustExist: true}); err != nil {
+		v.err = &PathError{Op: "open", Path: indexDir, Kind: ErrNotFound, Err: err}
+		return v.err
 	}
-	v.db, v.err = leveldb.OpenFile(indexDir, &options)
+	v.dbMeta, v.err = v.getDbMeta()
 	if v.err != nil {
-		log.Fatal("No index found at " + indexDir)
+		return v.err
 	}
-	v.dbMeta = v.getDbMeta()
 	if v.dbMeta == nil {
-		log.Fatal("No db meta found")
+		v.err = &PathError{Op: "open", Path: indexDir, Kind: ErrNotFound, Err: errors.New("no db meta found")}
+		return v.err
+	}
+	if v.err = v.upgrade(indexDir); v.err != nil {
+		return v.err
+	}
+	v.hasher, v.err = GetHasher(v.dbMeta.HashAlgorithm)
+	if v.err != nil {
+		return v.err
+	}
+	v.rules, v.err = ParseRules(v.dbMeta.Rules)
+	if v.err != nil {
+		return v.err
 	}
 	v.readingSequence = v.dbMeta.Sequence
 	v.writingSequence = v.readingSequence + 1
 	v.baseDir = v.dbMeta.BaseDir
 	log.Printf("Open indexer db with sequence %d", v.readingSequence)
+	return nil
 }
 
-// Quickly scan the directory to get file numbers and total size.
-func (v *Indexer) QuickScan(info *RepositoryInfo) {
-	fileInfo, err := os.Lstat(v.baseDir)
-	if err != nil {
-		log.Fatal("Lstat failed on " + v.baseDir)
+func (v *Indexer) OpenOrDie(indexDir string) {
+	if err := v.Open(indexDir); err != nil {
+		log.Fatal(err)
 	}
-	v.quickScanInternal(v.baseDir, fileInfo, info)
 }
 
-func (v *Indexer) shouldSkipPath(path string) bool {
-	relativePath := path[len(v.baseDir):]
-	if relativePath == "/fileIndexerDb" {
-		return true
-	}
-	if filepath.Base(relativePath) == "@eaDir" {
-		return true
+// Quickly scan the directory to get file numbers and total size.
+func (v *Indexer) QuickScan(info *RepositoryInfo) error {
+	fileInfo, err := os.Lstat(v.baseDir)
+	if err != nil {
+		return newPathError("lstat", v.baseDir, err)
 	}
-	return false
+	return v.quickScanInternal(v.baseDir, fileInfo, info)
 }
 
-func (v *Indexer) quickScanInternal(dir string, info os.FileInfo, rInfo *RepositoryInfo) {
-	if v.shouldSkipPath(dir) {
-		return
+func (v *Indexer) quickScanInternal(dir string, info os.FileInfo, rInfo *RepositoryInfo) error {
+	if v.isExcluded(dir, true) {
+		return nil
 	}
 
 	infos, err := ioutil.ReadDir(dir)
 	if err != nil {
-		log.Fatal("readDir failed on " + dir)
+		return v.skipOrAbort(newPathError("readdir", dir, err))
 	}
 
 	for _, info := range infos {
+		if v.isExcluded(filepath.Join(dir, info.Name()), info.IsDir()) {
+			continue
+		}
 		if info.IsDir() {
-			v.quickScanInternal(filepath.Join(dir, info.Name()), info, rInfo)
+			if err := v.quickScanInternal(filepath.Join(dir, info.Name()), info, rInfo); err != nil {
+				return err
+			}
 			rInfo.DirCount += 1
 		} else {
 			rInfo.FileCount += 1
 			rInfo.FileSize += info.Size()
 		}
 	}
+	return nil
 }
 
 func (v *Indexer) Close() {
@@ -146,60 +237,192 @@ func (v *Indexer) GetError() error {
 	return v.err
 }
 
-func (v *Indexer) GetFileOrDirMeta(relativePath string) *protos.FileMeta {
-	var meta protos.FileMeta
-	if v.getProto(keyForPath(relativePath), &meta) {
-		return &meta
-	} else {
+func (v *Indexer) GetHasher() Hasher {
+	return v.hasher
+}
+
+// Selects the hash algorithm of a new index. The algorithm of an index which
+// has already been updated can only be changed by Rehash.
+func (v *Indexer) SetHasher(name string) error {
+	hasher, err := GetHasher(name)
+	if err != nil {
+		return err
+	}
+	if hasher.Name() == v.dbMeta.HashAlgorithm {
 		return nil
 	}
+	if v.readingSequence != 0 {
+		return fmt.Errorf("index uses %s, rehash it to switch to %s",
+			v.dbMeta.HashAlgorithm, hasher.Name())
+	}
+	v.hasher = hasher
+	v.dbMeta.HashAlgorithm = hasher.Name()
+	return nil
+}
+
+// Sets the number of files hashed concurrently by Update. Defaults to 1.
+func (v *Indexer) SetWorkers(workers int) {
+	v.workers = workers
+}
+
+// Sets one of HASH_* modes for Update. Defaults to HASH_ALL.
+func (v *Indexer) SetHashMode(mode int) {
+	v.hashMode = mode
+}
+
+// Sets one of ON_ERROR_* policies for unreadable paths. Defaults to
+// ON_ERROR_ABORT. Db errors always abort.
+func (v *Indexer) SetErrorPolicy(policy int) {
+	v.errorPolicy = policy
 }
 
-func (v *Indexer) getDbMeta() *protos.DbMeta {
+// Returns paths skipped by the last Update under ON_ERROR_SKIP.
+func (v *Indexer) SkippedPaths() []*PathError {
+	v.skippedLock.Lock()
+	defer v.skippedLock.Unlock()
+	return append([]*PathError(nil), v.skipped...)
+}
+
+// Returns nil after recording err if unreadable paths are skipped, or err
+// otherwise.
+func (v *Indexer) skipOrAbort(err *PathError) error {
+	if v.errorPolicy != ON_ERROR_SKIP {
+		return err
+	}
+	log.Print(err)
+	v.skippedLock.Lock()
+	v.skipped = append(v.skipped, err)
+	v.skippedLock.Unlock()
+	return nil
+}
+
+// Returns meta of a file or dir, or an ErrNotFound error if it is not
+// indexed.
+func (v *Indexer) GetFileOrDirMeta(relativePath string) (*protos.FileMeta, error) {
+	meta, err := v.getFileMeta(relativePath)
+	if err == nil && meta == nil {
+		err = &PathError{Op: "get", Path: relativePath, Kind: ErrNotFound, Err: errors.New("not indexed")}
+	}
+	return meta, err
+}
+
+// Returns nil without error if relativePath is not indexed.
+func (v *Indexer) getFileMeta(relativePath string) (*protos.FileMeta, error) {
+	var meta protos.FileMeta
+	if found, err := v.getProto(keyForPath(relativePath), &meta); !found {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+func (v *Indexer) getDbMeta() (*protos.DbMeta, error) {
 	var meta protos.DbMeta
-	if v.getProto(KEY_DB_META, &meta) {
-		return &meta
-	} else {
-		return nil
+	if found, err := v.getProto(KEY_DB_META, &meta); !found {
+		return nil, err
 	}
+	return &meta, nil
 }
 
-func (v *Indexer) getProto(key string, msg proto.Message) bool {
-	data, err := v.db.Get([]byte(key), nil)
+// Returns false without error if key is not found.
+func (v *Indexer) getProto(key string, msg proto.Message) (bool, error) {
+	var data []byte
+	var err error
+	batch := v.getBatch()
+	found := true
+	if batch == nil {
+		data, found, err = v.db.Get([]byte(key))
+	} else if pending, ok := batch.get(key); !ok {
+		data, found, err = v.db.Get([]byte(key))
+	} else if pending == nil {
+		found = false
+	} else {
+		data = pending
+	}
 	if err != nil {
-		if err != leveldb.ErrNotFound {
-			log.Fatal("Unexpected error:", err)
-		}
-		return false
+		return false, newDbError("get", key, err)
+	} else if !found {
+		return false, nil
 	}
 	err = proto.Unmarshal(data, msg)
 	if err != nil {
-		log.Fatal("Unmarshal failed")
+		return false, newCorruptRecordError(key, err)
 	}
-	return true
+	return true, nil
 }
 
 func (v *Indexer) Update() error {
+	v.skippedLock.Lock()
+	v.skipped = nil
+	v.skippedLock.Unlock()
+	if err := v.loadStaleErrors(); err != nil {
+		return err
+	}
+
 	// Updating dirs and files
 	fileInfo, err := os.Lstat(v.baseDir)
 	if err != nil {
-		log.Fatal("Lstat failed on " + v.baseDir)
+		return newPathError("lstat", v.baseDir, err)
+	}
+	// An interrupted update is resumed with its sequence, see completedDir.
+	// Otherwise its sequence is not reused, as entries of it may be left.
+	v.resuming = v.canResume()
+	if v.resuming {
+		v.writingSequence = v.dbMeta.UpdatingSequence
+		log.Printf("Resuming interrupted update %d", v.writingSequence)
+	} else if v.writingSequence <= v.dbMeta.UpdatingSequence {
+		v.writingSequence = v.dbMeta.UpdatingSequence + 1
+	}
+	v.dbMeta.UpdatingSequence = v.writingSequence
+	v.dbMeta.UpdatingRules = v.rules.Lines()
+	if err := v.putKeyValue(KEY_DB_META, v.dbMeta); err != nil {
+		return err
+	}
+
+	v.beginBatch()
+	// recomputed at the commit.
+	v.deferDirStats = true
+	var info *RepositoryInfo
+	err = v.runPipeline(func() (err error) {
+		info, err = v.updateDir(v.baseDir, fileInfo, nil)
+		return err
+	})
+	if err == nil {
+		// removed entries are found in the db.
+		err = v.flushBatch()
 	}
-	info := v.updateDir(v.baseDir, fileInfo)
-
-	// Commiting new sequence
-	v.dbMeta.Sequence = v.writingSequence
+	if err == nil {
+		err = v.commitUpdate(info)
+	}
+	// written even on errors, for the failed paths recorded.
+	if endErr := v.endBatch(); err == nil {
+		err = endErr
+	}
+	v.deferDirStats = false
+	if err != nil {
+		v.dbMeta.Sequence = v.readingSequence
+		v.dbMeta.UpdatingSequence = v.writingSequence
+		v.dbMeta.UpdatingRules = v.rules.Lines()
+		return err
+	}
+	v.resuming = false
 	v.readingSequence = v.writingSequence
 	v.writingSequence++
-	v.putKeyValue(KEY_DB_META, v.dbMeta)
 
-	// Removing obsoleted dir/file from index.
+	if v.hashMode != HASH_ALL {
+		return v.HashCollisions()
+	}
+	return nil
+}
+
+// Removes entries not visited by the update and commits its sequence. All
+// of it is written in one batch, which is the commit point of the update.
+func (v *Indexer) commitUpdate(info *RepositoryInfo) error {
 	var removedFileCount int32 = 0
 	var removedFileSize int64 = 0
 	var removedDirCount int32 = 0
 	removedItems := make([]*protos.FileMeta, 0, 100)
-	v.Iter(func(path string, meta *protos.FileMeta) {
-		if meta.Sequence != v.dbMeta.Sequence {
+	err := v.Iter(func(path string, meta *protos.FileMeta) bool {
+		if meta.Sequence != v.writingSequence {
 			meta.RelativePath = path
 			removedItems = append(removedItems, meta)
 			if meta.IsDir {
@@ -209,146 +432,347 @@ func (v *Indexer) Update() error {
 				removedFileSize += meta.Size
 			}
 		}
+		return true
 	})
-	info.RemovedFileCount = removedFileCount
-	info.RemovedFileSize = removedFileSize
-	info.RemovedDirCount = removedDirCount
+	if err != nil {
+		return err
+	}
+	// a resumed update may have removed some while walking.
+	info.RemovedFileCount += removedFileCount
+	info.RemovedFileSize += removedFileSize
+	info.RemovedDirCount += removedDirCount
 	for _, meta := range removedItems {
-		v.removeItem(meta)
+		if err := v.removeItem(meta); err != nil {
+			return err
+		}
+	}
+	if err := v.removeStaleErrors(); err != nil {
+		return err
+	}
+	// duplicates are known once all files are.
+	if err := v.updateDirStats(""); err != nil {
+		return err
+	}
+
+	v.dbMeta.Sequence = v.writingSequence
+	v.dbMeta.UpdatingSequence = 0
+	v.dbMeta.UpdatingRules = nil
+	v.dbMeta.Rules = v.rules.Lines()
+	if err := v.putKeyValue(KEY_DB_META, v.dbMeta); err != nil {
+		return err
 	}
+	v.crash("commit")
 	return nil
 }
 
-type IterFunc func(path string, meta *protos.FileMeta)
-
-func (v *Indexer) Iter(iterFunc IterFunc) {
-	iter := v.db.NewIterator(nil, nil)
-	for iter.Next() {
-		key := string(iter.Key())
-		if key[0] != PREFIX_FILE {
-			continue
+// Runs walk with a new pipeline and waits until its tasks are applied. Writes
+// are batched unless the caller batches them already.
+func (v *Indexer) runPipeline(walk func() error) error {
+	batching := v.beginBatch()
+	v.pipeline = newUpdatePipeline(v, v.workers)
+	err := walk()
+	if closeErr := v.pipeline.close(); err == nil {
+		err = closeErr
+	}
+	v.pipeline = nil
+	if batching {
+		if endErr := v.endBatch(); err == nil {
+			err = endErr
 		}
-		var meta protos.FileMeta
-		proto.Unmarshal(iter.Value(), &meta)
-		iterFunc(key[1:], &meta)
 	}
-	iter.Release()
+	return err
 }
 
-type IterHashFunc func(hash string, fileSize int64, paths []string)
+// Runs fn writing entries with the committed sequence, for changes applied
+// outside of an Update.
+func (v *Indexer) withCommittedSequence(fn func() error) error {
+	writingSequence := v.writingSequence
+	v.writingSequence = v.readingSequence
+	defer func() { v.writingSequence = writingSequence }()
+	return fn()
+}
 
-func (v *Indexer) IterHash(iterFunc IterHashFunc) {
-	iter := v.db.NewIterator(nil, nil)
-	for iter.Next() {
-		key := string(iter.Key())
-		if key[0] != PREFIX_HASH {
-			continue
+// Iteration stops when an iter func returns false.
+type IterFunc func(path string, meta *protos.FileMeta) bool
+
+// Iterates all files and dirs.
+func (v *Indexer) Iter(iterFunc IterFunc) error {
+	return v.iterFiles(keyForPath(""), iterFunc)
+}
+
+// Iterates files and dirs under relativeDir, not including relativeDir
+// itself. All of the index for "".
+func (v *Indexer) IterDir(relativeDir string, iterFunc IterFunc) error {
+	if relativeDir == "" {
+		return v.Iter(iterFunc)
+	}
+	return v.iterFiles(keyForPath(relativeDir+"/"), iterFunc)
+}
+
+func (v *Indexer) iterFiles(prefix string, iterFunc IterFunc) error {
+	return v.iterPrefix(prefix, func(key string, value []byte) (bool, error) {
+		var meta protos.FileMeta
+		if err := proto.Unmarshal(value, &meta); err != nil {
+			return false, newCorruptRecordError(key, err)
 		}
+		return iterFunc(key[1:], &meta), nil
+	})
+}
+
+type IterHashFunc func(hash string, fileSize int64, paths []string) bool
+
+func (v *Indexer) IterHash(iterFunc IterHashFunc) error {
+	return v.iterPaths(PREFIX_HASH, func(key string, paths *protos.FilePaths) bool {
+		return iterFunc(key[1:], paths.FileSize, paths.Paths)
+	})
+}
+
+// Iterates FilePaths stored under given key prefix.
+func (v *Indexer) iterPaths(prefix byte, iterFunc func(key string, paths *protos.FilePaths) bool) error {
+	return v.iterPrefix(string(prefix), func(key string, value []byte) (bool, error) {
 		var paths protos.FilePaths
-		proto.Unmarshal(iter.Value(), &paths)
-		iterFunc(key[1:], paths.FileSize, paths.Paths)
+		if err := proto.Unmarshal(value, &paths); err != nil {
+			return false, newCorruptRecordError(key, err)
+		}
+		return iterFunc(key, &paths), nil
+	})
+}
+
+// Iterates the keys starting with prefix, and only those, until iterFunc
+// returns false or an error. Pending writes of keys in the db are seen, keys
+// only in the pending batch are not.
+func (v *Indexer) iterPrefix(prefix string, iterFunc func(key string, value []byte) (bool, error)) error {
+	var iterErr error
+	err := v.db.Iterate([]byte(prefix), nil, func(key []byte, value []byte) bool {
+		value, deleted := v.withPending(key, value)
+		if deleted {
+			return true
+		}
+		var more bool
+		more, iterErr = iterFunc(string(key), value)
+		return more && iterErr == nil
+	})
+	if err != nil {
+		return newDbError("iterate", prefix, err)
 	}
-	iter.Release()
+	return iterErr
 }
 
-func (v *Indexer) updateDir(dir string, info os.FileInfo) *RepositoryInfo {
+func (v *Indexer) updateDir(dir string, info os.FileInfo, parent *RepositoryInfo) (*RepositoryInfo, error) {
 	fmt.Println("updating dir:" + dir)
-	if v.shouldSkipPath(dir) {
-		return nil
+	if v.isExcluded(dir, true) {
+		return nil, nil
+	}
+	if v.resuming {
+		if rInfo, err := v.completedDir(dir, parent); rInfo != nil || err != nil {
+			return rInfo, err
+		}
 	}
 	dirInfo := &protos.DirInfo{
-		UpdateTimeStart: int32(time.Now().Unix()),
+		UpdateTimeStartNs: time.Now().UnixNano(),
 	}
 	meta := protos.FileMeta{
 		Size:     info.Size(),
 		IsDir:    true,
-		ModTime:  int32(info.ModTime().Unix()),
 		Sequence: v.writingSequence,
 		DirInfo:  dirInfo}
+	setStat(&meta, info)
 
 	infos, err := ioutil.ReadDir(dir)
 	if err != nil {
-		log.Fatal("readDir failed on " + dir)
+		// the dir is removed from the index if skipped.
+		return nil, v.failPath(newPathError("readdir", dir, err))
 	}
 
 	rInfo := RepositoryInfo{}
+	if v.resuming {
+		if err := v.removeVanished(dir, infos, &rInfo); err != nil {
+			return nil, err
+		}
+	}
 	for _, info := range infos {
 		if info.IsDir() {
-			rInfo.Add(v.updateDir(filepath.Join(dir, info.Name()), info))
-			rInfo.DirCount += 1
-		} else {
-			rInfo.Add(v.updateFile(filepath.Join(dir, info.Name()), info))
+			_, err = v.updateDir(filepath.Join(dir, info.Name()), info, &rInfo)
+		} else if !v.isExcluded(filepath.Join(dir, info.Name()), false) {
+			err = v.updateFile(filepath.Join(dir, info.Name()), info, &rInfo)
+		}
+		if err != nil {
+			return nil, err
 		}
 	}
-	dirInfo.TotalFileCount = rInfo.FileCount
-	dirInfo.TotalFileSize = rInfo.FileSize
-	dirInfo.UpdateTimeEnd = int32(time.Now().Unix())
-	v.putFileOrDirMeta(dir, &meta)
-	return &rInfo
+	// Totals are filled when the pipeline reaches the end of this dir.
+	err = v.pipeline.submit(&updateTask{path: dir, info: info, meta: &meta, rInfo: &rInfo, parent: parent})
+	return &rInfo, err
 }
 
-func (v *Indexer) updateFile(file string, info os.FileInfo) *RepositoryInfo {
-	rInfo := RepositoryInfo{
-		FileCount: 1,
-		FileSize:  info.Size(),
+func (v *Indexer) applyDir(task *updateTask) error {
+	dirInfo := task.meta.DirInfo
+	dirInfo.TotalFileCount = task.rInfo.FileCount
+	dirInfo.TotalFileSize = task.rInfo.FileSize
+	dirInfo.TotalDirCount = task.rInfo.DirCount
+	dirInfo.UniqueFileSize = task.rInfo.FileSize
+	dirInfo.UpdateTimeEndNs = time.Now().UnixNano()
+	relativePath := v.getRelativePath(task.path)
+	old, err := v.getFileMeta(relativePath)
+	if err != nil {
+		return err
 	}
-	relativePath := v.getRelativePath(file)
-	meta := v.GetFileOrDirMeta(relativePath)
-	md5sum := ""
-	var err error
-	if meta == nil || meta.Size != info.Size() || meta.ModTime != int32(info.ModTime().Unix()) {
-		// calculates hash for new/changed file.
-		md5sum, err = HashFile(file)
-		if err != nil {
-			log.Print(err)
-			return nil
+	if old != nil && old.DirInfo != nil {
+		// kept until the hash is recomputed, which moves the dir in the dir
+		// hash index.
+		dirInfo.ContentHash = old.DirInfo.ContentHash
+	}
+	if err := v.putFileOrDirMeta(task.path, task.meta); err != nil {
+		return err
+	}
+	v.dirChanged(relativePath)
+	if task.parent != nil {
+		task.parent.Add(task.rInfo)
+		task.parent.DirCount += 1
+	}
+	return nil
+}
+
+func (v *Indexer) updateFile(file string, info os.FileInfo, parent *RepositoryInfo) error {
+	meta, err := v.getFileMeta(v.getRelativePath(file))
+	if err != nil {
+		return err
+	}
+	// a symlink is indexed as the file it links to, so it is not taken for
+	// a copy of it.
+	info = followSymlink(file, info)
+	task := &updateTask{path: file, info: info, meta: meta, parent: parent}
+	same := meta != nil && unchanged(meta, info)
+	if !same || !v.isCurrentDigest(meta.Hash) {
+		// calculates hash for new/changed/unhashed file, unless sizes go first.
+		task.needHash = v.hashMode == HASH_ALL
+		if same && v.isCurrentDigest(meta.QuickHash) {
+			task.quickDigest = meta.QuickHash
 		}
 	} else {
-		md5sum = meta.Md5Sum
+		task.digest = meta.Hash
+		if v.isCurrentDigest(meta.QuickHash) {
+			task.quickDigest = meta.QuickHash
+		}
 	}
+	return v.pipeline.submit(task)
+}
+
+func (v *Indexer) applyFile(task *updateTask) (*RepositoryInfo, error) {
+	if task.err != nil {
+		return nil, v.failPath(newPathError("hash", task.path, task.err))
+	}
+	info := task.info
+	rInfo := RepositoryInfo{
+		FileCount: 1,
+		FileSize:  info.Size(),
+	}
+	relativePath := v.getRelativePath(task.path)
+	meta := task.meta
+	digest := task.digest
 
 	newMeta := protos.FileMeta{
-		Size:     info.Size(),
-		IsDir:    false,
-		Md5Sum:   md5sum,
-		ModTime:  int32(info.ModTime().Unix()),
-		Sequence: v.writingSequence,
+		Size:      info.Size(),
+		IsDir:     false,
+		Hash:      digest,
+		Sequence:  v.writingSequence,
+		Unhashed:  digest == "",
+		QuickHash: task.quickDigest,
+	}
+	setStat(&newMeta, info)
+	if err := v.putFileOrDirMeta(task.path, &newMeta); err != nil {
+		return nil, err
+	}
+	v.dirChanged(relativePath)
+	if meta != nil && meta.QuickHash != "" && meta.QuickHash != newMeta.QuickHash {
+		if err := v.removeQuickHash(meta.QuickHash, relativePath); err != nil {
+			return nil, err
+		}
 	}
-	v.putFileOrDirMeta(file, &newMeta)
-	if meta == nil || meta.Md5Sum != md5sum {
-		// need to update hash entry.
+	if meta == nil || meta.Size != info.Size() {
 		if meta != nil {
-			v.removeHash(meta.Md5Sum, relativePath)
+			if err := v.removeSize(meta.Size, relativePath); err != nil {
+				return nil, err
+			}
+		}
+		if err := v.addSize(info.Size(), relativePath); err != nil {
+			return nil, err
+		}
+	}
+	if meta == nil || meta.Hash != digest || meta.Size != info.Size() ||
+		linkId(relativePath, meta) != linkId(relativePath, &newMeta) {
+		// need to update hash entry, which counts links of a file once.
+		if meta != nil && meta.Hash != "" {
+			if err := v.removeHash(meta.Hash, meta, relativePath); err != nil {
+				return nil, err
+			}
+		}
+		if digest != "" {
+			if err := v.addHash(digest, &newMeta, relativePath); err != nil {
+				return nil, err
+			}
 		}
-		v.addHash(md5sum, info.Size(), relativePath)
 		rInfo.ChangedFileCount = 1
 		rInfo.ChangedFileSize = info.Size()
 	}
-	return &rInfo
+	return &rInfo, nil
 }
 
-func (v *Indexer) removeItem(meta *protos.FileMeta) {
-	key := keyForPath(meta.RelativePath)
-	v.db.Delete([]byte(key), nil)
-	if !meta.IsDir {
-		v.removeHash(meta.Md5Sum, meta.RelativePath)
+func (v *Indexer) removeItem(meta *protos.FileMeta) error {
+	if err := v.deleteKey(keyForPath(meta.RelativePath)); err != nil {
+		return err
+	}
+	v.dirChanged(meta.RelativePath)
+	if meta.IsDir {
+		if meta.DirInfo == nil || meta.DirInfo.ContentHash == "" {
+			return nil
+		}
+		_, err := v.removePath(keyForDirHash(meta.DirInfo.ContentHash), meta.RelativePath)
+		return err
+	}
+	if meta.Hash != "" {
+		if err := v.removeHash(meta.Hash, meta, meta.RelativePath); err != nil {
+			return err
+		}
 	}
+	if meta.QuickHash != "" {
+		if err := v.removeQuickHash(meta.QuickHash, meta.RelativePath); err != nil {
+			return err
+		}
+	}
+	return v.removeSize(meta.Size, meta.RelativePath)
 }
 
-func (v *Indexer) putKeyValue(key string, value proto.Message) {
+func (v *Indexer) putKeyValue(key string, value proto.Message) error {
 	json, err := proto.Marshal(value)
 	if err != nil {
-		log.Fatal("Failed to marshal value for key:" + key)
+		return &PathError{Op: "marshal", Path: key, Kind: ErrCorruptRecord, Err: err}
+	}
+	if batch := v.getBatch(); batch != nil {
+		batch.put(key, json)
+		return nil
 	}
-	err = v.db.Put([]byte(key), json, nil)
+	err = v.db.Put([]byte(key), json)
 	if err != nil {
-		log.Fatal("Writing db failed at key:" + key)
+		return newDbError("put", key, err)
+	}
+	return nil
+}
+
+func (v *Indexer) deleteKey(key string) error {
+	if batch := v.getBatch(); batch != nil {
+		batch.delete(key)
+		return nil
 	}
+	if err := v.db.Delete([]byte(key)); err != nil {
+		return newDbError("delete", key, err)
+	}
+	return nil
 }
 
-func (v *Indexer) putFileOrDirMeta(path string, meta proto.Message) {
+func (v *Indexer) putFileOrDirMeta(path string, meta proto.Message) error {
 	relativePath := v.getRelativePath(path)
-	v.putKeyValue(keyForPath(relativePath), meta)
+	return v.putKeyValue(keyForPath(relativePath), meta)
 }
 
 func (v *Indexer) getRelativePath(path string) string {
@@ -365,13 +789,46 @@ func keyForHash(hash string) string {
 	return string(PREFIX_HASH) + hash
 }
 
-func (v *Indexer) addHash(md5sum string, fileSize int64, relativePath string) {
+// Adds relativePath with digest to the hash index. meta is its entry, which
+// tells which file it is a link of.
+func (v *Indexer) addHash(digest string, meta *protos.FileMeta, relativePath string) error {
+	others, found, err := v.otherPaths(digest, relativePath)
+	if err != nil || found {
+		return err
+	}
+	if err := v.addPath(keyForHash(digest), meta.Size, relativePath); err != nil {
+		return err
+	}
+	v.dirChanged(relativePath)
+	return v.hashGroupChanged(others, meta, relativePath, 1)
+}
+
+func (v *Indexer) removeHash(digest string, meta *protos.FileMeta, relativePath string) error {
+	others, _, err := v.otherPaths(digest, relativePath)
+	if err != nil {
+		return err
+	}
+	found, err := v.removePath(keyForHash(digest), relativePath)
+	if err == nil && !found {
+		log.Printf("hash not found for %s", relativePath)
+	}
+	if err != nil || !found {
+		return err
+	}
+	return v.hashGroupChanged(others, meta, relativePath, -1)
+}
+
+// Adds relativePath to FilePaths stored at key.
+func (v *Indexer) addPath(key string, fileSize int64, relativePath string) error {
 	var paths protos.FilePaths
-	key := keyForHash(md5sum)
-	if v.getProto(key, &paths) {
+	found, err := v.getProto(key, &paths)
+	if err != nil {
+		return err
+	}
+	if found {
 		for _, path := range paths.Paths {
 			if path == relativePath {
-				return
+				return nil
 			}
 		}
 	} else {
@@ -379,15 +836,15 @@ func (v *Indexer) addHash(md5sum string, fileSize int64, relativePath string) {
 	}
 	paths.Paths = append(paths.Paths, relativePath)
 	paths.FileSize = fileSize
-	v.putKeyValue(key, &paths)
+	return v.putKeyValue(key, &paths)
 }
 
-func (v *Indexer) removeHash(md5sum string, relativePath string) {
+// Removes relativePath from FilePaths stored at key. Returns false if it is
+// not found.
+func (v *Indexer) removePath(key string, relativePath string) (bool, error) {
 	var paths protos.FilePaths
-	key := keyForHash(md5sum)
-	if !v.getProto(key, &paths) {
-		log.Printf("md5sum not found for %s", relativePath)
-		return
+	if found, err := v.getProto(key, &paths); !found {
+		return false, err
 	}
 	index := -1
 	for i, path := range paths.Paths {
@@ -397,38 +854,59 @@ func (v *Indexer) removeHash(md5sum string, relativePath string) {
 		}
 	}
 	if index == -1 {
-		log.Printf("md5sum not found for %s", relativePath)
-		return
+		return false, nil
 	}
 	s := paths.Paths
 	if len(s) == 1 {
-		v.db.Delete([]byte(key), nil)
-	} else {
-		s[len(s)-1], s[index] = s[index], s[len(s)-1]
-		paths.Paths = s[:len(s)-1]
-		v.putKeyValue(key, &paths)
+		return true, v.deleteKey(key)
 	}
+	s[len(s)-1], s[index] = s[index], s[len(s)-1]
+	paths.Paths = s[:len(s)-1]
+	return true, v.putKeyValue(key, &paths)
 }
 
-func (v *Indexer) GetFilesByHash(hash string) (int64, []string) {
+// Returns size and paths of files with given digest. Untagged digests are
+// looked up as md5 sums.
+func (v *Indexer) GetFilesByHash(hash string) (int64, []string, error) {
 	var paths protos.FilePaths
-	key := keyForHash(hash)
-	if v.getProto(key, &paths) {
-		return paths.FileSize, paths.Paths
-	} else {
-		return 0, nil
+	algorithm, digest := SplitDigest(hash)
+	key := keyForHash(algorithm + ":" + digest)
+	found, err := v.getProto(key, &paths)
+	if !found {
+		return 0, nil, err
 	}
+	return paths.FileSize, paths.Paths, nil
 }
 
 func OpenOrCreate(baseDir string, indexDir string) *Indexer {
+	return OpenOrCreateWithBackend(BACKEND_LEVELDB, baseDir, indexDir)
+}
+
+// Like OpenOrCreate, with the index kept by the given backend.
+func OpenOrCreateWithBackend(backend string, baseDir string, indexDir string) *Indexer {
 	if indexDir == "" {
 		indexDir = path.Join(baseDir, "fileIndexerDb")
 	}
-	indexer := Indexer{baseDir, nil, nil, nil, 0, 0}
+	indexer := Indexer{baseDir: baseDir, backend: backend}
 	indexer.OpenOrCreate(indexDir)
 	return &indexer
 }
 
+// Opens an existing index.
+func Open(indexDir string) (*Indexer, error) {
+	return OpenWithBackend(BACKEND_LEVELDB, indexDir)
+}
+
+// Like Open, with the index kept by the given backend.
+func OpenWithBackend(backend string, indexDir string) (*Indexer, error) {
+	indexer := Indexer{backend: backend}
+	if err := indexer.Open(indexDir); err != nil {
+		indexer.Close()
+		return nil, err
+	}
+	return &indexer, nil
+}
+
 func OpenOrDie(indexDir string) *Indexer {
 	indexer := Indexer{}
 	indexer.OpenOrDie(indexDir)
@@ -438,3 +916,83 @@ func OpenOrDie(indexDir string) *Indexer {
 func keyForPath(path string) string {
 	return string(PREFIX_FILE) + path
 }
+
+func (v *Indexer) isCurrentDigest(digest string) bool {
+	algorithm, _ := SplitDigest(digest)
+	return digest != "" && algorithm == v.hasher.Name()
+}
+
+// Rehashes all files of the index with another hash algorithm in place. The
+// new algorithm is recorded first, so an interrupted rehash is completed by
+// the next Rehash or Update.
+func (v *Indexer) Rehash(name string) error {
+	hasher, err := GetHasher(name)
+	if err != nil {
+		return err
+	}
+	v.hasher = hasher
+	v.dbMeta.HashAlgorithm = hasher.Name()
+	if err := v.putKeyValue(KEY_DB_META, v.dbMeta); err != nil {
+		return err
+	}
+
+	files := make([]*protos.FileMeta, 0, 100)
+	err = v.Iter(func(path string, meta *protos.FileMeta) bool {
+		if !meta.IsDir && (!meta.Unhashed && !v.isCurrentDigest(meta.Hash) ||
+			meta.QuickHash != "" && !v.isCurrentDigest(meta.QuickHash)) {
+			meta.RelativePath = path
+			files = append(files, meta)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Rehashing %d files with %s", len(files), hasher.Name())
+	batching := v.beginBatch()
+	for _, meta := range files {
+		if err = v.rehashFile(meta); err == nil {
+			err = v.taskApplied()
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = v.updateDirHashes()
+	}
+	if batching {
+		if endErr := v.endBatch(); err == nil {
+			err = endErr
+		}
+	}
+	return err
+}
+
+func (v *Indexer) rehashFile(meta *protos.FileMeta) error {
+	relativePath := meta.RelativePath
+	meta.RelativePath = ""
+	if meta.QuickHash != "" && !v.isCurrentDigest(meta.QuickHash) {
+		// quick hashes are recomputed when needed.
+		if err := v.removeQuickHash(meta.QuickHash, relativePath); err != nil {
+			return err
+		}
+		meta.QuickHash = ""
+	}
+	if !meta.Unhashed && !v.isCurrentDigest(meta.Hash) {
+		digest, err := HashFile(filepath.Join(v.baseDir, relativePath), v.hasher)
+		if err != nil {
+			// left for the next Update.
+			return v.failPath(newPathError("hash", filepath.Join(v.baseDir, relativePath), err))
+		}
+		if err := v.removeHash(meta.Hash, meta, relativePath); err != nil {
+			return err
+		}
+		if err := v.addHash(digest, meta, relativePath); err != nil {
+			return err
+		}
+		meta.Hash = digest
+		meta.Md5Sum = ""
+	}
+	return v.putKeyValue(keyForPath(relativePath), meta)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/idlecat/fileindexer"
+	"github.com/idlecat/fileindexer/protos"
+	"io"
+	"log"
+	"os"
+)
+
+const (
+	FORMAT_TEXT   = "text"
+	FORMAT_JSON   = "json"
+	FORMAT_NDJSON = "ndjson"
+	FORMAT_CSV    = "csv"
+)
+
+// Ops which write records in formats other than text.
+var formatOps = map[string]bool{
+	OP_LIST:           true,
+	OP_INFO:           true,
+	OP_DEDUP:          true,
+	OP_INTERSECT_WITH: true,
+	OP_QUICKSCAN:      true,
+}
+
+// Where text for people goes: stdout in text format, stderr otherwise, so
+// stdout has the records only.
+var textOut io.Writer = os.Stdout
+
+// A row of output, fields in order.
+type record []field
+
+type field struct {
+	name  string
+	value interface{}
+}
+
+func (r record) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range r {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(f.name)
+		value, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Writes records to out in one of the FORMAT_* formats. Records are written
+// as they come, a json array too, so nothing is held in memory.
+type recordWriter struct {
+	format string
+	out    io.Writer
+	csv    *csv.Writer
+	// Records written so far.
+	count int
+}
+
+func newRecordWriter(format string, out io.Writer) *recordWriter {
+	w := &recordWriter{format: format, out: out}
+	if format == FORMAT_CSV {
+		w.csv = csv.NewWriter(out)
+	}
+	return w
+}
+
+// Writes r. The csv header is taken from the first record.
+func (w *recordWriter) write(r record) error {
+	defer func() { w.count++ }()
+	switch w.format {
+	case FORMAT_JSON:
+		// as json.MarshalIndent writes an array.
+		data, err := json.MarshalIndent(r, "  ", "  ")
+		if err != nil {
+			return err
+		}
+		separator := ",\n  "
+		if w.count == 0 {
+			separator = "[\n  "
+		}
+		_, err = w.out.Write(append([]byte(separator), data...))
+		return err
+	case FORMAT_NDJSON:
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		_, err = w.out.Write(append(data, '\n'))
+		return err
+	case FORMAT_CSV:
+		if w.count == 0 {
+			header := make([]string, len(r))
+			for i, f := range r {
+				header[i] = f.name
+			}
+			if err := w.csv.Write(header); err != nil {
+				return err
+			}
+		}
+		values := make([]string, len(r))
+		for i, f := range r {
+			values[i] = fmt.Sprint(f.value)
+		}
+		return w.csv.Write(values)
+	}
+	return nil
+}
+
+// Ends the output, closing the json array.
+func (w *recordWriter) flush() error {
+	switch w.format {
+	case FORMAT_JSON:
+		end := "\n]\n"
+		if w.count == 0 {
+			end = "[]\n"
+		}
+		_, err := io.WriteString(w.out, end)
+		return err
+	case FORMAT_CSV:
+		w.csv.Flush()
+		return w.csv.Error()
+	}
+	return nil
+}
+
+// Where emit writes records, set by setFormat.
+var recordOut = newRecordWriter(FORMAT_TEXT, os.Stdout)
+
+func setFormat() {
+	switch *format {
+	case FORMAT_TEXT:
+		return
+	case FORMAT_JSON, FORMAT_NDJSON, FORMAT_CSV:
+	default:
+		log.Fatal("Unknown format " + *format)
+	}
+	if !formatOps[*op] {
+		log.Fatalf("Op %s only has text output", *op)
+	}
+	textOut = os.Stderr
+	recordOut = newRecordWriter(*format, os.Stdout)
+}
+
+// Returns whether records are written instead of text.
+func structured() bool {
+	return *format != FORMAT_TEXT
+}
+
+// Writes r in the format set, nothing in text format.
+func emit(r record) {
+	if err := recordOut.write(r); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func flushRecords() {
+	if err := recordOut.flush(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Returns the fields of a file or dir, named as in FileMeta and DirInfo.
+// Dir totals are zero for files.
+func metaRecord(relativePath string, meta *protos.FileMeta) record {
+	dirInfo := meta.DirInfo
+	if dirInfo == nil {
+		dirInfo = &protos.DirInfo{}
+	}
+	return record{
+		{"relativePath", relativePath},
+		{"isDir", meta.IsDir},
+		{"size", meta.Size},
+		{"hash", meta.Hash},
+		{"quickHash", meta.QuickHash},
+		{"unhashed", meta.Unhashed},
+		{"modTimeNs", meta.ModTimeNs},
+		{"ctimeNs", meta.CtimeNs},
+		{"inode", meta.Inode},
+		{"device", meta.Device},
+		{"nlink", meta.Nlink},
+		{"sequence", meta.Sequence},
+		{"totalFileCount", dirInfo.TotalFileCount},
+		{"totalFileSize", dirInfo.TotalFileSize},
+		{"totalDirCount", dirInfo.TotalDirCount},
+		{"duplicateFileCount", dirInfo.DuplicateFileCount},
+		{"duplicateFileSize", dirInfo.DuplicateFileSize},
+		{"uniqueFileSize", dirInfo.UniqueFileSize},
+		{"contentHash", dirInfo.ContentHash},
+		{"copiedFileCount", dirInfo.CopiedFileCount},
+		{"copiedFileSize", dirInfo.CopiedFileSize},
+	}
+}
+
+// Returns the fields of info, named as in RepositoryInfo.
+func repositoryInfoRecord(info *fileindexer.RepositoryInfo) record {
+	return record{
+		{"fileCount", info.FileCount},
+		{"fileSize", info.FileSize},
+		{"dirCount", info.DirCount},
+		{"changedFileCount", info.ChangedFileCount},
+		{"changedFileSize", info.ChangedFileSize},
+		{"removedDirCount", info.RemovedDirCount},
+		{"removedFileCount", info.RemovedFileCount},
+		{"removedFileSize", info.RemovedFileSize},
+	}
+}
+
+// Writes a record for each path of a group of copies dedup went through.
+// Paths in removed get action, the others "keep".
+func emitGroup(hash string, fileSize int64, paths []string, removed []string, action string) {
+	for _, path := range paths {
+		pathAction := "keep"
+		if contains(removed, path) {
+			pathAction = action
+		}
+		emit(record{{"hash", hash}, {"size", fileSize}, {"relativePath", path}, {"action", pathAction}})
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+var testRecords = []record{
+	{{"relativePath", "dir1/a,b.jpg"}, {"size", int64(3)}, {"duplicate", true}},
+	{{"relativePath", "dir2/\"quoted\"\nname"}, {"size", int64(0)}, {"duplicate", false}},
+}
+
+func TestRecordWriter(t *testing.T) {
+	tests := []struct {
+		format   string
+		records  []record
+		expected string
+	}{
+		{FORMAT_JSON, testRecords, `[
+  {
+    "relativePath": "dir1/a,b.jpg",
+    "size": 3,
+    "duplicate": true
+  },
+  {
+    "relativePath": "dir2/\"quoted\"\nname",
+    "size": 0,
+    "duplicate": false
+  }
+]
+`},
+		{FORMAT_JSON, nil, "[]\n"},
+		{FORMAT_NDJSON, testRecords, `{"relativePath":"dir1/a,b.jpg","size":3,"duplicate":true}
+{"relativePath":"dir2/\"quoted\"\nname","size":0,"duplicate":false}
+`},
+		{FORMAT_NDJSON, nil, ""},
+		// fields with commas, quotes or newlines are quoted.
+		{FORMAT_CSV, testRecords, `relativePath,size,duplicate
+"dir1/a,b.jpg",3,true
+"dir2/""quoted""
+name",0,false
+`},
+		{FORMAT_CSV, nil, ""},
+		{FORMAT_TEXT, testRecords, ""},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		w := newRecordWriter(test.format, &out)
+		for _, r := range test.records {
+			if err := w.write(r); err != nil {
+				t.Fatalf("%s: %v", test.format, err)
+			}
+		}
+		if err := w.flush(); err != nil {
+			t.Fatalf("%s: %v", test.format, err)
+		}
+		if out.String() != test.expected {
+			t.Errorf("%s of %d records: expected\n%s\nactual\n%s", test.format, len(test.records), test.expected, out.String())
+		}
+	}
+}
+
+func TestRecordWriterJSONArray(t *testing.T) {
+	var out bytes.Buffer
+	w := newRecordWriter(FORMAT_JSON, &out)
+	for _, r := range testRecords {
+		if err := w.write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.flush(); err != nil {
+		t.Fatal(err)
+	}
+	expected, err := json.MarshalIndent(testRecords, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != string(expected)+"\n" {
+		t.Errorf("expected the array json.MarshalIndent writes, got\n%s", out.String())
+	}
+	var decoded []map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil || len(decoded) != len(testRecords) {
+		t.Errorf("expected %d records, got %d: %v", len(testRecords), len(decoded), err)
+	}
+}
+
+// Records are written as they come, not when the output ends.
+func TestRecordWriterStreams(t *testing.T) {
+	for _, format := range []string{FORMAT_JSON, FORMAT_NDJSON} {
+		var out bytes.Buffer
+		w := newRecordWriter(format, &out)
+		if err := w.write(testRecords[0]); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(out.Bytes(), []byte(`"dir1/a,b.jpg"`)) {
+			t.Errorf("%s: expected the first record before flush, got %q", format, out.String())
+		}
+	}
+}
+
+// Text for people goes to stderr once stdout has records.
+func TestSetFormat(t *testing.T) {
+	savedOp, savedFormat := *op, *format
+	defer func() {
+		*op, *format = savedOp, savedFormat
+		textOut = os.Stdout
+		recordOut = newRecordWriter(FORMAT_TEXT, os.Stdout)
+	}()
+	tests := []struct {
+		format  string
+		textOut *os.File
+	}{
+		{FORMAT_TEXT, os.Stdout},
+		{FORMAT_JSON, os.Stderr},
+		{FORMAT_NDJSON, os.Stderr},
+		{FORMAT_CSV, os.Stderr},
+	}
+	for _, test := range tests {
+		textOut = os.Stdout
+		*op, *format = OP_LIST, test.format
+		setFormat()
+		if textOut != test.textOut {
+			t.Errorf("%s: text goes to %v", test.format, textOut)
+		}
+		if test.format != FORMAT_TEXT && (recordOut.format != test.format || recordOut.out != os.Stdout) {
+			t.Errorf("%s: records written as %s", test.format, recordOut.format)
+		}
+	}
+}
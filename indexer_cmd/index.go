@@ -1,12 +1,23 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/idlecat/fileindexer"
 	"github.com/idlecat/fileindexer/protos"
 	"log"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var (
@@ -15,14 +26,87 @@ var (
 	op                = flag.String("op", "info", "operations defined as OP_*")
 	intersectDir      = flag.String("intersectDir", "", "dir to check duplicated files")
 	intersectIndexDir = flag.String("intersectIndexDir", "", "index to check duplicated files")
-	dryRun            = flag.Bool("dryRun", true, "Dry run or not when dedup.")
+	dryRun            = flag.Bool("dryRun", true, "Dry run or not when dedup or migrate.")
 	tmpDir            = flag.String("tmpDir", "", "tmp dir for removed files")
 	dedupDirOrderFile = flag.String("dirOrder", "",
-		"text files containing list of directories, which defines the priority of keeping files under these directories.")
+		"text files containing list of directories, which defines the priority of keeping files under these directories. "+
+			"Entries match whole path components and may be glob patterns, lines starting with # are comments")
+	keepPolicyFile = flag.String("keepPolicy", "",
+		"file of rules choosing the copy dedup keeps, applied in order after dirOrder: oldest, newest, "+
+			"shortest-path, longest-path, prefer REGEXP, avoid REGEXP, camera-name")
+	hashAlgorithm = flag.String("hash", "",
+		"hash algorithm of a new index, or the target algorithm of rehash. One of "+
+			strings.Join(fileindexer.HasherNames(), ", "))
+	workers  = flag.Int("workers", runtime.NumCPU(), "number of files hashed concurrently")
+	hashMode = flag.String("hashMode", HASH_MODE_ALL,
+		"which files are hashed: all, size to hash only files whose size collides with another file, "+
+			"or quick to hash only files whose size and quick hash of head and tail collide")
+	onError = flag.String("onError", ON_ERROR_ABORT,
+		"what to do with unreadable files and dirs: abort, or skip them and report at the end")
+	retryFailed = flag.Bool("retryFailed", false, "update only paths listed by the errors op")
+	rulesFile   = flag.String("rulesFile", "",
+		"file of gitignore-style patterns of paths left out of the index. Rules of the last update are used "+
+			"if no rulesFile, exclude or include is given")
+	depth      = flag.Int("depth", 0, "levels of dirs shown by du and tree, 0 for all")
+	top        = flag.Int("top", 20, "number of dirs listed by dupreport, 0 for all")
+	similarity = flag.Float64("similarity", 0.9,
+		"share of the bigger dir's size found in both dirs for dirdedup to list them as near-identical")
+	strategy = flag.String("strategy", STRATEGY_MOVE,
+		"what dedup and dirdedup do with duplicates: move them to tmpDir, or replace them with a hardlink, "+
+			"reflink or symlink of the file kept")
+	interactive = flag.Bool("interactive", false,
+		"review each group of copies for dedup and save what is decided, without touching files")
+	decidedOnly = flag.Bool("decidedOnly", false, "dedup only groups with a decision saved by --interactive")
+	plan        = flag.String("plan", "",
+		"JSON file dedup writes its plan to instead of deduping, and apply carries out")
+	run = flag.Int64("run", 0,
+		"dedup run restored, as printed by dedup and dirdedup. Defaults to the last run")
+	format = flag.String("format", FORMAT_TEXT,
+		"output of list, info, dedup, intersect and qscan: text, json, ndjson or csv records, "+
+			"with other messages on stderr")
+	backend = flag.String("backend", fileindexer.BACKEND_LEVELDB,
+		"store the index is kept in: leveldb, bolt for a single file index, or memory which keeps nothing")
+	excludes = listFlag{}
+	includes = listFlag{}
 )
 
+func init() {
+	flag.Var(&excludes, "exclude", "gitignore-style pattern of paths left out of the index, may be repeated")
+	flag.Var(&includes, "include", "gitignore-style pattern of paths indexed even if excluded, may be repeated")
+}
+
+// listFlag collects values of a repeated flag.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 var dirOrder = []string{}
 
+const (
+	HASH_MODE_ALL   = "all"
+	HASH_MODE_SIZE  = "size"
+	HASH_MODE_QUICK = "quick"
+)
+
+const (
+	STRATEGY_MOVE     = "move"
+	STRATEGY_HARDLINK = "hardlink"
+	STRATEGY_REFLINK  = "reflink"
+	STRATEGY_SYMLINK  = "symlink"
+)
+
+const (
+	ON_ERROR_ABORT = "abort"
+	ON_ERROR_SKIP  = "skip"
+)
+
 const (
 	OP_UPDATE         = "update"
 	OP_INFO           = "info"
@@ -30,6 +114,17 @@ const (
 	OP_DEDUP          = "dedup"
 	OP_QUICKSCAN      = "qscan"
 	OP_INTERSECT_WITH = "intersect"
+	OP_REHASH         = "rehash"
+	OP_ERRORS         = "errors"
+	OP_WATCH          = "watch"
+	OP_MIGRATE        = "migrate"
+	OP_LS             = "ls"
+	OP_DU             = "du"
+	OP_TREE           = "tree"
+	OP_DUP_REPORT     = "dupreport"
+	OP_DEDUP_DIRS     = "dirdedup"
+	OP_RESTORE        = "restore"
+	OP_APPLY          = "apply"
 )
 
 var indexer *fileindexer.Indexer
@@ -39,12 +134,43 @@ func main() {
 	if *baseDir == "" {
 		log.Fatal("baseDir should be specified.")
 	}
-	indexer = fileindexer.OpenOrCreate(*baseDir, *indexDir)
+	setFormat()
+	if *op == OP_MIGRATE {
+		// before the index is opened, which migrates it.
+		migrate()
+		return
+	}
+	indexer = fileindexer.OpenOrCreateWithBackend(*backend, *baseDir, *indexDir)
 	defer indexer.Close()
 
 	if indexer.GetError() != nil {
-		log.Fatal("Failed to create indexer.")
+		log.Fatal("Failed to create indexer: ", indexer.GetError())
 	}
+	if *hashAlgorithm != "" && *op != OP_REHASH {
+		if err := indexer.SetHasher(*hashAlgorithm); err != nil {
+			log.Fatal(err)
+		}
+	}
+	indexer.SetWorkers(*workers)
+	switch *hashMode {
+	case HASH_MODE_ALL:
+		indexer.SetHashMode(fileindexer.HASH_ALL)
+	case HASH_MODE_SIZE:
+		indexer.SetHashMode(fileindexer.HASH_SIZE_FIRST)
+	case HASH_MODE_QUICK:
+		indexer.SetHashMode(fileindexer.HASH_QUICK_FIRST)
+	default:
+		log.Fatal("Unknown hashMode " + *hashMode)
+	}
+	switch *onError {
+	case ON_ERROR_ABORT:
+		indexer.SetErrorPolicy(fileindexer.ON_ERROR_ABORT)
+	case ON_ERROR_SKIP:
+		indexer.SetErrorPolicy(fileindexer.ON_ERROR_SKIP)
+	default:
+		log.Fatal("Unknown onError " + *onError)
+	}
+	setRules()
 
 	switch *op {
 	case OP_UPDATE:
@@ -59,70 +185,883 @@ func main() {
 		quickScan()
 	case OP_INTERSECT_WITH:
 		intersectWith()
+	case OP_REHASH:
+		rehash()
+	case OP_ERRORS:
+		listErrors()
+	case OP_WATCH:
+		watch()
+	case OP_LS:
+		ls()
+	case OP_DU:
+		du()
+	case OP_TREE:
+		tree()
+	case OP_DUP_REPORT:
+		dupReport()
+	case OP_DEDUP_DIRS:
+		dedupDirs()
+	case OP_RESTORE:
+		restore()
+	case OP_APPLY:
+		apply()
+	}
+	flushRecords()
+	reportSkipped()
+}
+
+// Sets rules from flags: the default rules, then rulesFile, excludes and
+// includes, so includes override the others.
+func setRules() {
+	if *rulesFile == "" && len(excludes) == 0 && len(includes) == 0 {
+		return
+	}
+	lines := fileindexer.DefaultRules().Lines()
+	if *rulesFile != "" {
+		fileLines, err := fileindexer.ReadLinesFromFile(*rulesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		lines = append(lines, fileLines...)
+	}
+	lines = append(lines, excludes...)
+	for _, include := range includes {
+		lines = append(lines, "!"+include)
+	}
+	rules, err := fileindexer.ParseRules(lines)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if indexer.SetRules(rules) {
+		if *op == OP_UPDATE {
+			fmt.Fprintln(textOut, "Rules changed, newly excluded paths are removed from the index")
+		} else {
+			fmt.Fprintln(textOut, "Rules differ from the ones of the last update, run update to apply them")
+		}
+	}
+}
+
+func reportSkipped() {
+	skipped := indexer.SkippedPaths()
+	if len(skipped) == 0 {
+		return
+	}
+	fmt.Fprintf(textOut, "Skipped %d paths:\n", len(skipped))
+	for _, err := range skipped {
+		fmt.Fprintln(textOut, err)
 	}
 }
 
 func update() {
-	indexer.Update()
+	var err error
+	if *retryFailed {
+		err = indexer.RetryFailed()
+	} else {
+		err = indexer.Update()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
-func info() {
-	fmt.Println(indexer.GetDbMeta())
+func watch() {
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		close(stop)
+	}()
+	fmt.Fprintln(textOut, "Watching "+*baseDir+", interrupt to stop")
+	if err := indexer.Watch(stop); err != nil {
+		log.Fatal(err)
+	}
+}
 
-	meta := indexer.GetFileOrDirMeta(flag.Arg(0))
+func migrate() {
+	dir := *indexDir
+	if dir == "" {
+		dir = filepath.Join(*baseDir, "fileIndexerDb")
+	}
+	pending, err := fileindexer.PendingMigrations(*backend, dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(pending) == 0 {
+		fmt.Fprintf(textOut, "Index is at schema version %d\n", fileindexer.SCHEMA_VERSION)
+		return
+	}
+	for _, step := range pending {
+		fmt.Fprintln(textOut, step)
+	}
+	if *dryRun {
+		fmt.Fprintf(textOut, "%d migration steps pending\n", len(pending))
+		return
+	}
+	migrated, err := fileindexer.OpenWithBackend(*backend, dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	migrated.Close()
+	fmt.Fprintf(textOut, "Migrated index to schema version %d\n", fileindexer.SCHEMA_VERSION)
+}
 
-	if meta != nil {
-		fmt.Println(meta)
+func listErrors() {
+	count := 0
+	err := indexer.IterErrors(func(record *protos.ErrorRecord) bool {
+		fmt.Fprintf(textOut, "%s %s: %s (%s, sequence %d, %s)\n", record.Op, record.Path, record.Message,
+			record.Kind, record.Sequence, time.Unix(0, record.TimeNs).Format(time.RFC3339))
+		count++
+		return true
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(textOut, "Total failed paths: %d\n", count)
+}
+
+func rehash() {
+	if *hashAlgorithm == "" {
+		log.Fatal("hash not specified")
+	}
+	if err := indexer.Rehash(*hashAlgorithm); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func info() {
+	fmt.Fprintln(textOut, indexer.GetDbMeta())
+
+	meta, err := indexer.GetFileOrDirMeta(flag.Arg(0))
+	if errors.Is(err, fileindexer.ErrNotFound) {
+		fmt.Fprintln(textOut, "No meta found for ", flag.Arg(0))
+	} else if err != nil {
+		log.Fatal(err)
+	} else if structured() {
+		emit(metaRecord(flag.Arg(0), meta))
 	} else {
-		fmt.Println("No meta found for ", flag.Arg(0))
+		fmt.Fprintln(textOut, meta)
 	}
 }
 
 func list() {
-	indexer.Iter(func(file string, meta *protos.FileMeta) {
-		fmt.Println(file, meta)
+	err := indexer.Iter(func(file string, meta *protos.FileMeta) bool {
+		if structured() {
+			emit(metaRecord(file, meta))
+		} else {
+			fmt.Fprintln(textOut, file, meta)
+		}
+		return true
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Returns the path given as first argument relative to baseDir, "" for
+// baseDir itself.
+func pathArg() string {
+	relativePath := filepath.ToSlash(filepath.Clean(flag.Arg(0)))
+	if relativePath == "." {
+		return ""
+	}
+	return relativePath
+}
+
+func displayPath(relativePath string) string {
+	if relativePath == "" {
+		return "."
+	}
+	return relativePath
+}
+
+// Returns the size of a file or the total size of a dir.
+func totalSize(meta *protos.FileMeta) int64 {
+	if meta.IsDir {
+		return meta.DirInfo.TotalFileSize
+	}
+	return meta.Size
+}
+
+func ls() {
+	relativePath := pathArg()
+	meta, err := indexer.GetFileOrDirMeta(relativePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	entries := []*protos.FileMeta{meta}
+	if meta.IsDir {
+		entries, err = indexer.ListDir(relativePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		meta.RelativePath = relativePath
+	}
+	for _, meta := range entries {
+		kind, name := "-", path.Base(meta.RelativePath)
+		if meta.IsDir {
+			kind, name = "d", name+"/"
+		}
+		modTime := time.Unix(0, meta.ModTimeNs).Format(time.RFC3339)
+		fmt.Fprintf(textOut, "%s %12d %s %s\n", kind, totalSize(meta), modTime, name)
+	}
+}
+
+// Returns the depth of relativePath under top, 0 for top itself.
+func depthUnder(top string, relativePath string) int {
+	if relativePath == top {
+		return 0
+	} else if top == "" {
+		return strings.Count(relativePath, "/") + 1
+	}
+	return strings.Count(relativePath[len(top):], "/")
+}
+
+func du() {
+	top := pathArg()
+	err := indexer.Walk(top, func(relativePath string, meta *protos.FileMeta) int {
+		if !meta.IsDir {
+			return fileindexer.NORMAL
+		}
+		fmt.Fprintf(textOut, "%12d %8d %s\n", meta.DirInfo.TotalFileSize, meta.DirInfo.TotalFileCount,
+			displayPath(relativePath))
+		if *depth > 0 && depthUnder(top, relativePath) >= *depth {
+			return fileindexer.STOP_SCAN_THIS_DIR
+		}
+		return fileindexer.NORMAL
 	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func tree() {
+	top := pathArg()
+	// Whether the entry at each depth is the last one of its dir.
+	lasts := []bool{}
+	var walkDir func(relativePath string) error
+	walkDir = func(relativePath string) error {
+		children, err := indexer.ListDir(relativePath)
+		if err != nil {
+			return err
+		}
+		for i, child := range children {
+			lasts = append(lasts, i == len(children)-1)
+			line := ""
+			for _, last := range lasts[:len(lasts)-1] {
+				if last {
+					line += "    "
+				} else {
+					line += "│   "
+				}
+			}
+			if lasts[len(lasts)-1] {
+				line += "└── "
+			} else {
+				line += "├── "
+			}
+			name := path.Base(child.RelativePath)
+			if child.IsDir {
+				name += "/"
+			}
+			fmt.Fprintf(textOut, "%s%s (%d)\n", line, name, totalSize(child))
+			if child.IsDir && (*depth == 0 || len(lasts) < *depth) {
+				if err := walkDir(child.RelativePath); err != nil {
+					return err
+				}
+			}
+			lasts = lasts[:len(lasts)-1]
+		}
+		return nil
+	}
+	meta, err := indexer.GetFileOrDirMeta(top)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(textOut, "%s (%d)\n", displayPath(top), totalSize(meta))
+	if meta.IsDir {
+		if err := walkDir(top); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// Lists dirs by the size of their files which have a copy anywhere, which
+// dedup reclaims from them if the copies elsewhere are kept. Deduping a dir
+// alone reclaims its duplicated size.
+func dupReport() {
+	dirs := []*protos.FileMeta{}
+	err := indexer.Walk(pathArg(), func(relativePath string, meta *protos.FileMeta) int {
+		if meta.IsDir && meta.DirInfo.CopiedFileSize > 0 {
+			meta.RelativePath = relativePath
+			dirs = append(dirs, meta)
+		}
+		return fileindexer.NORMAL
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	sort.SliceStable(dirs, func(i, j int) bool {
+		return dirs[i].DirInfo.CopiedFileSize > dirs[j].DirInfo.CopiedFileSize
+	})
+	if *top > 0 && len(dirs) > *top {
+		dirs = dirs[:*top]
+	}
+	fmt.Fprintf(textOut, "%12s %8s %12s %12s %s\n", "copied", "files", "duplicated", "total", "dir")
+	for _, meta := range dirs {
+		dirInfo := meta.DirInfo
+		fmt.Fprintf(textOut, "%12d %8d %12d %12d %s\n", dirInfo.CopiedFileSize, dirInfo.CopiedFileCount,
+			dirInfo.DuplicateFileSize, dirInfo.TotalFileSize, displayPath(meta.RelativePath))
+	}
 }
 
 func quickScan() {
 	info := fileindexer.RepositoryInfo{}
-	indexer.QuickScan(&info)
-	fmt.Printf("Total File:%d, Total Size:%d\n", info.FileCount, info.FileSize)
+	if err := indexer.QuickScan(&info); err != nil {
+		log.Fatal(err)
+	}
+	if structured() {
+		emit(repositoryInfoRecord(&info))
+	} else {
+		fmt.Fprintf(textOut, "Total File:%d, Total Size:%d\n", info.FileCount, info.FileSize)
+	}
+}
+
+var strategies = map[string]int{
+	STRATEGY_MOVE:     fileindexer.DEDUP_MOVE,
+	STRATEGY_HARDLINK: fileindexer.DEDUP_HARDLINK,
+	STRATEGY_REFLINK:  fileindexer.DEDUP_REFLINK,
+	STRATEGY_SYMLINK:  fileindexer.DEDUP_SYMLINK,
+}
+
+// Returns the dedup strategy of name, as given by the strategy flag.
+// Moving needs tmpDir, unless it is only written to a plan.
+func dedupStrategy(name string) int {
+	dedupStrategy, ok := strategies[name]
+	if !ok {
+		log.Fatal("Unknown strategy " + name)
+	}
+	if dedupStrategy == fileindexer.DEDUP_MOVE && *tmpDir == "" && (*op != OP_DEDUP || *plan == "") {
+		log.Fatal("tmpDir not specified")
+	}
+	return dedupStrategy
+}
+
+// Returns the keep policy of the keepPolicy flag, after dirOrder.
+func keepPolicy() *fileindexer.KeepPolicy {
+	if *dedupDirOrderFile != "" {
+		lines, err := fileindexer.ReadLinesFromFile(*dedupDirOrderFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if dirOrder, err = fileindexer.ParseDirOrder(lines); err != nil {
+			log.Fatal(err)
+		}
+		unmatched, err := indexer.UnmatchedDirs(dirOrder)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, dir := range unmatched {
+			log.Printf("Warning: dirOrder entry %q matches nothing in the index", dir)
+		}
+	}
+	var policy *fileindexer.KeepPolicy
+	if *keepPolicyFile != "" {
+		lines, err := fileindexer.ReadLinesFromFile(*keepPolicyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if policy, err = fileindexer.ParseKeepPolicy(lines); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return policy.WithDirOrder(dirOrder)
+}
+
+// Returns the entries of paths, nil for those not indexed.
+func getMetas(paths []string) []*protos.FileMeta {
+	metas := make([]*protos.FileMeta, len(paths))
+	for i, path := range paths {
+		meta, err := indexer.GetFileOrDirMeta(path)
+		if err != nil && !errors.Is(err, fileindexer.ErrNotFound) {
+			log.Fatal(err)
+		}
+		metas[i] = meta
+	}
+	return metas
+}
+
+// Returns the copy of paths policy keeps and why, after printing them.
+func chooseKeeper(policy *fileindexer.KeepPolicy, paths []string) (string, []string) {
+	keep, reasons := policy.Choose(paths, getMetas(paths))
+	fmt.Fprintf(textOut, "keep %s (%s)\n", keep, strings.Join(reasons, ", "))
+	return keep, reasons
+}
+
+// Removes whole dirs which have an identical copy, keeping one dir of each
+// group by the keep policy like dedup. With a link strategy each file of a dir
+// removed is replaced with a link of the same file in the dir kept. Files
+// are verified against the dir kept first, and the group is skipped if one
+// differs. Near-identical dirs are only listed.
+func dedupDirs() {
+	dedupStrategy := dedupStrategy(*strategy)
+	policy := keepPolicy()
+	if *hashMode != HASH_MODE_ALL {
+		if err := indexer.HashCollisions(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	groups, err := indexer.IdenticalDirs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	count := 0
+	var size int64 = 0
+	removed := []string{}
+	isRemoved := func(path string) bool {
+		for _, dir := range removed {
+			if path == dir || strings.HasPrefix(path, dir+"/") {
+				return true
+			}
+		}
+		return false
+	}
+	for _, group := range groups {
+		// a copy may be in a dir removed already.
+		paths := []string{}
+		for _, path := range group.Paths {
+			if !isRemoved(path) {
+				paths = append(paths, path)
+			}
+		}
+		if len(paths) < 2 {
+			continue
+		}
+		fmt.Fprintf(textOut, "dir hash:%s\n", group.Hash)
+		for _, path := range paths {
+			fmt.Fprintln(textOut, path)
+		}
+		keep, _ := chooseKeeper(policy, paths)
+		dirsToRemove := []string{}
+		for _, path := range paths {
+			if path != keep {
+				dirsToRemove = append(dirsToRemove, path)
+			}
+		}
+		files, keeps := []string{}, []string{}
+		for _, dir := range dirsToRemove {
+			dirFiles, dirKeeps := filesUnder(dir, keep)
+			files = append(files, dirFiles...)
+			keeps = append(keeps, dirKeeps...)
+		}
+		if !verified(files, keeps) {
+			continue
+		}
+		for _, dir := range dirsToRemove {
+			if dedupStrategy == fileindexer.DEDUP_MOVE {
+				dedupFileSafe(dir, keep, dedupStrategy)
+			} else {
+				for i, file := range files {
+					if strings.HasPrefix(file, dir+"/") {
+						dedupFileSafe(file, keeps[i], dedupStrategy)
+					}
+				}
+			}
+			removed = append(removed, dir)
+			count++
+			size += group.TotalFileSize
+		}
+	}
+	updateChanged()
+	pairs, err := indexer.SimilarDirs(*similarity)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, pair := range pairs {
+		fmt.Fprintf(textOut, "similar %.0f%%, %d bytes shared: %s %s\n", pair.Similarity*100, pair.SharedFileSize,
+			pair.Paths[0], pair.Paths[1])
+	}
+	fmt.Fprintf(textOut, "Total duplicated dirs: %d\n", count)
+	fmt.Fprintf(textOut, "Total duplicated size: %d\n", size)
+}
+
+func contains(paths []string, path string) bool {
+	for _, p := range paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
 }
 
-func rmFileSafe(file string) {
+// Returns the files under dir and the files at the same places under keep.
+func filesUnder(dir string, keep string) ([]string, []string) {
+	files, keeps := []string{}, []string{}
+	err := indexer.Walk(dir, func(relativePath string, meta *protos.FileMeta) int {
+		if !meta.IsDir {
+			files = append(files, relativePath)
+			keeps = append(keeps, keep+relativePath[len(dir):])
+		}
+		return fileindexer.NORMAL
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return files, keeps
+}
+
+// Checks each file is still a copy of the file kept in its place, unless
+// in a dry run. Returns false after printing why if one is not.
+func verified(files []string, keeps []string) bool {
 	if *dryRun {
-		fmt.Printf("rm %s\n", file)
-	} else {
-		fileindexer.RemoveFileSafely(file, *baseDir, *tmpDir)
+		return true
+	}
+	for i, file := range files {
+		err := indexer.VerifyDuplicate(file, keeps[i])
+		if errors.Is(err, fileindexer.ErrDb) || errors.Is(err, fileindexer.ErrCorruptRecord) {
+			log.Fatal(err)
+		} else if err != nil {
+			fmt.Fprintf(textOut, "skipped, %v\n", err)
+			return false
+		}
+	}
+	return true
+}
+
+// Dedup run of this process, 0 until a path is deduped.
+var dedupRun int64
+
+// Paths deduped or restored, and the files kept, which are indexed again at
+// the end.
+var changed = []string{}
+
+// Moves file to the dir of dedupRun under tmpDir, or replaces it with a link
+// of keep, and journals it under dedupRun.
+func dedupFileSafe(file string, keep string, dedupStrategy int) {
+	if *dryRun {
+		if dedupStrategy == fileindexer.DEDUP_MOVE {
+			fmt.Fprintf(textOut, "rm %s\n", file)
+		} else {
+			for name, value := range strategies {
+				if value == dedupStrategy {
+					fmt.Fprintf(textOut, "%s %s => %s\n", name, file, keep)
+				}
+			}
+		}
+		return
+	}
+	if dedupRun == 0 {
+		dedupRun = fileindexer.NewDedupRun()
+	}
+	if err := indexer.DedupPath(dedupRun, file, keep, dedupStrategy, *tmpDir); err != nil {
+		log.Fatal(err)
+	}
+	changed = append(changed, file, keep)
+}
+
+// Indexes the paths deduped or restored again, without a full update.
+func updateChanged() {
+	if len(changed) == 0 {
+		return
+	}
+	if err := indexer.UpdatePaths(changed); err != nil {
+		log.Fatal(err)
+	}
+	if dedupRun != 0 {
+		fmt.Fprintf(textOut, "Journaled as run %d, undo with --op=restore --run=%d\n", dedupRun, dedupRun)
+	}
+}
+
+// Reverses the actions of a dedup run, all of them or those on the paths
+// given as arguments and under them.
+func restore() {
+	restoreRun := *run
+	if restoreRun == 0 {
+		var err error
+		if restoreRun, err = indexer.LastDedupRun(); err != nil {
+			log.Fatal(err)
+		}
+		if restoreRun == 0 {
+			fmt.Fprintln(textOut, "Nothing to restore")
+			return
+		}
+	}
+	entries := []*protos.JournalEntry{}
+	err := indexer.IterJournal(restoreRun, func(entry *protos.JournalEntry) bool {
+		if selected(entry.Path) {
+			entries = append(entries, entry)
+		}
+		return true
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	restored := 0
+	for _, entry := range entries {
+		if *dryRun {
+			fmt.Fprintf(textOut, "restore %s\n", entry.Path)
+			continue
+		}
+		if err := indexer.Restore(entry); errors.Is(err, fileindexer.ErrMismatch) {
+			fmt.Fprintf(textOut, "skipped, %v\n", err)
+			continue
+		} else if err != nil {
+			log.Fatal(err)
+		}
+		changed = append(changed, entry.Path, entry.KeepPath)
+		restored++
 	}
+	updateChanged()
+	fmt.Fprintf(textOut, "Restored %d of %d paths of run %d\n", restored, len(entries), restoreRun)
 }
 
+// Returns whether relativePath is one of the arguments or under one, true
+// if there are none.
+func selected(relativePath string) bool {
+	if flag.NArg() == 0 {
+		return true
+	}
+	for _, arg := range flag.Args() {
+		arg = filepath.ToSlash(filepath.Clean(arg))
+		if relativePath == arg || strings.HasPrefix(relativePath, arg+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes duplicated files, keeping one of each set by a decision saved by
+// review, or by the keep policy. Paths which are links of one file count as
+// one, so files replaced with links by an earlier dedup are not duplicates
+// any more. Files are verified against the one kept first, and the set is
+// skipped if one differs.
 func dedup() {
-	if *tmpDir == "" {
-		log.Fatal("tmpDir not specified")
+	if *interactive {
+		review()
+		return
 	}
+	dedupStrategy := dedupStrategy(*strategy)
 	count := 0
 	var size int64 = 0
-	if *dedupDirOrderFile != "" {
-		dirOrder = fileindexer.ReadLinesFromFile(*dedupDirOrderFile)
+	policy := keepPolicy()
+	var dedupPlan *fileindexer.Plan
+	if *plan != "" {
+		dedupPlan = &fileindexer.Plan{Sequence: indexer.GetDbMeta().Sequence, Strategy: *strategy}
 	}
-	indexer.IterHash(func(hash string, fileSize int64, paths []string) {
-		if len(paths) > 1 {
-			fmt.Printf("hash:%s\n", hash)
-			for _, path := range paths {
-				fmt.Println(path)
+	if *hashMode != HASH_MODE_ALL {
+		// the index may have been updated in another mode.
+		if err := indexer.HashCollisions(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	err := indexer.IterHash(func(hash string, fileSize int64, paths []string) bool {
+		if len(paths) < 2 {
+			return true
+		}
+		links, err := indexer.GroupLinks(paths)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(links) < 2 {
+			return true
+		}
+		decision, err := indexer.GetDecision(hash, paths)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if decision == nil && *decidedOnly {
+			return true
+		}
+		fmt.Fprintf(textOut, "hash:%s\n", hash)
+		for _, path := range paths {
+			fmt.Fprintln(textOut, path)
+		}
+		var keep string
+		var reasons []string
+		if decision == nil {
+			keep, reasons = chooseKeeper(policy, paths)
+		} else if decision.Action == fileindexer.DECISION_KEEP_ALL {
+			fmt.Fprintln(textOut, "keep all (decided)")
+			emitGroup(hash, fileSize, paths, nil, "")
+			return true
+		} else {
+			keep = decision.KeepPath
+			reasons = []string{"decided"}
+			fmt.Fprintf(textOut, "keep %s (decided)\n", keep)
+		}
+		files, keeps := []string{}, []string{}
+		for _, set := range links {
+			if contains(set, keep) {
+				// links of the file kept stay.
+				continue
 			}
-			count += len(paths) - 1
-			size += int64(len(paths)-1) * fileSize
-			filesToRemove := fileindexer.DedupFiles(paths, dirOrder)
-			for _, file := range filesToRemove {
-				rmFileSafe(file)
+			for _, file := range set {
+				files = append(files, file)
+				keeps = append(keeps, keep)
 			}
 		}
+		if dedupPlan != nil {
+			dedupPlan.Groups = append(dedupPlan.Groups, &fileindexer.PlanGroup{
+				Hash:    hash,
+				Size:    fileSize,
+				Keep:    keep,
+				Remove:  files,
+				Reasons: reasons,
+			})
+		} else if !verified(files, keeps) {
+			emitGroup(hash, fileSize, paths, files, "skip")
+			return true
+		}
+		emitGroup(hash, fileSize, paths, files, "remove")
+		count += len(links) - 1
+		size += int64(len(links)-1) * fileSize
+		if dedupPlan != nil {
+			return true
+		}
+		for _, file := range files {
+			dedupFileSafe(file, keep, dedupStrategy)
+		}
+		return true
 	})
-	fmt.Printf("Total duplicated files: %d\n", count)
-	fmt.Printf("Total duplicated size: %d\n", size)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if dedupPlan != nil {
+		if err := fileindexer.WritePlan(*plan, dedupPlan); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintf(textOut, "Wrote plan of %d groups to %s, apply it with --op=apply\n", len(dedupPlan.Groups), *plan)
+	}
+	updateChanged()
+	fmt.Fprintf(textOut, "Total duplicated files: %d\n", count)
+	fmt.Fprintf(textOut, "Total duplicated size: %d\n", size)
+}
+
+// Carries out a plan written by dedup, and maybe edited, which ReadPlan
+// checks. Each file of a group is hashed again first, and the group is
+// skipped if one does not match its indexed hash.
+func apply() {
+	if *plan == "" {
+		log.Fatal("plan not specified")
+	}
+	dedupPlan, err := fileindexer.ReadPlan(*plan)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dedupStrategy := dedupStrategy(dedupPlan.Strategy)
+	if sequence := indexer.GetDbMeta().Sequence; sequence != dedupPlan.Sequence {
+		fmt.Fprintf(textOut, "Plan was made from update %d, the index is at %d\n", dedupPlan.Sequence, sequence)
+	}
+	applied := 0
+	for _, group := range dedupPlan.Groups {
+		fmt.Fprintf(textOut, "hash:%s\nkeep %s\n", group.Hash, group.Keep)
+		if !*dryRun && !hashVerified(group) {
+			continue
+		}
+		for _, file := range group.Remove {
+			dedupFileSafe(file, group.Keep, dedupStrategy)
+		}
+		applied++
+	}
+	updateChanged()
+	fmt.Fprintf(textOut, "Applied %d of %d groups\n", applied, len(dedupPlan.Groups))
+}
+
+// Checks each file of group still has the hash of the group. Returns false
+// after printing why if one does not.
+func hashVerified(group *fileindexer.PlanGroup) bool {
+	for _, file := range append([]string{group.Keep}, group.Remove...) {
+		err := indexer.VerifyHash(file, group.Hash)
+		if errors.Is(err, fileindexer.ErrDb) || errors.Is(err, fileindexer.ErrCorruptRecord) {
+			log.Fatal(err)
+		} else if err != nil {
+			fmt.Fprintf(textOut, "skipped, %v\n", err)
+			return false
+		}
+	}
+	return true
+}
+
+// Goes through the groups of copies without a decision, showing the copy
+// the keep policy keeps, and saves what is decided for each. Files are left
+// alone, a later dedup applies the decisions.
+func review() {
+	policy := keepPolicy()
+	if *hashMode != HASH_MODE_ALL {
+		if err := indexer.HashCollisions(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	in := bufio.NewReader(os.Stdin)
+	saved := 0
+	err := indexer.IterHash(func(hash string, fileSize int64, paths []string) bool {
+		if len(paths) < 2 {
+			return true
+		}
+		links, err := indexer.GroupLinks(paths)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(links) < 2 {
+			return true
+		}
+		decision, err := indexer.GetDecision(hash, paths)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if decision != nil {
+			return true
+		}
+		metas := getMetas(paths)
+		keep, reasons := policy.Choose(paths, metas)
+		fmt.Fprintf(textOut, "\nhash:%s, %d copies of %d bytes\n", hash, len(links), fileSize)
+		for i, path := range paths {
+			mark, modTime := " ", "-"
+			if path == keep {
+				mark = "*"
+			}
+			if metas[i] != nil {
+				modTime = time.Unix(0, metas[i].ModTimeNs).Format(time.RFC3339)
+			}
+			fmt.Fprintf(textOut, "%s %2d %s %s\n", mark, i+1, modTime, path)
+		}
+		fmt.Fprintf(textOut, "keep %s (%s)\n", keep, strings.Join(reasons, ", "))
+		for {
+			fmt.Fprintf(textOut, "[a]ccept, keep [1-%d] instead, [s]kip, keep a[l]l, [q]uit: ", len(paths))
+			line, err := in.ReadString('\n')
+			if err != nil && line == "" {
+				// end of input.
+				fmt.Fprintln(textOut)
+				return false
+			}
+			action := fileindexer.DECISION_DEDUP
+			switch answer := strings.TrimSpace(line); answer {
+			case "a":
+			case "s":
+				return true
+			case "l":
+				action = fileindexer.DECISION_KEEP_ALL
+			case "q":
+				return false
+			default:
+				n, err := strconv.Atoi(answer)
+				if err != nil || n < 1 || n > len(paths) {
+					continue
+				}
+				keep = paths[n-1]
+			}
+			if err := indexer.SaveDecision(hash, action, keep, paths); err != nil {
+				log.Fatal(err)
+			}
+			saved++
+			return true
+		}
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(textOut, "Saved %d decisions, dedup applies them\n", saved)
 }
 
 func intersectWith() {
@@ -133,42 +1072,88 @@ func intersectWith() {
 	var dupSize int64 = 0
 	uniqCount := 0
 	var uniqSize int64 = 0
+	var err error
 	if *intersectDir != "" {
-		fileindexer.ScanDir(*intersectDir, func(path string, info os.FileInfo) int {
+		err = fileindexer.ScanDirWithRules(*intersectDir, indexer.GetRules(), func(path string, info os.FileInfo) int {
 			if info.IsDir() {
 				return fileindexer.NORMAL
 			}
-			hash, _ := fileindexer.HashFile(path)
-			_, files := indexer.GetFilesByHash(hash)
-			if files != nil && len(files) > 1 {
-				// duplicated
+			_, files, err := indexer.LookupFile(path, info.Size())
+			if err != nil {
+				log.Fatal(err)
+			}
+			duplicate := files != nil && len(files) > 1
+			if duplicate {
 				dupCount += 1
 				dupSize += info.Size()
 			} else {
 				uniqCount += 1
 				uniqSize += info.Size()
 			}
+			// relative to intersectDir, as paths of the other index are.
+			relativePath, err := filepath.Rel(*intersectDir, path)
+			if err != nil {
+				log.Fatal(err)
+			}
+			emit(record{{"relativePath", filepath.ToSlash(relativePath)}, {"size", info.Size()}, {"duplicate", duplicate}})
 			return fileindexer.NORMAL
 		})
 	} else {
-		otherIndexer := fileindexer.OpenOrDie(*intersectIndexDir)
-		otherIndexer.IterHash(func(hash string, fileSize int64, paths []string) {
-			_, files := indexer.GetFilesByHash(hash)
-			if files != nil && len(files) > 1 {
-				// duplicated
-				for _, p := range paths {
-					fmt.Printf("%s\n", p)
+		var otherIndexer *fileindexer.Indexer
+		otherIndexer, err = fileindexer.OpenWithBackend(*backend, *intersectIndexDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer otherIndexer.Close()
+		if otherIndexer.GetHasher().Name() != indexer.GetHasher().Name() {
+			log.Fatalf("Index uses %s but %s uses %s, rehash one of them first",
+				indexer.GetHasher().Name(), *intersectIndexDir, otherIndexer.GetHasher().Name())
+		}
+		otherIndexer.SetWorkers(*workers)
+		if err := indexer.HashCollisionsWith(otherIndexer); err != nil {
+			log.Fatal(err)
+		}
+		// Files still unhashed have no counterpart in this index.
+		err = otherIndexer.Iter(func(path string, meta *protos.FileMeta) bool {
+			if meta.Unhashed {
+				uniqCount += 1
+				uniqSize += meta.Size
+				emit(record{{"relativePath", path}, {"size", meta.Size}, {"duplicate", false}})
+			}
+			return true
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = otherIndexer.IterHash(func(hash string, fileSize int64, paths []string) bool {
+			_, files, err := indexer.GetFilesByHash(hash)
+			if err != nil {
+				log.Fatal(err)
+			}
+			duplicate := files != nil && len(files) > 1
+			if duplicate {
+				if !structured() {
+					for _, p := range paths {
+						fmt.Fprintf(textOut, "%s\n", p)
+					}
 				}
-				dupCount += len(files)
-				dupSize += fileSize * int64(len(files))
+				dupCount += len(paths)
+				dupSize += fileSize * int64(len(paths))
 			} else {
-				uniqCount += 1
-				uniqSize += fileSize * int64(len(files))
+				uniqCount += len(paths)
+				uniqSize += fileSize * int64(len(paths))
 			}
+			for _, p := range paths {
+				emit(record{{"relativePath", p}, {"size", fileSize}, {"duplicate", duplicate}})
+			}
+			return true
 		})
 	}
-	fmt.Printf("Total duplicated files: %d\n", dupCount)
-	fmt.Printf("Total duplicated files size: %d\n", dupSize)
-	fmt.Printf("Total unique files: %d\n", uniqCount)
-	fmt.Printf("Total unique files size: %d\n", uniqSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(textOut, "Total duplicated files: %d\n", dupCount)
+	fmt.Fprintf(textOut, "Total duplicated files size: %d\n", dupSize)
+	fmt.Fprintf(textOut, "Total unique files: %d\n", uniqCount)
+	fmt.Fprintf(textOut, "Total unique files size: %d\n", uniqSize)
 }
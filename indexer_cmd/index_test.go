@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"github.com/idlecat/fileindexer"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for path, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, path), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func updatedIndex(t *testing.T, dir string, indexDir string) *fileindexer.Indexer {
+	v := fileindexer.OpenOrCreate(dir, indexDir)
+	if err := v.GetError(); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Update(); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// Totals count each file of the other index, duplicated or not.
+func TestIntersectTotals(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileindexer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "base")
+	other := filepath.Join(dir, "other")
+	for _, d := range []string{base, other} {
+		if err := os.Mkdir(d, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFiles(t, base, map[string]string{"a1": "abc", "a2": "abc", "a3": "abc", "z": "zz"})
+	writeFiles(t, other, map[string]string{"p": "abc", "q": "abc", "r1": "rrrr", "r2": "rrrr"})
+	otherIndex := updatedIndex(t, other, filepath.Join(dir, "otherIndex"))
+	otherIndex.Close()
+
+	savedIndexer, savedTextOut, savedIntersectIndexDir := indexer, textOut, *intersectIndexDir
+	defer func() {
+		indexer, textOut, *intersectIndexDir = savedIndexer, savedTextOut, savedIntersectIndexDir
+	}()
+	indexer = updatedIndex(t, base, filepath.Join(dir, "baseIndex"))
+	defer indexer.Close()
+	var out bytes.Buffer
+	textOut = &out
+	*intersectIndexDir = filepath.Join(dir, "otherIndex")
+	intersectWith()
+
+	for _, total := range []string{
+		"Total duplicated files: 2\n",
+		"Total duplicated files size: 6\n",
+		"Total unique files: 2\n",
+		"Total unique files size: 8\n",
+	} {
+		if !strings.Contains(out.String(), total) {
+			t.Errorf("expected %q in\n%s", total, out.String())
+		}
+	}
+}
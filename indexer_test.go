@@ -1,14 +1,23 @@
 package fileindexer_test
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang/protobuf/proto"
 	"github.com/idlecat/fileindexer"
 	"github.com/idlecat/fileindexer/protos"
+	"github.com/syndtr/goleveldb/leveldb"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"reflect"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 func FatalErr(err error, msg string) {
@@ -51,7 +60,7 @@ type HashTest struct {
 
 func VerifyDirTests(indexer *fileindexer.Indexer, tests []DirTest, t *testing.T) {
 	for _, dt := range tests {
-		meta := indexer.GetFileOrDirMeta(dt.relativePath)
+		meta := GetMeta(indexer, dt.relativePath)
 		if meta == nil {
 			t.Errorf("%s has no meta found", dt.relativePath)
 			continue
@@ -67,7 +76,7 @@ func VerifyDirTests(indexer *fileindexer.Indexer, tests []DirTest, t *testing.T)
 
 func VerifyFileTests(indexer *fileindexer.Indexer, tests []FileTest, t *testing.T) {
 	for _, ft := range tests {
-		meta := indexer.GetFileOrDirMeta(ft.relativePath)
+		meta := GetMeta(indexer, ft.relativePath)
 		if meta == nil {
 			t.Errorf("%s has no meta found", ft.relativePath)
 			continue
@@ -77,13 +86,14 @@ func VerifyFileTests(indexer *fileindexer.Indexer, tests []FileTest, t *testing.
 			continue
 		}
 		ExpectEqual(t, ft.meta.Size, meta.Size, ft.relativePath+" size")
-		ExpectEqual(t, ft.meta.Md5Sum, meta.Md5Sum, ft.relativePath+" md5sum")
+		ExpectEqual(t, ft.meta.Hash, meta.Hash, ft.relativePath+" hash")
 	}
 }
 
 func VerifyHashTests(indexer *fileindexer.Indexer, tests []HashTest, t *testing.T) {
 	for _, test := range tests {
-		_, files := indexer.GetFilesByHash(test.hash)
+		_, files, err := indexer.GetFilesByHash(test.hash)
+		FatalErr(err, test.hash)
 		if files == nil && test.files != nil {
 			t.Errorf("hash %s has no file found", test.hash)
 			continue
@@ -92,6 +102,22 @@ func VerifyHashTests(indexer *fileindexer.Indexer, tests []HashTest, t *testing.
 	}
 }
 
+// Returns nil if relativePath is not indexed.
+func GetMeta(indexer *fileindexer.Indexer, relativePath string) *protos.FileMeta {
+	meta, err := indexer.GetFileOrDirMeta(relativePath)
+	if errors.Is(err, fileindexer.ErrNotFound) {
+		return nil
+	}
+	FatalErr(err, relativePath)
+	return meta
+}
+
+func GetFilesBySize(indexer *fileindexer.Indexer, size int64) []string {
+	files, err := indexer.GetFilesBySize(size)
+	FatalErr(err, "")
+	return files
+}
+
 func ExpectEqual(t *testing.T, expected interface{}, actual interface{}, name string) {
 	if expected != actual {
 		t.Errorf("%s: expected %d, actual %d", name, expected, actual)
@@ -117,9 +143,11 @@ func ExpectSliceEqual(t *testing.T, expected []string, actual []string, name str
 }
 
 const (
-	ABC_MD5SUM   = "900150983cd24fb0d6963f7d28e17f72"
-	XYZ_MD5SUM   = "d16fb36f0911f878998c136191af705e"
-	XDONG_MD5SUM = "ac970faf8b99258047c5a385070e3d64"
+	ABC_MD5SUM   = "md5:900150983cd24fb0d6963f7d28e17f72"
+	XYZ_MD5SUM   = "md5:d16fb36f0911f878998c136191af705e"
+	XDONG_MD5SUM = "md5:ac970faf8b99258047c5a385070e3d64"
+
+	ABC_SHA256 = "sha256:ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
 )
 
 func TestCreateIndexer(t *testing.T) {
@@ -132,7 +160,7 @@ func TestCreateIndexer(t *testing.T) {
 
 	dbMeta := indexer.GetDbMeta()
 	if dbMeta.BaseDir != dir || dbMeta.Sequence != 1 {
-		t.Errorf("DbMeta", dbMeta)
+		t.Errorf("DbMeta %v", dbMeta)
 	}
 
 	dirTests := []DirTest{
@@ -144,9 +172,9 @@ func TestCreateIndexer(t *testing.T) {
 	VerifyDirTests(indexer, dirTests, t)
 
 	fileTests := []FileTest{
-		{"dir1/abc", protos.FileMeta{Size: 3, Md5Sum: ABC_MD5SUM}},
-		{"dir2/xyz", protos.FileMeta{Size: 3, Md5Sum: XYZ_MD5SUM}},
-		{"dir1/dir11/xdong", protos.FileMeta{Size: 5, Md5Sum: XDONG_MD5SUM}},
+		{"dir1/abc", protos.FileMeta{Size: 3, Hash: ABC_MD5SUM}},
+		{"dir2/xyz", protos.FileMeta{Size: 3, Hash: XYZ_MD5SUM}},
+		{"dir1/dir11/xdong", protos.FileMeta{Size: 5, Hash: XDONG_MD5SUM}},
 	}
 	VerifyFileTests(indexer, fileTests, t)
 
@@ -169,7 +197,7 @@ func TestUpdateIndexerWithoutChange(t *testing.T) {
 
 	dbMeta := indexer.GetDbMeta()
 	if dbMeta.BaseDir != dir || dbMeta.Sequence != 2 {
-		t.Errorf("DbMeta", dbMeta)
+		t.Errorf("DbMeta %v", dbMeta)
 	}
 
 	dirTests := []DirTest{
@@ -181,9 +209,9 @@ func TestUpdateIndexerWithoutChange(t *testing.T) {
 	VerifyDirTests(indexer, dirTests, t)
 
 	fileTests := []FileTest{
-		{"dir1/abc", protos.FileMeta{Size: 3, Md5Sum: ABC_MD5SUM}},
-		{"dir2/xyz", protos.FileMeta{Size: 3, Md5Sum: XYZ_MD5SUM}},
-		{"dir1/dir11/xdong", protos.FileMeta{Size: 5, Md5Sum: XDONG_MD5SUM}},
+		{"dir1/abc", protos.FileMeta{Size: 3, Hash: ABC_MD5SUM}},
+		{"dir2/xyz", protos.FileMeta{Size: 3, Hash: XYZ_MD5SUM}},
+		{"dir1/dir11/xdong", protos.FileMeta{Size: 5, Hash: XDONG_MD5SUM}},
 	}
 	VerifyFileTests(indexer, fileTests, t)
 
@@ -215,8 +243,8 @@ func TestFileRemoved(t *testing.T) {
 	VerifyDirTests(indexer, dirTests, t)
 
 	fileTests := []FileTest{
-		{"dir2/xyz", protos.FileMeta{Size: 3, Md5Sum: XYZ_MD5SUM}},
-		{"dir1/dir11/xdong", protos.FileMeta{Size: 5, Md5Sum: XDONG_MD5SUM}},
+		{"dir2/xyz", protos.FileMeta{Size: 3, Hash: XYZ_MD5SUM}},
+		{"dir1/dir11/xdong", protos.FileMeta{Size: 5, Hash: XDONG_MD5SUM}},
 	}
 	VerifyFileTests(indexer, fileTests, t)
 
@@ -247,8 +275,8 @@ func TestDirRemoved(t *testing.T) {
 	VerifyDirTests(indexer, dirTests, t)
 
 	fileTests := []FileTest{
-		{"dir1/abc", protos.FileMeta{Size: 3, Md5Sum: ABC_MD5SUM}},
-		{"dir2/xyz", protos.FileMeta{Size: 3, Md5Sum: XYZ_MD5SUM}},
+		{"dir1/abc", protos.FileMeta{Size: 3, Hash: ABC_MD5SUM}},
+		{"dir2/xyz", protos.FileMeta{Size: 3, Hash: XYZ_MD5SUM}},
 	}
 	VerifyFileTests(indexer, fileTests, t)
 
@@ -280,9 +308,9 @@ func TestFileModified(t *testing.T) {
 	VerifyDirTests(indexer, dirTests, t)
 
 	fileTests := []FileTest{
-		{"dir1/abc", protos.FileMeta{Size: 5, Md5Sum: XDONG_MD5SUM}},
-		{"dir2/xyz", protos.FileMeta{Size: 3, Md5Sum: XYZ_MD5SUM}},
-		{"dir1/dir11/xdong", protos.FileMeta{Size: 5, Md5Sum: XDONG_MD5SUM}},
+		{"dir1/abc", protos.FileMeta{Size: 5, Hash: XDONG_MD5SUM}},
+		{"dir2/xyz", protos.FileMeta{Size: 3, Hash: XYZ_MD5SUM}},
+		{"dir1/dir11/xdong", protos.FileMeta{Size: 5, Hash: XDONG_MD5SUM}},
 	}
 	VerifyFileTests(indexer, fileTests, t)
 
@@ -314,10 +342,10 @@ func TestFileAdded(t *testing.T) {
 	VerifyDirTests(indexer, dirTests, t)
 
 	fileTests := []FileTest{
-		{"dir1/abc", protos.FileMeta{Size: 3, Md5Sum: ABC_MD5SUM}},
-		{"dir1/xdong", protos.FileMeta{Size: 5, Md5Sum: XDONG_MD5SUM}},
-		{"dir2/xyz", protos.FileMeta{Size: 3, Md5Sum: XYZ_MD5SUM}},
-		{"dir1/dir11/xdong", protos.FileMeta{Size: 5, Md5Sum: XDONG_MD5SUM}},
+		{"dir1/abc", protos.FileMeta{Size: 3, Hash: ABC_MD5SUM}},
+		{"dir1/xdong", protos.FileMeta{Size: 5, Hash: XDONG_MD5SUM}},
+		{"dir2/xyz", protos.FileMeta{Size: 3, Hash: XYZ_MD5SUM}},
+		{"dir1/dir11/xdong", protos.FileMeta{Size: 5, Hash: XDONG_MD5SUM}},
 	}
 	VerifyFileTests(indexer, fileTests, t)
 
@@ -351,10 +379,10 @@ func TestDirAdded(t *testing.T) {
 	VerifyDirTests(indexer, dirTests, t)
 
 	fileTests := []FileTest{
-		{"dir1/abc", protos.FileMeta{Size: 3, Md5Sum: ABC_MD5SUM}},
-		{"dir2/xyz", protos.FileMeta{Size: 3, Md5Sum: XYZ_MD5SUM}},
-		{"dir1/dir11/xdong", protos.FileMeta{Size: 5, Md5Sum: XDONG_MD5SUM}},
-		{"dir1/dir12/abc", protos.FileMeta{Size: 3, Md5Sum: ABC_MD5SUM}},
+		{"dir1/abc", protos.FileMeta{Size: 3, Hash: ABC_MD5SUM}},
+		{"dir2/xyz", protos.FileMeta{Size: 3, Hash: XYZ_MD5SUM}},
+		{"dir1/dir11/xdong", protos.FileMeta{Size: 5, Hash: XDONG_MD5SUM}},
+		{"dir1/dir12/abc", protos.FileMeta{Size: 3, Hash: ABC_MD5SUM}},
 	}
 	VerifyFileTests(indexer, fileTests, t)
 
@@ -366,6 +394,1587 @@ func TestDirAdded(t *testing.T) {
 	VerifyHashTests(indexer, hashTests, t)
 }
 
+func TestHashAlgorithm(t *testing.T) {
+	dir := setUp()
+	defer os.RemoveAll(dir)
+
+	indexer := fileindexer.OpenOrCreate(dir, "")
+	defer indexer.Close()
+	if err := indexer.SetHasher("sha256"); err != nil {
+		t.Fatal(err)
+	}
+	indexer.Update()
+
+	ExpectEqual(t, "sha256", indexer.GetDbMeta().HashAlgorithm, "hash algorithm")
+	fileTests := []FileTest{
+		{"dir1/abc", protos.FileMeta{Size: 3, Hash: ABC_SHA256}},
+	}
+	VerifyFileTests(indexer, fileTests, t)
+	hashTests := []HashTest{
+		{ABC_SHA256, []string{"dir1/abc"}},
+		{ABC_MD5SUM, nil},
+	}
+	VerifyHashTests(indexer, hashTests, t)
+
+	if err := indexer.SetHasher("md5"); err == nil {
+		t.Errorf("SetHasher should fail on an updated index")
+	}
+}
+
+func TestRehash(t *testing.T) {
+	dir := setUp()
+	defer os.RemoveAll(dir)
+
+	indexer := fileindexer.OpenOrCreate(dir, "")
+	defer indexer.Close()
+	indexer.Update()
+	if err := indexer.Rehash("sha256"); err != nil {
+		t.Fatal(err)
+	}
+
+	ExpectEqual(t, "sha256", indexer.GetDbMeta().HashAlgorithm, "hash algorithm")
+	hashTests := []HashTest{
+		{ABC_SHA256, []string{"dir1/abc"}},
+		{ABC_MD5SUM, nil},
+	}
+	VerifyHashTests(indexer, hashTests, t)
+
+	// Update must not rehash again.
+	indexer.Update()
+	VerifyHashTests(indexer, hashTests, t)
+}
+
+func TestLegacyMd5Index(t *testing.T) {
+	dir := setUp()
+	defer os.RemoveAll(dir)
+
+	// Writes an index the way versions without pluggable hashes did.
+	indexDir := filepath.Join(dir, "fileIndexerDb")
+	db, err := leveldb.OpenFile(indexDir, nil)
+	FatalErr(err, "")
+	put := func(key string, msg proto.Message) {
+		data, err := proto.Marshal(msg)
+		FatalErr(err, "")
+		FatalErr(db.Put([]byte(key), data, nil), "")
+	}
+	put(".", &protos.DbMeta{BaseDir: dir, Sequence: 1})
+	put("fdir1/abc", &protos.FileMeta{Size: 3, Md5Sum: ABC_MD5SUM[4:], Sequence: 1})
+	put("h"+ABC_MD5SUM[4:], &protos.FilePaths{Paths: []string{"dir1/abc"}, FileSize: 3})
+	db.Close()
+
+	indexer := fileindexer.OpenOrCreate(dir, "")
+	defer indexer.Close()
+	ExpectEqual(t, "md5", indexer.GetDbMeta().HashAlgorithm, "hash algorithm")
+	hashTests := []HashTest{
+		{ABC_MD5SUM, []string{"dir1/abc"}},
+		{ABC_MD5SUM[4:], []string{"dir1/abc"}},
+	}
+	VerifyHashTests(indexer, hashTests, t)
+	ExpectSliceEqual(t, []string{"dir1/abc"}, GetFilesBySize(indexer, 3), "size 3")
+
+	indexer.Update()
+	fileTests := []FileTest{
+		{"dir1/abc", protos.FileMeta{Size: 3, Hash: ABC_MD5SUM}},
+		{"dir2/xyz", protos.FileMeta{Size: 3, Hash: XYZ_MD5SUM}},
+	}
+	VerifyFileTests(indexer, fileTests, t)
+	VerifyHashTests(indexer, hashTests, t)
+}
+
+func TestSchemaVersion(t *testing.T) {
+	dir := setUp()
+	defer os.RemoveAll(dir)
+	indexDir := filepath.Join(dir, "fileIndexerDb")
+	db, err := leveldb.OpenFile(indexDir, nil)
+	FatalErr(err, "")
+	data, err := proto.Marshal(&protos.DbMeta{BaseDir: dir, Sequence: 1})
+	FatalErr(err, "")
+	FatalErr(db.Put([]byte("."), data, nil), "")
+	db.Close()
+
+	pending, err := fileindexer.PendingMigrations(fileindexer.BACKEND_LEVELDB, indexDir)
+	FatalErr(err, "")
+	ExpectEqual(t, fileindexer.SCHEMA_VERSION, len(pending), "pending migrations")
+	indexer, err := fileindexer.Open(indexDir)
+	FatalErr(err, "")
+	ExpectEqual(t, int32(fileindexer.SCHEMA_VERSION), indexer.GetDbMeta().SchemaVersion, "schema version")
+	dbMeta := proto.Clone(indexer.GetDbMeta()).(*protos.DbMeta)
+	indexer.Close()
+	pending, err = fileindexer.PendingMigrations(fileindexer.BACKEND_LEVELDB, indexDir)
+	FatalErr(err, "")
+	ExpectEqual(t, 0, len(pending), "pending migrations")
+
+	db, err = leveldb.OpenFile(indexDir, nil)
+	FatalErr(err, "")
+	dbMeta.SchemaVersion = fileindexer.SCHEMA_VERSION + 1
+	data, err = proto.Marshal(dbMeta)
+	FatalErr(err, "")
+	FatalErr(db.Put([]byte("."), data, nil), "")
+	db.Close()
+	if _, err := fileindexer.PendingMigrations(fileindexer.BACKEND_LEVELDB, indexDir); !errors.Is(err, fileindexer.ErrSchemaTooNew) {
+		t.Errorf("expected ErrSchemaTooNew, got %v", err)
+	}
+	if _, err := fileindexer.Open(indexDir); !errors.Is(err, fileindexer.ErrSchemaTooNew) {
+		t.Errorf("expected ErrSchemaTooNew, got %v", err)
+	}
+	indexer = fileindexer.OpenOrCreate(dir, indexDir)
+	if err := indexer.GetError(); !errors.Is(err, fileindexer.ErrSchemaTooNew) {
+		t.Errorf("expected ErrSchemaTooNew, got %v", err)
+	}
+	indexer.Close()
+}
+
+func TestSubSecondChange(t *testing.T) {
+	dir := setUp()
+	defer os.RemoveAll(dir)
+	abc := filepath.Join(dir, "dir1/abc")
+	modTime := time.Unix(1600000000, 0)
+	FatalErr(os.Chtimes(abc, modTime, modTime), "")
+	indexer := fileindexer.OpenOrCreate(dir, "")
+	defer indexer.Close()
+	FatalErr(indexer.Update(), "")
+	ExpectEqual(t, modTime.UnixNano(), GetMeta(indexer, "dir1/abc").ModTimeNs, "modTimeNs")
+
+	// changed within the same second.
+	_ = ioutil.WriteFile(abc, []byte("abd"), 0666)
+	modTime = modTime.Add(time.Millisecond)
+	FatalErr(os.Chtimes(abc, modTime, modTime), "")
+	FatalErr(indexer.Update(), "")
+	ExpectEqual(t, "md5:4911e516e5aa21d327512e0c8b197616", GetMeta(indexer, "dir1/abc").Hash, "hash")
+	ExpectEqual(t, modTime.UnixNano(), GetMeta(indexer, "dir1/abc").ModTimeNs, "modTimeNs")
+
+	// changed with the modification time restored, noticed by ctime.
+	_ = ioutil.WriteFile(abc, []byte("abe"), 0666)
+	FatalErr(os.Chtimes(abc, modTime, modTime), "")
+	FatalErr(indexer.Update(), "")
+	ExpectEqual(t, "md5:7888d65a43501d992cc38638b59964d6", GetMeta(indexer, "dir1/abc").Hash, "hash")
+}
+
+func TestMigrateSecondTimes(t *testing.T) {
+	dir := setUp()
+	defer os.RemoveAll(dir)
+	indexDir := filepath.Join(dir, "fileIndexerDb")
+	indexer := fileindexer.OpenOrCreate(dir, indexDir)
+	FatalErr(indexer.Update(), "")
+	dbMeta := proto.Clone(indexer.GetDbMeta()).(*protos.DbMeta)
+	meta := GetMeta(indexer, "dir1/abc")
+	dirMeta := GetMeta(indexer, "dir1")
+	indexer.Close()
+
+	// Writes times the way versions with seconds did. The bogus hash stays
+	// unless the file is rehashed.
+	db, err := leveldb.OpenFile(indexDir, nil)
+	FatalErr(err, "")
+	put := func(key string, msg proto.Message) {
+		data, err := proto.Marshal(msg)
+		FatalErr(err, "")
+		FatalErr(db.Put([]byte(key), data, nil), "")
+	}
+	dbMeta.NsTimes = false
+	dbMeta.SchemaVersion = 0
+	put(".", dbMeta)
+	modTime := meta.ModTimeNs / 1e9
+	meta.ModTime = int32(modTime)
+	meta.ModTimeNs = 0
+	meta.CtimeNs = 0
+	meta.Inode = 0
+	meta.Hash = "md5:00000000000000000000000000000000"
+	put("fdir1/abc", meta)
+	updateTime := dirMeta.DirInfo.UpdateTimeStartNs / 1e9
+	dirMeta.DirInfo.UpdateTimeStart = int32(updateTime)
+	dirMeta.DirInfo.UpdateTimeStartNs = 0
+	dirMeta.DirInfo.TotalDirCount = 0
+	put("fdir1", dirMeta)
+	db.Close()
+
+	indexer = fileindexer.OpenOrCreate(dir, indexDir)
+	defer indexer.Close()
+	ExpectEqual(t, true, indexer.GetDbMeta().NsTimes, "nsTimes")
+	ExpectEqual(t, modTime*1e9, GetMeta(indexer, "dir1/abc").ModTimeNs, "modTimeNs")
+	ExpectEqual(t, int32(0), GetMeta(indexer, "dir1/abc").ModTime, "modTime")
+	ExpectEqual(t, updateTime*1e9, GetMeta(indexer, "dir1").DirInfo.UpdateTimeStartNs, "updateTimeStartNs")
+	ExpectEqual(t, int32(1), GetMeta(indexer, "dir1").DirInfo.TotalDirCount, "dir count")
+	FatalErr(indexer.Update(), "")
+	ExpectEqual(t, "md5:00000000000000000000000000000000", GetMeta(indexer, "dir1/abc").Hash, "hash")
+}
+
+func TestStores(t *testing.T) {
+	for _, backend := range fileindexer.BackendNames() {
+		dir, err := ioutil.TempDir("", "fileindexer")
+		FatalErr(err, "")
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "store")
+		if _, err := fileindexer.OpenStore(backend, path, &fileindexer.StoreOptions{MustExist: true}); err == nil {
+			t.Errorf("%s: missing store opened", backend)
+		}
+		store, err := fileindexer.OpenStore(backend, path, nil)
+		FatalErr(err, backend)
+
+		// more than read at once by chunks.
+		for i := 0; i < 1500; i++ {
+			FatalErr(store.Put([]byte(fmt.Sprintf("a%04d", i)), []byte(fmt.Sprint(i))), backend)
+		}
+		batch := fileindexer.Batch{}
+		batch.Put([]byte("b1"), []byte("1"))
+		batch.Put([]byte("b2"), []byte("2"))
+		batch.Delete([]byte("a0000"))
+		FatalErr(store.Write(&batch), backend)
+		FatalErr(store.Delete([]byte("a0001")), backend)
+
+		value, found, err := store.Get([]byte("b2"))
+		FatalErr(err, backend)
+		ExpectEqual(t, "2", string(value), backend+" b2")
+		_, found, err = store.Get([]byte("a0000"))
+		FatalErr(err, backend)
+		ExpectEqual(t, false, found, backend+" a0000 found")
+
+		// entries are rewritten while iterated.
+		count := 0
+		err = store.Iterate([]byte("a"), []byte("a0002"), func(key []byte, value []byte) bool {
+			if count == 0 {
+				ExpectEqual(t, "a0002", string(key), backend+" first key")
+			}
+			count++
+			FatalErr(store.Put(key, []byte("x")), backend)
+			return true
+		})
+		FatalErr(err, backend)
+		ExpectEqual(t, 1498, count, backend+" iterated")
+		keys := []string{}
+		err = store.Iterate([]byte("b"), nil, func(key []byte, value []byte) bool {
+			keys = append(keys, string(key))
+			return false
+		})
+		FatalErr(err, backend)
+		ExpectSliceEqual(t, []string{"b1"}, keys, backend+" stopped")
+		FatalErr(store.Close(), backend)
+
+		if backend == fileindexer.BACKEND_MEMORY {
+			continue
+		}
+		store, err = fileindexer.OpenStore(backend, path, &fileindexer.StoreOptions{MustExist: true, ReadOnly: true})
+		FatalErr(err, backend)
+		value, _, err = store.Get([]byte("a1499"))
+		FatalErr(err, backend)
+		ExpectEqual(t, "x", string(value), backend+" a1499")
+		FatalErr(store.Close(), backend)
+	}
+}
+
+func TestBackends(t *testing.T) {
+	for _, backend := range fileindexer.BackendNames() {
+		dir := setUp()
+		defer os.RemoveAll(dir)
+		indexer := fileindexer.OpenOrCreateWithBackend(backend, dir, "")
+		FatalErr(indexer.GetError(), backend)
+		FatalErr(indexer.Update(), backend)
+		_ = os.Remove(filepath.Join(dir, "dir1/abc"))
+		FatalErr(indexer.Update(), backend)
+		indexer.Close()
+
+		if backend != fileindexer.BACKEND_MEMORY {
+			indexer, err := fileindexer.OpenWithBackend(backend, filepath.Join(dir, "fileIndexerDb"))
+			FatalErr(err, backend)
+			indexer.Close()
+		}
+		indexer = fileindexer.OpenOrCreateWithBackend(backend, dir, "")
+		defer indexer.Close()
+		if backend == fileindexer.BACKEND_MEMORY {
+			FatalErr(indexer.Update(), backend)
+		}
+		ExpectEqual(t, dir, indexer.GetDbMeta().BaseDir, backend+" base dir")
+		VerifyDirTests(indexer, []DirTest{
+			{"", protos.DirInfo{TotalFileSize: 8, TotalFileCount: 2}},
+			{"dir1", protos.DirInfo{TotalFileSize: 5, TotalFileCount: 1}},
+		}, t)
+		VerifyHashTests(indexer, []HashTest{
+			{ABC_MD5SUM, nil},
+			{XYZ_MD5SUM, []string{"dir2/xyz"}},
+			{XDONG_MD5SUM, []string{"dir1/dir11/xdong"}},
+		}, t)
+		ExpectSliceEqual(t, []string{"dir2/xyz"}, GetFilesBySize(indexer, 3), backend+" size 3")
+	}
+}
+
+func TestIterDir(t *testing.T) {
+	dir := setUp()
+	defer os.RemoveAll(dir)
+	indexer := fileindexer.OpenOrCreate(dir, "")
+	FatalErr(indexer.Update(), "")
+
+	paths := []string{}
+	err := indexer.IterDir("dir1", func(path string, meta *protos.FileMeta) bool {
+		paths = append(paths, path)
+		return true
+	})
+	FatalErr(err, "")
+	ExpectSliceEqual(t, []string{"dir1/abc", "dir1/dir11", "dir1/dir11/xdong"}, paths, "dir1")
+
+	paths = paths[:0]
+	err = indexer.Iter(func(path string, meta *protos.FileMeta) bool {
+		paths = append(paths, path)
+		return len(paths) < 2
+	})
+	FatalErr(err, "")
+	ExpectSliceEqual(t, []string{"", "dir1"}, paths, "stopped")
+
+	hashes := 0
+	err = indexer.IterHash(func(hash string, fileSize int64, paths []string) bool {
+		hashes++
+		return true
+	})
+	FatalErr(err, "")
+	ExpectEqual(t, 3, hashes, "hashes")
+	indexer.Close()
+
+	store, err := fileindexer.OpenStore(fileindexer.BACKEND_LEVELDB, filepath.Join(dir, "fileIndexerDb"), nil)
+	FatalErr(err, "")
+	FatalErr(store.Put([]byte("fdir2/bad"), []byte("\xff")), "")
+	FatalErr(store.Close(), "")
+	indexer = fileindexer.OpenOrCreate(dir, "")
+	defer indexer.Close()
+	err = indexer.IterDir("dir2", func(path string, meta *protos.FileMeta) bool {
+		return true
+	})
+	if !errors.Is(err, fileindexer.ErrCorruptRecord) {
+		t.Errorf("corrupt record: %v", err)
+	}
+	FatalErr(indexer.IterDir("dir1", func(path string, meta *protos.FileMeta) bool {
+		return true
+	}), "other dir")
+}
+
+// Expects dir counts and duplicate totals of a dir.
+func ExpectDirStats(t *testing.T, indexer *fileindexer.Indexer, relativePath string,
+	dirCount int32, duplicateCount int32, duplicateSize int64, uniqueSize int64) {
+	dirInfo := GetMeta(indexer, relativePath).DirInfo
+	ExpectEqual(t, dirCount, dirInfo.TotalDirCount, relativePath+" dir count")
+	ExpectEqual(t, duplicateCount, dirInfo.DuplicateFileCount, relativePath+" duplicate count")
+	ExpectEqual(t, duplicateSize, dirInfo.DuplicateFileSize, relativePath+" duplicate size")
+	ExpectEqual(t, uniqueSize, dirInfo.UniqueFileSize, relativePath+" unique size")
+}
+
+// Expects the totals of files of a dir which have a copy anywhere.
+func ExpectCopied(t *testing.T, indexer *fileindexer.Indexer, relativePath string, copiedCount int32, copiedSize int64) {
+	dirInfo := GetMeta(indexer, relativePath).DirInfo
+	ExpectEqual(t, copiedCount, dirInfo.CopiedFileCount, relativePath+" copied count")
+	ExpectEqual(t, copiedSize, dirInfo.CopiedFileSize, relativePath+" copied size")
+}
+
+func TestDirStats(t *testing.T) {
+	dir := setUp()
+	defer os.RemoveAll(dir)
+	_ = ioutil.WriteFile(filepath.Join(dir, "dir2/abc"), []byte("abc"), 0666)
+	_ = ioutil.WriteFile(filepath.Join(dir, "dir1/dir11/abc"), []byte("abc"), 0666)
+	indexer := fileindexer.OpenOrCreate(dir, "")
+	defer indexer.Close()
+	FatalErr(indexer.Update(), "")
+	// dedup keeps one of the three copies.
+	ExpectDirStats(t, indexer, "", 3, 2, 6, 11)
+	ExpectDirStats(t, indexer, "dir1", 1, 1, 3, 8)
+	// the copy in dir2 is the only one there, but dedup can reclaim it.
+	ExpectDirStats(t, indexer, "dir2", 0, 0, 0, 6)
+	ExpectCopied(t, indexer, "", 3, 9)
+	ExpectCopied(t, indexer, "dir1", 2, 6)
+	ExpectCopied(t, indexer, "dir2", 1, 3)
+
+	_ = os.Remove(filepath.Join(dir, "dir2/abc"))
+	FatalErr(indexer.Update(), "")
+	ExpectDirStats(t, indexer, "", 3, 1, 3, 11)
+	ExpectDirStats(t, indexer, "dir1", 1, 1, 3, 8)
+	ExpectDirStats(t, indexer, "dir2", 0, 0, 0, 3)
+	ExpectCopied(t, indexer, "", 2, 6)
+	ExpectCopied(t, indexer, "dir2", 0, 0)
+	_ = os.Remove(filepath.Join(dir, "dir1/dir11/abc"))
+	FatalErr(indexer.Update(), "")
+	ExpectDirStats(t, indexer, "", 3, 0, 0, 11)
+	ExpectDirStats(t, indexer, "dir1", 1, 0, 0, 8)
+
+	// hashed after the update, so totals follow the hash index.
+	indexer.SetHashMode(fileindexer.HASH_SIZE_FIRST)
+	_ = ioutil.WriteFile(filepath.Join(dir, "dir2/abc"), []byte("abc"), 0666)
+	FatalErr(indexer.Update(), "")
+	ExpectDirStats(t, indexer, "", 3, 1, 3, 11)
+	ExpectDirStats(t, indexer, "dir1", 1, 0, 0, 8)
+	ExpectDirStats(t, indexer, "dir2", 0, 0, 0, 6)
+	ExpectCopied(t, indexer, "", 2, 6)
+	ExpectCopied(t, indexer, "dir1", 1, 3)
+	ExpectCopied(t, indexer, "dir2", 1, 3)
+}
+
+func TestDuplicateTotals(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileindexer")
+	FatalErr(err, "")
+	defer os.RemoveAll(dir)
+	big := strings.Repeat("x", 300000)
+	files := map[string]string{
+		"a/big":     big,
+		"b/big":     big,
+		"b/c/big":   big,
+		"a/small":   "s",
+		"b/c/small": "s",
+	}
+	for path, content := range files {
+		FatalErr(os.MkdirAll(filepath.Join(dir, filepath.Dir(path)), 0777), "")
+		FatalErr(ioutil.WriteFile(filepath.Join(dir, path), []byte(content), 0666), "")
+	}
+	FatalErr(os.Link(filepath.Join(dir, "a/big"), filepath.Join(dir, "a/link")), "")
+	indexer := fileindexer.OpenOrCreate(dir, "")
+	defer indexer.Close()
+	FatalErr(indexer.Update(), "")
+	// what dedup reclaims, one copy of each file kept and links left alone.
+	ExpectDirStats(t, indexer, "", 3, 3, 600001, 600001)
+	ExpectDirStats(t, indexer, "a", 0, 0, 0, 600001)
+	ExpectDirStats(t, indexer, "b", 1, 1, 300000, 300001)
+	// everything has a copy somewhere.
+	ExpectCopied(t, indexer, "", 6, 1200002)
+	ExpectCopied(t, indexer, "a", 3, 600001)
+	ExpectCopied(t, indexer, "b", 3, 600001)
+
+	// totals kept up as paths change are those computed from scratch.
+	FatalErr(os.Remove(filepath.Join(dir, "b/big")), "")
+	FatalErr(ioutil.WriteFile(filepath.Join(dir, "b/small"), []byte("s"), 0666), "")
+	FatalErr(os.Link(filepath.Join(dir, "b/c/big"), filepath.Join(dir, "a/link2")), "")
+	FatalErr(indexer.UpdatePaths([]string{"b/big", "b/small", "a/link2"}), "")
+	ExpectDirStats(t, indexer, "", 3, 3, 300002, 900001)
+	indexDir, err := ioutil.TempDir("", "fileindexer")
+	FatalErr(err, "")
+	defer os.RemoveAll(indexDir)
+	fresh := fileindexer.OpenOrCreate(dir, indexDir)
+	defer fresh.Close()
+	FatalErr(fresh.Update(), "")
+	FatalErr(indexer.Walk("", func(relativePath string, meta *protos.FileMeta) int {
+		if meta.IsDir && meta.DirInfo != nil && !strings.HasPrefix(relativePath, "fileIndexerDb") {
+			dirInfo := GetMeta(fresh, relativePath).DirInfo
+			ExpectDirStats(t, indexer, relativePath, dirInfo.TotalDirCount, dirInfo.DuplicateFileCount,
+				dirInfo.DuplicateFileSize, dirInfo.UniqueFileSize)
+			ExpectCopied(t, indexer, relativePath, dirInfo.CopiedFileCount, dirInfo.CopiedFileSize)
+		}
+		return fileindexer.NORMAL
+	}), "")
+}
+
+func TestDuplicateDirs(t *testing.T) {
+	for _, hashMode := range []int{fileindexer.HASH_ALL, fileindexer.HASH_SIZE_FIRST} {
+		dir, err := ioutil.TempDir("", "fileindexer")
+		FatalErr(err, "")
+		defer os.RemoveAll(dir)
+		files := map[string]string{
+			"2014/Trip/a.jpg":                    "aaaa",
+			"2014/Trip/day1/b.jpg":               "bbbbbb",
+			"Backup/Photos/2014/Trip/a.jpg":      "aaaa",
+			"Backup/Photos/2014/Trip/day1/b.jpg": "bbbbbb",
+			"2015/Party/c":                       "cc",
+			"2015/Party/d":                       "dddddddddd",
+			"Old/Party/c":                        "cc",
+			"Old/Party/d":                        "dddddddddd",
+			"Old/Party/e":                        "e",
+		}
+		for path, content := range files {
+			FatalErr(os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0777), path)
+			FatalErr(ioutil.WriteFile(filepath.Join(dir, path), []byte(content), 0666), path)
+		}
+		indexer := fileindexer.OpenOrCreate(dir, "")
+		defer indexer.Close()
+		indexer.SetHashMode(hashMode)
+		FatalErr(indexer.Update(), "")
+		FatalErr(indexer.Check(), "")
+		name := fmt.Sprint("mode ", hashMode)
+
+		groups, err := indexer.IdenticalDirs()
+		FatalErr(err, "")
+		// Trip dirs are inside the 2014 dirs.
+		ExpectEqual(t, 1, len(groups), name+" groups")
+		if len(groups) == 1 {
+			ExpectEqual(t, "2014,Backup/Photos/2014", strings.Join(groups[0].Paths, ","), name+" identical")
+			ExpectEqual(t, int64(10), groups[0].TotalFileSize, name+" identical size")
+		}
+		ExpectEqual(t, GetMeta(indexer, "2014/Trip").DirInfo.ContentHash,
+			GetMeta(indexer, "Backup/Photos/2014/Trip").DirInfo.ContentHash, name+" trip hash")
+
+		pairs, err := indexer.SimilarDirs(0.9)
+		FatalErr(err, "")
+		ExpectEqual(t, 1, len(pairs), name+" pairs")
+		if len(pairs) == 1 {
+			ExpectEqual(t, [2]string{"2015", "Old"}, pairs[0].Paths, name+" similar")
+			ExpectEqual(t, int64(12), pairs[0].SharedFileSize, name+" shared size")
+		}
+	}
+}
+
+func TestLinkDedup(t *testing.T) {
+	dir := setUp()
+	defer os.RemoveAll(dir)
+	_ = ioutil.WriteFile(filepath.Join(dir, "dir2/abc"), []byte("abc"), 0666)
+	_ = ioutil.WriteFile(filepath.Join(dir, "dir1/dir11/abc"), []byte("abc"), 0666)
+	indexer := fileindexer.OpenOrCreate(dir, "")
+	defer indexer.Close()
+	FatalErr(indexer.Update(), "")
+	ExpectDirStats(t, indexer, "", 3, 2, 6, 11)
+
+	FatalErr(fileindexer.ReplaceWithLink("dir2/abc", "dir1/abc", dir, fileindexer.DEDUP_HARDLINK), "hardlink")
+	FatalErr(indexer.Update(), "")
+	// dir1/dir11/abc is still a copy.
+	ExpectDirStats(t, indexer, "", 3, 1, 3, 14)
+	ExpectCopied(t, indexer, "", 3, 9)
+	links, err := indexer.GroupLinks([]string{"dir1/abc", "dir1/dir11/abc", "dir2/abc"})
+	FatalErr(err, "")
+	ExpectEqual(t, 2, len(links), "hardlinks")
+	if len(links) == 2 {
+		ExpectSliceEqual(t, []string{"dir1/abc", "dir2/abc"}, links[0], "hardlinks")
+	}
+
+	FatalErr(fileindexer.ReplaceWithLink("dir1/dir11/abc", "dir1/abc", dir, fileindexer.DEDUP_SYMLINK), "symlink")
+	target, err := os.Readlink(filepath.Join(dir, "dir1/dir11/abc"))
+	FatalErr(err, "")
+	ExpectEqual(t, "../abc", target, "symlink target")
+	FatalErr(indexer.Update(), "")
+	FatalErr(indexer.Check(), "")
+	ExpectDirStats(t, indexer, "", 3, 0, 0, 17)
+	ExpectCopied(t, indexer, "", 0, 0)
+	ExpectEqual(t, int64(3), GetMeta(indexer, "dir1/dir11/abc").Size, "symlink size")
+	links, err = indexer.GroupLinks([]string{"dir1/abc", "dir1/dir11/abc", "dir2/abc"})
+	FatalErr(err, "")
+	ExpectEqual(t, 1, len(links), "links")
+
+	// reflinks need a file system supporting them.
+	_ = ioutil.WriteFile(filepath.Join(dir, "dir2/xyz2"), []byte("xyz"), 0666)
+	err = fileindexer.ReplaceWithLink("dir2/xyz2", "dir2/xyz", dir, fileindexer.DEDUP_REFLINK)
+	if err != nil {
+		t.Log("reflink not supported: ", err)
+		return
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, "dir2/xyz2"))
+	FatalErr(err, "")
+	ExpectEqual(t, "xyz", string(content), "reflink content")
+}
+
+// The file kept by a hardlink dedup has a new ctime, but only its link count
+// changed, so it is not hashed again.
+func TestHardlinkKeptNotRehashed(t *testing.T) {
+	dir := setUp()
+	defer os.RemoveAll(dir)
+	indexDir := filepath.Join(dir, "fileIndexerDb")
+	_ = ioutil.WriteFile(filepath.Join(dir, "dir2/abc"), []byte("abc"), 0666)
+	indexer := fileindexer.OpenOrCreate(dir, indexDir)
+	FatalErr(indexer.Update(), "")
+	meta := GetMeta(indexer, "dir1/abc")
+	ExpectEqual(t, uint64(1), meta.Nlink, "nlink")
+	indexer.Close()
+
+	// The bogus hash stays unless the file is rehashed.
+	db, err := leveldb.OpenFile(indexDir, nil)
+	FatalErr(err, "")
+	meta.Hash = "md5:00000000000000000000000000000000"
+	data, err := proto.Marshal(meta)
+	FatalErr(err, "")
+	FatalErr(db.Put([]byte("fdir1/abc"), data, nil), "")
+	db.Close()
+
+	indexer = fileindexer.OpenOrCreate(dir, indexDir)
+	defer indexer.Close()
+	FatalErr(fileindexer.ReplaceWithLink("dir2/abc", "dir1/abc", dir, fileindexer.DEDUP_HARDLINK), "hardlink")
+	FatalErr(indexer.Update(), "")
+	ExpectEqual(t, "md5:00000000000000000000000000000000", GetMeta(indexer, "dir1/abc").Hash, "hash")
+	ExpectEqual(t, uint64(2), GetMeta(indexer, "dir1/abc").Nlink, "nlink")
+
+	// a new ctime with the same link count is still noticed.
+	FatalErr(os.Chmod(filepath.Join(dir, "dir1/abc"), 0600), "")
+	FatalErr(indexer.Update(), "")
+	ExpectEqual(t, "md5:900150983cd24fb0d6963f7d28e17f72", GetMeta(indexer, "dir1/abc").Hash, "hash")
+}
+
+func TestLinkDedupSymlinkKept(t *testing.T) {
+	dir := setUp()
+	defer os.RemoveAll(dir)
+	outside, err := ioutil.TempDir("", "fileindexer")
+	FatalErr(err, "")
+	defer os.RemoveAll(outside)
+	_ = ioutil.WriteFile(filepath.Join(dir, "dir1/dir11/abc"), []byte("abc"), 0666)
+	FatalErr(os.Symlink("../dir1/abc", filepath.Join(dir, "dir2/abc")), "")
+
+	// the file linked to is linked, not the relative symlink.
+	for _, strategy := range []int{fileindexer.DEDUP_HARDLINK, fileindexer.DEDUP_SYMLINK} {
+		_ = os.Remove(filepath.Join(dir, "dir1/dir11/abc"))
+		_ = ioutil.WriteFile(filepath.Join(dir, "dir1/dir11/abc"), []byte("abc"), 0666)
+		FatalErr(fileindexer.ReplaceWithLink("dir1/dir11/abc", "dir2/abc", dir, strategy), fmt.Sprint(strategy))
+		content, err := ioutil.ReadFile(filepath.Join(dir, "dir1/dir11/abc"))
+		FatalErr(err, fmt.Sprint(strategy))
+		ExpectEqual(t, "abc", string(content), fmt.Sprint("content of ", strategy))
+	}
+	target, err := os.Readlink(filepath.Join(dir, "dir1/dir11/abc"))
+	FatalErr(err, "")
+	ExpectEqual(t, "../abc", target, "symlink target")
+
+	// not to a file outside the base dir.
+	_ = ioutil.WriteFile(filepath.Join(outside, "abc"), []byte("abc"), 0666)
+	FatalErr(os.Symlink(filepath.Join(outside, "abc"), filepath.Join(dir, "dir2/outside")), "")
+	err = fileindexer.ReplaceWithLink("dir1/dir11/abc", "dir2/outside", dir, fileindexer.DEDUP_HARDLINK)
+	ExpectEqual(t, true, errors.Is(err, fileindexer.ErrMismatch), fmt.Sprint("outside: ", err))
+}
+
+func TestVerifyDuplicate(t *testing.T) {
+	dir := setUp()
+	defer os.RemoveAll(dir)
+	copyPath := filepath.Join(dir, "dir2/abc")
+	_ = ioutil.WriteFile(copyPath, []byte("abc"), 0666)
+	indexer := fileindexer.OpenOrCreate(dir, "")
+	defer indexer.Close()
+	FatalErr(indexer.Update(), "")
+	FatalErr(indexer.VerifyDuplicate("dir2/abc", "dir1/abc"), "copy")
+
+	// same size and time, as after a collision.
+	info, err := os.Stat(copyPath)
+	FatalErr(err, "")
+	_ = ioutil.WriteFile(copyPath, []byte("abd"), 0666)
+	FatalErr(os.Chtimes(copyPath, info.ModTime(), info.ModTime()), "")
+	err = indexer.VerifyDuplicate("dir2/abc", "dir1/abc")
+	ExpectEqual(t, true, errors.Is(err, fileindexer.ErrMismatch), fmt.Sprint("content: ", err))
+	records := ListErrors(t, indexer)
+	ExpectEqual(t, 1, len(records), "records")
+	if len(records) == 1 {
+		ExpectEqual(t, "dir2/abc", records[0].Path, "record path")
+		ExpectEqual(t, "verify", records[0].Op, "record op")
+	}
+
+	_ = ioutil.WriteFile(copyPath, []byte("abcd"), 0666)
+	err = indexer.VerifyDuplicate("dir2/abc", "dir1/abc")
+	ExpectEqual(t, true, errors.Is(err, fileindexer.ErrMismatch), fmt.Sprint("changed: ", err))
+	_ = os.Remove(copyPath)
+	err = indexer.VerifyDuplicate("dir2/abc", "dir1/abc")
+	ExpectEqual(t, true, errors.Is(err, fileindexer.ErrNotFound), fmt.Sprint("removed: ", err))
+	err = indexer.VerifyDuplicate("dir2/xyz", "dir1/none")
+	ExpectEqual(t, true, errors.Is(err, fileindexer.ErrMismatch), fmt.Sprint("not indexed: ", err))
+
+	// the next update clears the records.
+	FatalErr(indexer.Update(), "")
+	ExpectEqual(t, 0, len(ListErrors(t, indexer)), "records after update")
+}
+
+func TestVerifyMigratedTimes(t *testing.T) {
+	dir := setUp()
+	defer os.RemoveAll(dir)
+	indexDir := filepath.Join(dir, "fileIndexerDb")
+	modTime := time.Unix(1600000000, 500000000)
+	for _, path := range []string{"dir1/abc", "dir2/abc"} {
+		_ = ioutil.WriteFile(filepath.Join(dir, path), []byte("abc"), 0666)
+		FatalErr(os.Chtimes(filepath.Join(dir, path), modTime, modTime), "")
+	}
+	indexer := fileindexer.OpenOrCreate(dir, indexDir)
+	FatalErr(indexer.Update(), "")
+	dbMeta := proto.Clone(indexer.GetDbMeta()).(*protos.DbMeta)
+	metas := map[string]*protos.FileMeta{
+		"dir1/abc": GetMeta(indexer, "dir1/abc"),
+		"dir2/abc": GetMeta(indexer, "dir2/abc"),
+	}
+	indexer.Close()
+
+	// times in seconds, as versions before nanoseconds wrote them.
+	db, err := leveldb.OpenFile(indexDir, nil)
+	FatalErr(err, "")
+	put := func(key string, msg proto.Message) {
+		data, err := proto.Marshal(msg)
+		FatalErr(err, "")
+		FatalErr(db.Put([]byte(key), data, nil), "")
+	}
+	dbMeta.NsTimes = false
+	dbMeta.SchemaVersion = 0
+	put(".", dbMeta)
+	for path, meta := range metas {
+		meta.ModTime = int32(modTime.Unix())
+		meta.ModTimeNs = 0
+		meta.CtimeNs = 0
+		put("f"+path, meta)
+	}
+	db.Close()
+
+	indexer = fileindexer.OpenOrCreate(dir, indexDir)
+	defer indexer.Close()
+	ExpectEqual(t, modTime.Unix()*1e9, GetMeta(indexer, "dir2/abc").ModTimeNs, "migrated")
+	FatalErr(indexer.VerifyDuplicate("dir2/abc", "dir1/abc"), "sub-second modTime")
+	later := modTime.Add(time.Second)
+	FatalErr(os.Chtimes(filepath.Join(dir, "dir2/abc"), later, later), "")
+	err = indexer.VerifyDuplicate("dir2/abc", "dir1/abc")
+	ExpectEqual(t, true, errors.Is(err, fileindexer.ErrMismatch), fmt.Sprint("changed: ", err))
+}
+
+func TestDedupJournal(t *testing.T) {
+	dir := setUp()
+	defer os.RemoveAll(dir)
+	tmpDir, err := ioutil.TempDir("", "fileindexer")
+	FatalErr(err, "")
+	defer os.RemoveAll(tmpDir)
+	_ = ioutil.WriteFile(filepath.Join(dir, "dir2/abc"), []byte("abc"), 0666)
+	_ = ioutil.WriteFile(filepath.Join(dir, "dir1/dir11/abc"), []byte("abc"), 0666)
+	indexer := fileindexer.OpenOrCreate(dir, "")
+	defer indexer.Close()
+	FatalErr(indexer.Update(), "")
+
+	// the linked path is restored with its own mode and time, not the kept one's.
+	linked := filepath.Join(dir, "dir1/dir11/abc")
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	FatalErr(os.Chmod(linked, 0600), "")
+	FatalErr(os.Chtimes(linked, modTime, modTime), "")
+
+	run := fileindexer.NewDedupRun()
+	FatalErr(indexer.DedupPath(run, "dir2/abc", "dir1/abc", fileindexer.DEDUP_MOVE, tmpDir), "move")
+	FatalErr(indexer.DedupPath(run, "dir1/dir11/abc", "dir1/abc", fileindexer.DEDUP_HARDLINK, ""), "hardlink")
+	changed := []string{"dir2/abc", "dir1/dir11/abc", "dir1/abc"}
+	FatalErr(indexer.UpdatePaths(changed), "")
+	FatalErr(indexer.Check(), "")
+	ExpectEqual(t, true, GetMeta(indexer, "dir2/abc") == nil, "moved")
+	ExpectDirStats(t, indexer, "", 3, 0, 0, 14)
+
+	entries := []*protos.JournalEntry{}
+	FatalErr(indexer.IterJournal(0, func(entry *protos.JournalEntry) bool {
+		entries = append(entries, entry)
+		return true
+	}), "")
+	ExpectEqual(t, 2, len(entries), "entries")
+	last, err := indexer.LastDedupRun()
+	FatalErr(err, "")
+	ExpectEqual(t, run, last, "last run")
+	for _, entry := range entries {
+		ExpectEqual(t, "dir1/abc", entry.KeepPath, entry.Path+" kept")
+		ExpectEqual(t, GetMeta(indexer, "dir1/abc").Hash, entry.Hash, entry.Path+" hash")
+	}
+
+	// not restored over a new file.
+	_ = ioutil.WriteFile(filepath.Join(dir, "dir2/abc"), []byte("new"), 0666)
+	err = indexer.Restore(entries[1])
+	ExpectEqual(t, true, errors.Is(err, fileindexer.ErrMismatch), fmt.Sprint("exists: ", err))
+	_ = os.Remove(filepath.Join(dir, "dir2/abc"))
+	for _, entry := range entries {
+		FatalErr(indexer.Restore(entry), entry.Path)
+	}
+	FatalErr(indexer.UpdatePaths(changed), "")
+	FatalErr(indexer.Check(), "")
+	content, err := ioutil.ReadFile(filepath.Join(dir, "dir2/abc"))
+	FatalErr(err, "")
+	ExpectEqual(t, "abc", string(content), "restored")
+	kept, err := os.Stat(filepath.Join(dir, "dir1/abc"))
+	FatalErr(err, "")
+	copied, err := os.Stat(filepath.Join(dir, "dir1/dir11/abc"))
+	FatalErr(err, "")
+	ExpectEqual(t, false, os.SameFile(kept, copied), "link restored")
+	ExpectEqual(t, os.FileMode(0600), copied.Mode().Perm(), "restored mode")
+	ExpectEqual(t, modTime.UnixNano(), copied.ModTime().UnixNano(), "restored modTime")
+	ExpectDirStats(t, indexer, "", 3, 2, 6, 11)
+	last, err = indexer.LastDedupRun()
+	FatalErr(err, "")
+	ExpectEqual(t, int64(0), last, "journal after restore")
+}
+
+func TestDedupJournalPending(t *testing.T) {
+	dir := setUp()
+	defer os.RemoveAll(dir)
+	tmpDir, err := ioutil.TempDir("", "fileindexer")
+	FatalErr(err, "")
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(dir, "dir2/abc")
+	_ = ioutil.WriteFile(path, []byte("abc"), 0666)
+	indexer := fileindexer.OpenOrCreate(dir, "")
+	defer indexer.Close()
+	FatalErr(indexer.Update(), "")
+	journal := func() []*protos.JournalEntry {
+		entries := []*protos.JournalEntry{}
+		FatalErr(indexer.IterJournal(0, func(entry *protos.JournalEntry) bool {
+			entries = append(entries, entry)
+			return true
+		}), "")
+		return entries
+	}
+
+	// crashed after journaling, before moving.
+	run := fileindexer.NewDedupRun()
+	fileindexer.SetCrashHook(indexer, func(point string) {
+		if point == "journal" {
+			panic(point)
+		}
+	})
+	crashed := func() (crashed bool) {
+		defer func() {
+			crashed = recover() != nil
+		}()
+		FatalErr(indexer.DedupPath(run, "dir2/abc", "dir1/abc", fileindexer.DEDUP_MOVE, tmpDir), "")
+		return false
+	}()
+	fileindexer.SetCrashHook(indexer, nil)
+	ExpectEqual(t, true, crashed, "crashed")
+	entries := journal()
+	ExpectEqual(t, 1, len(entries), "pending entries")
+	ExpectEqual(t, true, entries[0].Pending, "pending")
+	FatalErr(indexer.Restore(entries[0]), "pending")
+	ExpectEqual(t, 0, len(journal()), "entries after restore")
+	content, err := ioutil.ReadFile(path)
+	FatalErr(err, "")
+	ExpectEqual(t, "abc", string(content), "not moved")
+
+	// runs moving the same path with one tmpDir keep their own copies.
+	FatalErr(indexer.DedupPath(run, "dir2/abc", "dir1/abc", fileindexer.DEDUP_MOVE, tmpDir), "first run")
+	_ = ioutil.WriteFile(path, []byte("abc"), 0666)
+	FatalErr(indexer.DedupPath(run+1, "dir2/abc", "dir1/abc", fileindexer.DEDUP_MOVE, tmpDir), "second run")
+	entries = journal()
+	ExpectEqual(t, 2, len(entries), "entries")
+	ExpectEqual(t, false, entries[0].Pending, "done")
+	ExpectEqual(t, filepath.Join(tmpDir, fmt.Sprint(run), "dir2/abc"), entries[0].Destination, "first destination")
+	ExpectEqual(t, filepath.Join(tmpDir, fmt.Sprint(run+1), "dir2/abc"), entries[1].Destination, "second destination")
+	FatalErr(indexer.Restore(entries[1]), "second run")
+	err = fileindexer.RemoveFileSafely("dir2/abc", dir, filepath.Join(tmpDir, fmt.Sprint(run)))
+	ExpectEqual(t, true, errors.Is(err, fileindexer.ErrMismatch), fmt.Sprint("destination exists: ", err))
+	_ = os.Remove(path)
+	FatalErr(indexer.Restore(entries[0]), "first run")
+	content, err = ioutil.ReadFile(path)
+	FatalErr(err, "")
+	ExpectEqual(t, "abc", string(content), "restored")
+}
+
+func TestDecisions(t *testing.T) {
+	dir := setUp()
+	defer os.RemoveAll(dir)
+	_ = ioutil.WriteFile(filepath.Join(dir, "dir2/abc"), []byte("abc"), 0666)
+	indexer := fileindexer.OpenOrCreate(dir, "")
+	FatalErr(indexer.Update(), "")
+	hash := GetMeta(indexer, "dir1/abc").Hash
+	paths := []string{"dir1/abc", "dir2/abc"}
+	FatalErr(indexer.SaveDecision(hash, fileindexer.DECISION_DEDUP, "dir2/abc", paths), "")
+	indexer.Close()
+
+	indexer = fileindexer.OpenOrCreate(dir, "")
+	defer indexer.Close()
+	FatalErr(indexer.Check(), "")
+	decision, err := indexer.GetDecision(hash, []string{"dir2/abc", "dir1/abc"})
+	FatalErr(err, "")
+	ExpectEqual(t, true, decision != nil, "decision")
+	if decision != nil {
+		ExpectEqual(t, int32(fileindexer.DECISION_DEDUP), decision.Action, "action")
+		ExpectEqual(t, "dir2/abc", decision.KeepPath, "keep")
+	}
+	// a new copy is decided on again.
+	decision, err = indexer.GetDecision(hash, append(paths, "dir1/dir11/abc"))
+	FatalErr(err, "")
+	ExpectEqual(t, true, decision == nil, "new copy")
+
+	FatalErr(indexer.SaveDecision(hash, fileindexer.DECISION_KEEP_ALL, "", paths), "")
+	decision, err = indexer.GetDecision(hash, paths)
+	FatalErr(err, "")
+	ExpectEqual(t, int32(fileindexer.DECISION_KEEP_ALL), decision.Action, "replaced")
+}
+
+func TestPlan(t *testing.T) {
+	dir := setUp()
+	defer os.RemoveAll(dir)
+	copyPath := filepath.Join(dir, "dir2/abc")
+	_ = ioutil.WriteFile(copyPath, []byte("abc"), 0666)
+	indexer := fileindexer.OpenOrCreate(dir, "")
+	defer indexer.Close()
+	FatalErr(indexer.Update(), "")
+	hash := GetMeta(indexer, "dir1/abc").Hash
+
+	planPath := filepath.Join(dir, "plan.json")
+	plan := &fileindexer.Plan{Sequence: 1, Strategy: "move", Groups: []*fileindexer.PlanGroup{
+		{Hash: "md5:b", Size: 2, Keep: "b1", Remove: []string{"b3", "b2"}},
+		{Hash: hash, Size: 3, Keep: "dir1/abc", Remove: []string{"dir2/abc"}, Reasons: []string{"oldest: 1 of 2 left"}},
+	}}
+	FatalErr(fileindexer.WritePlan(planPath, plan), "")
+	read, err := fileindexer.ReadPlan(planPath)
+	FatalErr(err, "")
+	ExpectEqual(t, int32(1), read.Sequence, "sequence")
+	ExpectEqual(t, "move", read.Strategy, "strategy")
+	ExpectEqual(t, 2, len(read.Groups), "groups")
+	if len(read.Groups) == 2 {
+		ExpectEqual(t, "md5:b", read.Groups[1].Hash, "hash order")
+		ExpectSliceEqual(t, []string{"b2", "b3"}, read.Groups[1].Remove, "remove order")
+		ExpectSliceEqual(t, []string{"oldest: 1 of 2 left"}, read.Groups[0].Reasons, "reasons")
+	}
+
+	// edited plans which could remove every copy are not read.
+	badPlans := map[string][]*fileindexer.PlanGroup{
+		"kept and removed": {{Hash: hash, Keep: "dir1/abc", Remove: []string{"dir2/abc", "dir1/abc"}}},
+		"removed twice":    {{Hash: hash, Keep: "dir1/abc", Remove: []string{"dir2/abc", "./dir2/abc"}}},
+		"in two groups": {
+			{Hash: hash, Keep: "dir1/abc", Remove: []string{"dir2/abc"}},
+			{Hash: "md5:b", Keep: "dir2/abc", Remove: []string{"b2"}},
+		},
+		"nothing kept": {{Hash: hash, Remove: []string{"dir2/abc"}}},
+	}
+	for name, groups := range badPlans {
+		data, err := json.Marshal(&fileindexer.Plan{Strategy: "move", Groups: groups})
+		FatalErr(err, "")
+		FatalErr(ioutil.WriteFile(planPath, data, 0666), "")
+		_, err = fileindexer.ReadPlan(planPath)
+		ExpectEqual(t, true, errors.Is(err, fileindexer.ErrCorruptRecord), fmt.Sprint(name, ": ", err))
+	}
+
+	FatalErr(indexer.VerifyHash("dir2/abc", hash), "copy")
+	err = indexer.VerifyHash("dir2/abc", "md5:b")
+	ExpectEqual(t, true, errors.Is(err, fileindexer.ErrMismatch), fmt.Sprint("other hash: ", err))
+	info, err := os.Stat(copyPath)
+	FatalErr(err, "")
+	_ = ioutil.WriteFile(copyPath, []byte("abd"), 0666)
+	FatalErr(os.Chtimes(copyPath, info.ModTime(), info.ModTime()), "")
+	err = indexer.VerifyHash("dir2/abc", hash)
+	ExpectEqual(t, true, errors.Is(err, fileindexer.ErrMismatch), fmt.Sprint("content: ", err))
+}
+
+func TestListDirAndWalk(t *testing.T) {
+	dir := setUp()
+	defer os.RemoveAll(dir)
+	indexer := fileindexer.OpenOrCreate(dir, "")
+	defer indexer.Close()
+	FatalErr(indexer.Update(), "")
+	// answered from the index only.
+	FatalErr(os.RemoveAll(filepath.Join(dir, "dir1")), "")
+
+	names := func(metas []*protos.FileMeta) []string {
+		paths := []string{}
+		for _, meta := range metas {
+			paths = append(paths, meta.RelativePath)
+		}
+		return paths
+	}
+	children, err := indexer.ListDir("")
+	FatalErr(err, "")
+	ExpectSliceEqual(t, []string{"dir1", "dir2"}, names(children), "root")
+	children, err = indexer.ListDir("dir1")
+	FatalErr(err, "")
+	ExpectSliceEqual(t, []string{"dir1/abc", "dir1/dir11"}, names(children), "dir1")
+	ExpectEqual(t, int64(5), children[1].DirInfo.TotalFileSize, "dir11 size")
+	children, err = indexer.ListDir("dir2/xyz")
+	FatalErr(err, "")
+	ExpectEqual(t, 0, len(children), "file children")
+	if _, err := indexer.ListDir("dir3"); !errors.Is(err, fileindexer.ErrNotFound) {
+		t.Errorf("missing dir: %v", err)
+	}
+
+	paths := []string{}
+	err = indexer.Walk("", func(path string, meta *protos.FileMeta) int {
+		paths = append(paths, path)
+		if path == "dir1/dir11" {
+			return fileindexer.STOP_SCAN_THIS_DIR
+		}
+		return fileindexer.NORMAL
+	})
+	FatalErr(err, "")
+	// a dir before its entries, in name order.
+	ExpectEqual(t, ",dir1,dir1/abc,dir1/dir11,dir2,dir2/xyz", strings.Join(paths, ","), "walk")
+}
+
+// Returns the entries of an index, without their sequences.
+func DumpIndex(indexer *fileindexer.Indexer) []string {
+	entries := []string{}
+	indexer.Iter(func(path string, meta *protos.FileMeta) bool {
+		entries = append(entries, fmt.Sprint(path, meta.Size, meta.Hash, meta.QuickHash))
+		if meta.IsDir {
+			entries = append(entries, fmt.Sprint(meta.DirInfo.TotalFileCount, meta.DirInfo.TotalFileSize))
+		}
+		return true
+	})
+	indexer.IterHash(func(hash string, fileSize int64, paths []string) bool {
+		entries = append(entries, fmt.Sprint(hash, fileSize, paths))
+		return true
+	})
+	indexer.IterSize(func(fileSize int64, paths []string) bool {
+		entries = append(entries, fmt.Sprint(fileSize, paths))
+		return true
+	})
+	return entries
+}
+
+func TestParallelUpdate(t *testing.T) {
+	dir := setUp()
+	defer os.RemoveAll(dir)
+	for i := 0; i < 50; i++ {
+		sub := filepath.Join(dir, fmt.Sprintf("many/%d", i%7))
+		_ = os.MkdirAll(sub, 0777)
+		_ = ioutil.WriteFile(filepath.Join(sub, fmt.Sprintf("f%d", i)), []byte(fmt.Sprint(i%10)), 0666)
+	}
+
+	dump := func(workers int) []string {
+		indexDir, err := ioutil.TempDir("", "fileindexer")
+		FatalErr(err, "")
+		defer os.RemoveAll(indexDir)
+		indexer := fileindexer.OpenOrCreate(dir, indexDir)
+		defer indexer.Close()
+		indexer.SetWorkers(workers)
+		indexer.Update()
+		indexer.Update()
+		return DumpIndex(indexer)
+	}
+	serial := dump(1)
+	parallel := dump(8)
+	if !reflect.DeepEqual(serial, parallel) {
+		t.Errorf("parallel update differs from serial update:\n%v\n%v", serial, parallel)
+	}
+}
+
+func TestEnsureHashedChanged(t *testing.T) {
+	dir := setUp()
+	defer os.RemoveAll(dir)
+	indexer := fileindexer.OpenOrCreate(dir, "")
+	defer indexer.Close()
+	indexer.SetHashMode(fileindexer.HASH_SIZE_FIRST)
+	FatalErr(indexer.Update(), "")
+
+	// changed since the update, the new content is not hashed.
+	xdong := filepath.Join(dir, "dir1/dir11/xdong")
+	_ = ioutil.WriteFile(xdong, []byte("abcde"), 0666)
+	later := time.Now().Add(time.Hour)
+	FatalErr(os.Chtimes(xdong, later, later), "")
+	err := indexer.EnsureHashed([]string{"dir1/dir11/xdong"})
+	ExpectEqual(t, true, errors.Is(err, fileindexer.ErrMismatch), fmt.Sprint("abort: ", err))
+	indexer.SetErrorPolicy(fileindexer.ON_ERROR_SKIP)
+	FatalErr(indexer.EnsureHashed([]string{"dir1/dir11/xdong"}), "skip")
+	FatalErr(indexer.EnsureQuickHashed([]string{"dir1/dir11/xdong"}), "quick hash")
+	meta := GetMeta(indexer, "dir1/dir11/xdong")
+	ExpectEqual(t, true, meta.Unhashed, "unhashed")
+	ExpectEqual(t, "", meta.QuickHash, "quick hash")
+	records := ListErrors(t, indexer)
+	ExpectEqual(t, 1, len(records), "records")
+	if len(records) == 1 {
+		ExpectEqual(t, fileindexer.ErrMismatch.Error(), records[0].Kind, "record kind")
+	}
+
+	// hashed once indexed again.
+	FatalErr(indexer.Update(), "")
+	FatalErr(indexer.EnsureHashed([]string{"dir1/dir11/xdong"}), "")
+	ExpectEqual(t, "md5:ab56b4d92b40713acc5af89985d4b786", GetMeta(indexer, "dir1/dir11/xdong").Hash, "hash")
+}
+
+func TestSizeFirstUpdate(t *testing.T) {
+	dir := setUp()
+	defer os.RemoveAll(dir)
+
+	indexer := fileindexer.OpenOrCreate(dir, "")
+	defer indexer.Close()
+	indexer.SetHashMode(fileindexer.HASH_SIZE_FIRST)
+	indexer.Update()
+
+	// abc and xyz have the same size, xdong is unique.
+	fileTests := []FileTest{
+		{"dir1/abc", protos.FileMeta{Size: 3, Hash: ABC_MD5SUM}},
+		{"dir2/xyz", protos.FileMeta{Size: 3, Hash: XYZ_MD5SUM}},
+		{"dir1/dir11/xdong", protos.FileMeta{Size: 5, Hash: ""}},
+	}
+	VerifyFileTests(indexer, fileTests, t)
+	if meta := GetMeta(indexer, "dir1/dir11/xdong"); meta == nil || !meta.Unhashed {
+		t.Errorf("dir1/dir11/xdong should be unhashed")
+	}
+	hashTests := []HashTest{
+		{ABC_MD5SUM, []string{"dir1/abc"}},
+		{XYZ_MD5SUM, []string{"dir2/xyz"}},
+		{XDONG_MD5SUM, nil},
+	}
+	VerifyHashTests(indexer, hashTests, t)
+	ExpectSliceEqual(t, []string{"dir1/dir11/xdong"}, GetFilesBySize(indexer, 5), "size 5")
+
+	// A copy of xdong makes both of them hashed.
+	_ = ioutil.WriteFile(filepath.Join(dir, "dir2/xdong"), []byte("xdong"), 0666)
+	indexer.Update()
+	fileTests = []FileTest{
+		{"dir1/dir11/xdong", protos.FileMeta{Size: 5, Hash: XDONG_MD5SUM}},
+		{"dir2/xdong", protos.FileMeta{Size: 5, Hash: XDONG_MD5SUM}},
+	}
+	VerifyFileTests(indexer, fileTests, t)
+	dups := 0
+	indexer.IterHash(func(hash string, fileSize int64, paths []string) bool {
+		if len(paths) > 1 {
+			dups++
+			ExpectEqual(t, XDONG_MD5SUM, hash, "duplicated hash")
+		}
+		return true
+	})
+	ExpectEqual(t, 1, dups, "duplicated groups")
+
+	// An unindexed file with the size of an unhashed file is looked up by
+	// content.
+	_ = os.Remove(filepath.Join(dir, "dir2/xdong"))
+	_ = ioutil.WriteFile(filepath.Join(dir, "dir2/uvw"), []byte("uvw"), 0666)
+	_ = ioutil.WriteFile(filepath.Join(dir, "1234567"), []byte("1234567"), 0666)
+	indexer.Update()
+	if meta := GetMeta(indexer, "1234567"); meta == nil || !meta.Unhashed {
+		t.Errorf("1234567 should be unhashed")
+	}
+	other, err := ioutil.TempDir("", "fileindexer")
+	FatalErr(err, "")
+	defer os.RemoveAll(other)
+	_ = ioutil.WriteFile(filepath.Join(other, "copy"), []byte("1234567"), 0666)
+	_, files, err := indexer.LookupFile(filepath.Join(other, "copy"), 7)
+	FatalErr(err, "")
+	ExpectSliceEqual(t, []string{"1234567"}, files, "lookup")
+}
+
+func TestQuickFirstUpdate(t *testing.T) {
+	dir := setUp()
+	defer os.RemoveAll(dir)
+
+	// Files of 3KiB. same1 and same2 differ only in the middle, which is
+	// not covered by a quick hash of 1KiB head and tail.
+	content := func(head, middle byte) []byte {
+		data := bytes.Repeat([]byte{'t'}, 3*1024)
+		data[0] = head
+		data[1536] = middle
+		return data
+	}
+	_ = ioutil.WriteFile(filepath.Join(dir, "same1"), content('h', 'a'), 0666)
+	_ = ioutil.WriteFile(filepath.Join(dir, "same2"), content('h', 'b'), 0666)
+	_ = ioutil.WriteFile(filepath.Join(dir, "other"), content('x', 'a'), 0666)
+
+	indexer := fileindexer.OpenOrCreate(dir, "")
+	defer indexer.Close()
+	FatalErr(indexer.SetQuickHashKiB(1), "")
+	indexer.SetHashMode(fileindexer.HASH_QUICK_FIRST)
+	indexer.Update()
+
+	for _, path := range []string{"same1", "same2", "other"} {
+		meta := GetMeta(indexer, path)
+		if meta == nil || meta.QuickHash == "" {
+			t.Errorf("%s should be quick hashed", path)
+			continue
+		}
+		ExpectEqual(t, path == "other", meta.Unhashed, path+" unhashed")
+	}
+	ExpectEqual(t, GetMeta(indexer, "same1").QuickHash,
+		GetMeta(indexer, "same2").QuickHash, "quick hash")
+	// Small files are fully hashed along with the quick hash.
+	fileTests := []FileTest{
+		{"dir1/abc", protos.FileMeta{Size: 3, Hash: ABC_MD5SUM}},
+		{"dir2/xyz", protos.FileMeta{Size: 3, Hash: XYZ_MD5SUM}},
+		{"dir1/dir11/xdong", protos.FileMeta{Size: 5, Hash: ""}},
+	}
+	VerifyFileTests(indexer, fileTests, t)
+	indexer.IterHash(func(hash string, fileSize int64, paths []string) bool {
+		if len(paths) > 1 {
+			t.Errorf("unexpected duplicates %v", paths)
+		}
+		return true
+	})
+
+	// A copy of other is found by quick hash, then confirmed by full hash.
+	_ = ioutil.WriteFile(filepath.Join(dir, "dir2/other"), content('x', 'a'), 0666)
+	indexer.Update()
+	dups := [][]string{}
+	indexer.IterHash(func(hash string, fileSize int64, paths []string) bool {
+		if len(paths) > 1 {
+			dups = append(dups, paths)
+		}
+		return true
+	})
+	ExpectEqual(t, 1, len(dups), "duplicated groups")
+	if len(dups) == 1 {
+		ExpectSliceEqual(t, []string{"other", "dir2/other"}, dups[0], "duplicates")
+	}
+
+	// Lookup does not need a full hash when quick hashes differ.
+	other, err := ioutil.TempDir("", "fileindexer")
+	FatalErr(err, "")
+	defer os.RemoveAll(other)
+	_ = ioutil.WriteFile(filepath.Join(other, "new"), content('n', 'a'), 0666)
+	digest, files, err := indexer.LookupFile(filepath.Join(other, "new"), 3*1024)
+	FatalErr(err, "")
+	ExpectEqual(t, "", digest, "digest")
+	ExpectSliceEqual(t, nil, files, "lookup")
+	_ = ioutil.WriteFile(filepath.Join(other, "copy"), content('h', 'b'), 0666)
+	_, files, err = indexer.LookupFile(filepath.Join(other, "copy"), 3*1024)
+	FatalErr(err, "")
+	ExpectSliceEqual(t, []string{"same2"}, files, "lookup")
+}
+
+func TestErrorPolicy(t *testing.T) {
+	dir := setUp()
+	defer os.RemoveAll(dir)
+	// A dangling symlink can't be hashed.
+	FatalErr(os.Symlink(filepath.Join(dir, "missing"), filepath.Join(dir, "dir2/broken")), "")
+
+	indexer := fileindexer.OpenOrCreate(dir, "")
+	defer indexer.Close()
+	err := indexer.Update()
+	if !errors.Is(err, fileindexer.ErrNotFound) {
+		t.Errorf("Update should abort with ErrNotFound, got %v", err)
+	}
+	ExpectEqual(t, int32(0), indexer.GetDbMeta().Sequence, "sequence after abort")
+
+	indexer.SetErrorPolicy(fileindexer.ON_ERROR_SKIP)
+	FatalErr(indexer.Update(), "")
+	skipped := indexer.SkippedPaths()
+	ExpectEqual(t, 1, len(skipped), "skipped paths")
+	if len(skipped) == 1 {
+		ExpectEqual(t, filepath.Join(dir, "dir2/broken"), skipped[0].Path, "skipped path")
+	}
+	if GetMeta(indexer, "dir2/broken") != nil {
+		t.Errorf("dir2/broken should not be indexed")
+	}
+	fileTests := []FileTest{
+		{"dir1/abc", protos.FileMeta{Size: 3, Hash: ABC_MD5SUM}},
+		{"dir2/xyz", protos.FileMeta{Size: 3, Hash: XYZ_MD5SUM}},
+	}
+	VerifyFileTests(indexer, fileTests, t)
+
+	if _, err := fileindexer.Open(filepath.Join(dir, "noIndex")); !errors.Is(err, fileindexer.ErrNotFound) {
+		t.Errorf("Open should fail with ErrNotFound, got %v", err)
+	}
+}
+
+func ListErrors(t *testing.T, indexer *fileindexer.Indexer) []*protos.ErrorRecord {
+	records := []*protos.ErrorRecord{}
+	FatalErr(indexer.IterErrors(func(record *protos.ErrorRecord) bool {
+		records = append(records, record)
+		return true
+	}), "")
+	return records
+}
+
+func TestErrorJournal(t *testing.T) {
+	dir := setUp()
+	defer os.RemoveAll(dir)
+	broken := filepath.Join(dir, "dir2/broken")
+	FatalErr(os.Symlink(filepath.Join(dir, "missing"), broken), "")
+
+	indexer := fileindexer.OpenOrCreate(dir, "")
+	defer indexer.Close()
+	indexer.SetErrorPolicy(fileindexer.ON_ERROR_SKIP)
+	start := time.Now()
+	FatalErr(indexer.Update(), "")
+	records := ListErrors(t, indexer)
+	ExpectEqual(t, 1, len(records), "failed paths")
+	if len(records) == 1 {
+		ExpectEqual(t, "dir2/broken", records[0].Path, "failed path")
+		ExpectEqual(t, "hash", records[0].Op, "failed op")
+		ExpectEqual(t, fileindexer.ErrNotFound.Error(), records[0].Kind, "error kind")
+		ExpectEqual(t, int32(1), records[0].Sequence, "failed sequence")
+		ExpectEqual(t, true, records[0].TimeNs >= start.UnixNano() && records[0].TimeNs <= time.Now().UnixNano(), "failed time")
+	}
+
+	// Only the failed path is retried, ancestors get its totals.
+	FatalErr(os.Remove(broken), "")
+	FatalErr(ioutil.WriteFile(broken, []byte("uvwx"), 0666), "")
+	FatalErr(indexer.RetryFailed(), "")
+	ExpectEqual(t, 0, len(ListErrors(t, indexer)), "failed paths after retry")
+	VerifyFileTests(indexer, []FileTest{
+		{"dir2/broken", protos.FileMeta{Size: 4, Hash: "md5:90bbb862a9989ad4e667f30f23ec55b8"}},
+	}, t)
+	dirTests := []DirTest{
+		{"dir2", protos.DirInfo{TotalFileSize: 7, TotalFileCount: 2}},
+		{"", protos.DirInfo{TotalFileSize: 15, TotalFileCount: 4}},
+	}
+	VerifyDirTests(indexer, dirTests, t)
+	FatalErr(indexer.Update(), "")
+	VerifyDirTests(indexer, dirTests, t)
+
+	// A path indexed by a later Update is removed from the journal.
+	FatalErr(os.Remove(broken), "")
+	FatalErr(os.Symlink(filepath.Join(dir, "missing"), broken), "")
+	FatalErr(indexer.Update(), "")
+	ExpectEqual(t, 1, len(ListErrors(t, indexer)), "failed paths")
+	FatalErr(os.Remove(broken), "")
+	FatalErr(indexer.Update(), "")
+	ExpectEqual(t, 0, len(ListErrors(t, indexer)), "failed paths after update")
+}
+
+func TestRules(t *testing.T) {
+	rules, err := fileindexer.ParseRules([]string{
+		"# comment",
+		"",
+		".DS_Store",
+		`\#recycle/`,
+		"/tmp",
+		"photos/**/*.part",
+		"downloads/**",
+		"*.log",
+		"!keep.log",
+	})
+	FatalErr(err, "")
+	tests := []struct {
+		path     string
+		isDir    bool
+		excluded bool
+	}{
+		{".DS_Store", false, true},
+		{"a/b/.DS_Store", false, true},
+		{"#recycle", true, true},
+		{"a/#recycle", false, false},
+		{"tmp", true, true},
+		{"a/tmp", true, false},
+		{"photos/x.part", false, true},
+		{"photos/2020/01/x.part", false, true},
+		{"photos/x.jpg", false, false},
+		{"downloads", true, false},
+		{"downloads/a/b", false, true},
+		{"a/b.log", false, true},
+		{"a/keep.log", false, false},
+		{"", true, false},
+	}
+	for _, test := range tests {
+		ExpectEqual(t, test.excluded, rules.Excluded(test.path, test.isDir), test.path)
+	}
+	ExpectEqual(t, 7, len(rules.Lines()), "rule lines")
+	if _, err := fileindexer.ParseRules([]string{"a/[b"}); err == nil {
+		t.Errorf("ParseRules should fail on a bad pattern")
+	}
+}
+
+func TestUpdateWithRules(t *testing.T) {
+	dir := setUp()
+	defer os.RemoveAll(dir)
+	_ = ioutil.WriteFile(filepath.Join(dir, "dir2/.DS_Store"), []byte("ds"), 0666)
+	_ = os.Mkdir(filepath.Join(dir, "@eaDir"), 0777)
+	_ = ioutil.WriteFile(filepath.Join(dir, "@eaDir/thumb"), []byte("thumb"), 0666)
+
+	indexer := fileindexer.OpenOrCreate(dir, "")
+	defer indexer.Close()
+	rules, err := fileindexer.ParseRules(append(fileindexer.DefaultRules().Lines(), ".DS_Store", "dir11/"))
+	FatalErr(err, "")
+	if indexer.SetRules(rules) {
+		t.Errorf("rules of a new index should not be reported as changed")
+	}
+	FatalErr(indexer.Update(), "")
+	for _, path := range []string{"dir2/.DS_Store", "@eaDir", "dir1/dir11", "dir1/dir11/xdong"} {
+		if GetMeta(indexer, path) != nil {
+			t.Errorf("%s should be excluded", path)
+		}
+	}
+	dirTests := []DirTest{
+		{"", protos.DirInfo{TotalFileSize: 6, TotalFileCount: 2}},
+		{"dir1", protos.DirInfo{TotalFileSize: 3, TotalFileCount: 1}},
+	}
+	VerifyDirTests(indexer, dirTests, t)
+	info := fileindexer.RepositoryInfo{}
+	FatalErr(indexer.QuickScan(&info), "")
+	ExpectEqual(t, int32(2), info.FileCount, "quick scan file count")
+
+	// Rules are kept in the index and a change is detected.
+	indexer.Close()
+	indexer = fileindexer.OpenOrCreate(dir, "")
+	defer indexer.Close()
+	ExpectSliceEqual(t, rules.Lines(), indexer.GetRules().Lines(), "rules")
+	if !indexer.SetRules(fileindexer.DefaultRules()) {
+		t.Errorf("rule change should be detected")
+	}
+	FatalErr(indexer.Update(), "")
+	VerifyFileTests(indexer, []FileTest{
+		{"dir2/.DS_Store", protos.FileMeta{Size: 2, Hash: "md5:522748524ad010358705b6852b81be4c"}},
+		{"dir1/dir11/xdong", protos.FileMeta{Size: 5, Hash: XDONG_MD5SUM}},
+	}, t)
+
+	scanned := []string{}
+	FatalErr(fileindexer.ScanDirWithRules(dir, rules, func(path string, info os.FileInfo) int {
+		if !info.IsDir() {
+			scanned = append(scanned, path[len(dir)+1:])
+		}
+		return fileindexer.NORMAL
+	}), "")
+	ExpectSliceEqual(t, []string{"dir1/abc", "dir2/xyz"}, scanned, "scanned files")
+}
+
+// Polls cond until it holds, failing the test after a few seconds.
+func WaitFor(t *testing.T, name string, cond func() bool) {
+	for i := 0; i < 500; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", name)
+}
+
+func HasTotals(indexer *fileindexer.Indexer, relativePath string, fileSize int64, fileCount int32) bool {
+	meta := GetMeta(indexer, relativePath)
+	return meta != nil && meta.DirInfo.TotalFileSize == fileSize && meta.DirInfo.TotalFileCount == fileCount
+}
+
+func TestWatch(t *testing.T) {
+	dir := setUp()
+	defer os.RemoveAll(dir)
+
+	indexer := fileindexer.OpenOrCreate(dir, "")
+	defer indexer.Close()
+	indexer.SetWatchDelay(20 * time.Millisecond)
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- indexer.Watch(stop) }()
+	WaitFor(t, "reconcile", func() bool { return HasTotals(indexer, "", 11, 3) })
+
+	FatalErr(ioutil.WriteFile(filepath.Join(dir, "dir2/new"), []byte("abc"), 0666), "")
+	WaitFor(t, "create", func() bool { return HasTotals(indexer, "", 14, 4) })
+	VerifyFileTests(indexer, []FileTest{{"dir2/new", protos.FileMeta{Size: 3, Hash: ABC_MD5SUM}}}, t)
+	VerifyHashTests(indexer, []HashTest{{ABC_MD5SUM, []string{"dir1/abc", "dir2/new"}}}, t)
+	VerifyDirTests(indexer, []DirTest{{"dir2", protos.DirInfo{TotalFileSize: 6, TotalFileCount: 2}}}, t)
+
+	FatalErr(ioutil.WriteFile(filepath.Join(dir, "dir2/new"), []byte("xdong!"), 0666), "")
+	WaitFor(t, "write", func() bool { return HasTotals(indexer, "", 17, 4) })
+	VerifyHashTests(indexer, []HashTest{{ABC_MD5SUM, []string{"dir1/abc"}}}, t)
+
+	FatalErr(os.Rename(filepath.Join(dir, "dir1/dir11"), filepath.Join(dir, "dir1/moved")), "")
+	WaitFor(t, "rename", func() bool {
+		return GetMeta(indexer, "dir1/dir11") == nil && GetMeta(indexer, "dir1/moved/xdong") != nil
+	})
+	VerifyDirTests(indexer, []DirTest{
+		{"dir1", protos.DirInfo{TotalFileSize: 8, TotalFileCount: 2}},
+		{"dir1/moved", protos.DirInfo{TotalFileSize: 5, TotalFileCount: 1}},
+	}, t)
+	VerifyHashTests(indexer, []HashTest{{XDONG_MD5SUM, []string{"dir1/moved/xdong"}}}, t)
+
+	FatalErr(os.RemoveAll(filepath.Join(dir, "dir2")), "")
+	WaitFor(t, "remove", func() bool { return HasTotals(indexer, "", 8, 2) })
+	if GetMeta(indexer, "dir2/xyz") != nil {
+		t.Errorf("dir2/xyz should be removed")
+	}
+	VerifyHashTests(indexer, []HashTest{{XYZ_MD5SUM, nil}}, t)
+
+	close(stop)
+	FatalErr(<-done, "")
+}
+
+func TestCrashDuringUpdate(t *testing.T) {
+	dir := setUp()
+	defer os.RemoveAll(dir)
+	change := func() {
+		_ = os.Remove(filepath.Join(dir, "dir2/xyz"))
+		_ = ioutil.WriteFile(filepath.Join(dir, "dir1/abc"), []byte("abcd"), 0666)
+		for i := 0; i < 6; i++ {
+			_ = ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("dir2/f%d", i)), []byte(fmt.Sprint(i%2)), 0666)
+		}
+	}
+	restore := func() {
+		_ = os.RemoveAll(filepath.Join(dir, "dir2"))
+		_ = os.Mkdir(filepath.Join(dir, "dir2"), 0777)
+		_ = ioutil.WriteFile(filepath.Join(dir, "dir2/xyz"), []byte("xyz"), 0666)
+		_ = ioutil.WriteFile(filepath.Join(dir, "dir1/abc"), []byte("abc"), 0666)
+	}
+
+	change()
+	cleanDir, err := ioutil.TempDir("", "fileindexer")
+	FatalErr(err, "")
+	defer os.RemoveAll(cleanDir)
+	clean := fileindexer.OpenOrCreate(dir, cleanDir)
+	clean.SetHashMode(fileindexer.HASH_SIZE_FIRST)
+	FatalErr(clean.Update(), "")
+	expected := DumpIndex(clean)
+	clean.Close()
+
+	for k := 1; ; k++ {
+		restore()
+		indexDir, err := ioutil.TempDir("", "fileindexer")
+		FatalErr(err, "")
+		defer os.RemoveAll(indexDir)
+		indexer := fileindexer.OpenOrCreate(dir, indexDir)
+		indexer.SetHashMode(fileindexer.HASH_SIZE_FIRST)
+		FatalErr(indexer.Update(), "")
+		sequence := indexer.GetDbMeta().Sequence
+		change()
+
+		// dies at the k-th write of the update.
+		points := 0
+		indexer.SetWorkers(1)
+		fileindexer.SetBatchSize(indexer, 1)
+		fileindexer.SetCrashHook(indexer, func(point string) {
+			points++
+			if points == k {
+				panic(point)
+			}
+		})
+		crashed := func() (crashed bool) {
+			defer func() {
+				crashed = recover() != nil
+			}()
+			FatalErr(indexer.Update(), "")
+			return false
+		}()
+		indexer.Close()
+		if !crashed {
+			break
+		}
+
+		indexer, err = fileindexer.Open(indexDir)
+		if err != nil {
+			t.Fatalf("crash %d: %v", k, err)
+		}
+		// crashes after the commit point leave nothing to repair.
+		meta := indexer.GetDbMeta()
+		if meta.Sequence == sequence && (meta.UpdatingSequence == 0 || meta.RepairedSequence != meta.UpdatingSequence) {
+			t.Errorf("crash %d: interrupted update not repaired: %v", k, meta)
+		}
+		if err := indexer.Check(); err != nil {
+			t.Errorf("crash %d: %v", k, err)
+		}
+		indexer.SetHashMode(fileindexer.HASH_SIZE_FIRST)
+		FatalErr(indexer.Update(), "")
+		if actual := DumpIndex(indexer); !reflect.DeepEqual(expected, actual) {
+			t.Errorf("crash %d: index differs from clean index:\n%v\n%v", k, expected, actual)
+		}
+		indexer.Close()
+	}
+}
+
+func TestResumeUpdate(t *testing.T) {
+	dir := setUp()
+	defer os.RemoveAll(dir)
+	// walked after dir1 and dir2.
+	_ = ioutil.WriteFile(filepath.Join(dir, "r1"), []byte("r1"), 0666)
+
+	// counts flushes of an update, dying at the k-th if k > 0.
+	update := func(indexer *fileindexer.Indexer, k int) (flushes int, crashed bool) {
+		indexer.SetWorkers(1)
+		fileindexer.SetBatchSize(indexer, 1)
+		fileindexer.SetCrashHook(indexer, func(point string) {
+			if point != "flush" {
+				return
+			}
+			flushes++
+			if flushes == k {
+				panic(point)
+			}
+		})
+		defer func() {
+			crashed = recover() != nil
+		}()
+		FatalErr(indexer.Update(), "")
+		return flushes, false
+	}
+
+	cleanDir, err := ioutil.TempDir("", "fileindexer")
+	FatalErr(err, "")
+	defer os.RemoveAll(cleanDir)
+	clean := fileindexer.OpenOrCreate(dir, cleanDir)
+	full, _ := update(clean, 0)
+	clean.Close()
+
+	// the last two flushes write the root dir and the commit, after which
+	// changes are left to the next update.
+	for k := 1; k < full-1; k++ {
+		_ = ioutil.WriteFile(filepath.Join(dir, "r1"), []byte("r1"), 0666)
+		_ = os.Remove(filepath.Join(dir, "r2"))
+		indexDir, err := ioutil.TempDir("", "fileindexer")
+		FatalErr(err, "")
+		defer os.RemoveAll(indexDir)
+		indexer := fileindexer.OpenOrCreate(dir, indexDir)
+		if _, crashed := update(indexer, k); !crashed {
+			t.Fatalf("update %d did not crash", k)
+		}
+		indexer.Close()
+
+		// r1 may be indexed by the interrupted update.
+		_ = os.Remove(filepath.Join(dir, "r1"))
+		_ = ioutil.WriteFile(filepath.Join(dir, "r2"), []byte("r2"), 0666)
+		indexer, err = fileindexer.Open(indexDir)
+		FatalErr(err, "")
+		resumed, _ := update(indexer, 0)
+		if k > 4 && resumed >= full {
+			t.Errorf("crash %d: completed dir1 walked again, %d flushes of %d", k, resumed, full)
+		}
+		ExpectEqual(t, int32(1), indexer.GetDbMeta().Sequence, "sequence")
+		ExpectEqual(t, int32(0), indexer.GetDbMeta().UpdatingSequence, "updating sequence")
+		if GetMeta(indexer, "r1") != nil || GetMeta(indexer, "r2") == nil {
+			t.Errorf("crash %d: r1 and r2 not updated", k)
+		}
+		VerifyDirTests(indexer, []DirTest{
+			{"", protos.DirInfo{TotalFileCount: 4, TotalFileSize: 13}},
+			{"dir1", protos.DirInfo{TotalFileCount: 2, TotalFileSize: 8}},
+		}, t)
+		indexer.Close()
+	}
+}
+
 type DedupTest struct {
 	name     string
 	dupFiles []string
@@ -389,4 +1998,102 @@ func TestDedupFiles(t *testing.T) {
 		{"DirOrder", dupFiles, []string{"dir2/"}, []string{"dir1/ab", "dir1/abc"}},
 	}
 	VerifyDedupTest(tests, t)
+
+	photos := []string{"Photos/2014/a.jpg", "Photos/2014-old/a.jpg", "Backup/Photos/2014/a.jpg"}
+	tests = []DedupTest{
+		{"WholeComponents", photos, []string{"Photos/2014"},
+			[]string{"Backup/Photos/2014/a.jpg", "Photos/2014-old/a.jpg"}},
+		{"TrailingSlash", photos, []string{"Photos/2014-old/"},
+			[]string{"Backup/Photos/2014/a.jpg", "Photos/2014/a.jpg"}},
+		{"PartialName", photos, []string{"Photos/201"},
+			[]string{"Photos/2014-old/a.jpg", "Photos/2014/a.jpg"}},
+		{"Glob", photos, []string{"Photos/*-old"},
+			[]string{"Backup/Photos/2014/a.jpg", "Photos/2014/a.jpg"}},
+		{"GlobAnyDepth", photos, []string{"**/Photos/2014"},
+			[]string{"Photos/2014-old/a.jpg", "Photos/2014/a.jpg"}},
+		{"File", photos, []string{"Backup/Photos/2014/a.jpg"},
+			[]string{"Photos/2014-old/a.jpg", "Photos/2014/a.jpg"}},
+		{"BlankFirst", photos, []string{"", "  ", "Photos/2014-old"},
+			[]string{"Backup/Photos/2014/a.jpg", "Photos/2014/a.jpg"}},
+		{"FirstMatchingEntry", photos, []string{"Other", "Backup", "Photos"},
+			[]string{"Photos/2014-old/a.jpg", "Photos/2014/a.jpg"}},
+	}
+	VerifyDedupTest(tests, t)
+}
+
+func TestDirOrder(t *testing.T) {
+	dirOrder, err := fileindexer.ParseDirOrder([]string{"# keep sorted photos", "", "dir1/dir11", " dir2/ ", "dir*/none"})
+	FatalErr(err, "")
+	ExpectSliceEqual(t, []string{"dir1/dir11", "dir2/", "dir*/none"}, dirOrder, "parsed")
+	_, err = fileindexer.ParseDirOrder([]string{"dir["})
+	ExpectEqual(t, true, err != nil, "invalid glob")
+
+	dir := setUp()
+	defer os.RemoveAll(dir)
+	indexer := fileindexer.OpenOrCreate(dir, "")
+	defer indexer.Close()
+	FatalErr(indexer.Update(), "")
+	unmatched, err := indexer.UnmatchedDirs(append(dirOrder, "dir1/dir1", "*/xyz"))
+	FatalErr(err, "")
+	ExpectSliceEqual(t, []string{"dir*/none", "dir1/dir1"}, unmatched, "unmatched")
+}
+
+type KeepTest struct {
+	name     string
+	rules    []string
+	dirOrder []string
+	paths    []string
+	keep     string
+	reasons  int
+}
+
+func TestKeepPolicy(t *testing.T) {
+	// modification times by path.
+	modTimes := map[string]int64{
+		"Photos/IMG_0001.JPG":             3,
+		"Photos/IMG_0001 (1).JPG":         2,
+		"Backup/2014/IMG_0001.JPG":        1,
+		"Copy of Photos/IMG_0001.JPG":     1,
+		"Photos/sorted/trip/IMG_0001.JPG": 3,
+	}
+	tests := []KeepTest{
+		{"NoRules", nil, nil, []string{"Photos/IMG_0001.JPG", "Backup/2014/IMG_0001.JPG"},
+			"Backup/2014/IMG_0001.JPG", 1},
+		{"Oldest", []string{"oldest"}, nil, []string{"Photos/IMG_0001.JPG", "Photos/IMG_0001 (1).JPG"},
+			"Photos/IMG_0001 (1).JPG", 1},
+		{"Newest", []string{"newest"}, nil, []string{"Photos/IMG_0001 (1).JPG", "Backup/2014/IMG_0001.JPG"},
+			"Photos/IMG_0001 (1).JPG", 1},
+		{"ShortestPath", []string{"shortest-path"}, nil,
+			[]string{"Photos/sorted/trip/IMG_0001.JPG", "Photos/IMG_0001 (1).JPG"}, "Photos/IMG_0001 (1).JPG", 1},
+		{"LongestPath", []string{"longest-path"}, nil,
+			[]string{"Photos/sorted/trip/IMG_0001.JPG", "Photos/IMG_0001 (1).JPG"}, "Photos/sorted/trip/IMG_0001.JPG", 1},
+		{"Prefer", []string{"prefer ^Photos/sorted/"}, nil,
+			[]string{"Photos/IMG_0001.JPG", "Photos/sorted/trip/IMG_0001.JPG"}, "Photos/sorted/trip/IMG_0001.JPG", 1},
+		{"AvoidThenOldest", []string{"# copies of folders", "avoid (?i)(^|/)(copy|backup)[^/]*/", "", "oldest"}, nil,
+			[]string{"Backup/2014/IMG_0001.JPG", "Copy of Photos/IMG_0001.JPG", "Photos/IMG_0001.JPG",
+				"Photos/IMG_0001 (1).JPG"}, "Photos/IMG_0001 (1).JPG", 2},
+		{"CameraName", []string{"camera-name", "oldest"}, nil,
+			[]string{"Photos/IMG_0001 (1).JPG", "Photos/IMG_0001.JPG"}, "Photos/IMG_0001.JPG", 1},
+		{"DirOrderFirst", []string{"oldest"}, []string{"Photos/"},
+			[]string{"Backup/2014/IMG_0001.JPG", "Photos/IMG_0001.JPG", "Photos/IMG_0001 (1).JPG"},
+			"Photos/IMG_0001 (1).JPG", 2},
+		{"Tie", []string{"camera-name"}, nil,
+			[]string{"Photos/IMG_0001.JPG", "Backup/2014/IMG_0001.JPG"}, "Backup/2014/IMG_0001.JPG", 1},
+	}
+	for _, test := range tests {
+		policy, err := fileindexer.ParseKeepPolicy(test.rules)
+		FatalErr(err, test.name)
+		metas := []*protos.FileMeta{}
+		for _, path := range test.paths {
+			metas = append(metas, &protos.FileMeta{ModTimeNs: modTimes[path]})
+		}
+		keep, reasons := policy.WithDirOrder(test.dirOrder).Choose(test.paths, metas)
+		ExpectEqual(t, test.keep, keep, test.name)
+		ExpectEqual(t, test.reasons, len(reasons), test.name+" reasons: "+strings.Join(reasons, ", "))
+	}
+
+	for _, rules := range [][]string{{"biggest"}, {"prefer"}, {"avoid ("}, {"oldest now"}} {
+		_, err := fileindexer.ParseKeepPolicy(rules)
+		ExpectEqual(t, true, err != nil, "invalid "+rules[0])
+	}
 }
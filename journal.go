@@ -0,0 +1,198 @@
+package fileindexer
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/idlecat/fileindexer/protos"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Runs are fixed width in keys, so they sort by time.
+func keyForJournal(run int64, relativePath string) string {
+	return fmt.Sprintf("%c%016x%s", PREFIX_JOURNAL, run, relativePath)
+}
+
+// Returns the id of a new dedup run, under which DedupPath journals.
+func NewDedupRun() int64 {
+	return time.Now().UnixNano()
+}
+
+// Dedups relativePath, a copy of keepPath, by strategy and journals it under
+// run, so it can be restored. The entry is written pending before the
+// action, so a crash leaves a record of it. A path moved goes to a dir of
+// run under tmpDir, see RemoveFileSafely. The index is not updated, see
+// UpdatePaths.
+func (v *Indexer) DedupPath(run int64, relativePath string, keepPath string, strategy int, tmpDir string) error {
+	meta, err := v.getFileMeta(relativePath)
+	if err != nil {
+		return err
+	}
+	entry := protos.JournalEntry{
+		Run:      run,
+		Path:     relativePath,
+		KeepPath: keepPath,
+		Strategy: int32(strategy),
+		Pending:  true,
+	}
+	if meta != nil && meta.DirInfo != nil {
+		entry.Hash = meta.DirInfo.ContentHash
+	} else if meta != nil {
+		entry.Hash = meta.Hash
+	}
+	// runs don't move over each other's paths.
+	runDir := filepath.Join(tmpDir, fmt.Sprint(run))
+	if strategy == DEDUP_MOVE {
+		dest, err := filepath.Abs(filepath.Join(runDir, relativePath))
+		if err != nil {
+			return newPathError("abs", tmpDir, err)
+		}
+		entry.Destination = dest
+	} else {
+		info, err := os.Stat(filepath.Join(v.baseDir, relativePath))
+		if err != nil {
+			return newPathError("stat", filepath.Join(v.baseDir, relativePath), err)
+		}
+		entry.Mode = uint32(info.Mode().Perm())
+		entry.ModTimeNs = info.ModTime().UnixNano()
+	}
+	key := keyForJournal(run, relativePath)
+	entry.TimeNs = time.Now().UnixNano()
+	if err := v.putKeyValue(key, &entry); err != nil {
+		return err
+	}
+	if err := v.flushBatch(); err != nil {
+		return err
+	}
+	v.crash("journal")
+	if strategy == DEDUP_MOVE {
+		err = RemoveFileSafely(relativePath, v.baseDir, runDir)
+	} else {
+		err = ReplaceWithLink(relativePath, keepPath, v.baseDir, strategy)
+	}
+	if err != nil {
+		// both leave the path as it was when they fail.
+		if deleteErr := v.deleteKey(key); deleteErr != nil {
+			log.Printf("Failed to drop journal entry of %s: %v", relativePath, deleteErr)
+		}
+		return err
+	}
+	entry.Pending = false
+	return v.putKeyValue(key, &entry)
+}
+
+type IterJournalFunc func(entry *protos.JournalEntry) bool
+
+// Iterates the journaled dedup actions of run, or of all runs for run 0,
+// oldest run first and paths in order.
+func (v *Indexer) IterJournal(run int64, iterFunc IterJournalFunc) error {
+	prefix := string(PREFIX_JOURNAL)
+	if run != 0 {
+		prefix = keyForJournal(run, "")
+	}
+	return v.iterPrefix(prefix, func(key string, value []byte) (bool, error) {
+		var entry protos.JournalEntry
+		if err := proto.Unmarshal(value, &entry); err != nil {
+			return false, newCorruptRecordError(key, err)
+		}
+		return iterFunc(&entry), nil
+	})
+}
+
+// Returns the last dedup run with actions left to restore, 0 if none.
+func (v *Indexer) LastDedupRun() (int64, error) {
+	var last int64
+	err := v.IterJournal(0, func(entry *protos.JournalEntry) bool {
+		last = entry.Run
+		return true
+	})
+	return last, err
+}
+
+// Reverses a journaled dedup action and drops it from the journal. A path
+// moved is moved back, and a link is replaced with a copy of the file kept.
+// A pending action which never happened is only dropped.
+// Returns an error of kind ErrMismatch, and leaves the path alone, if
+// something else is at the path now. The index is not updated, see
+// UpdatePaths.
+func (v *Indexer) Restore(entry *protos.JournalEntry) error {
+	path := filepath.Join(v.baseDir, entry.Path)
+	if entry.Pending && entry.Strategy == DEDUP_MOVE && !exists(entry.Destination) && exists(path) {
+		// never moved.
+		return v.deleteKey(keyForJournal(entry.Run, entry.Path))
+	}
+	if entry.Strategy == DEDUP_MOVE {
+		if _, err := os.Lstat(path); err == nil {
+			return &PathError{Op: "restore", Path: path, Kind: ErrMismatch, Err: errors.New("path exists")}
+		} else if !os.IsNotExist(err) {
+			return newPathError("lstat", path, err)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			return newPathError("mkdir", filepath.Dir(path), err)
+		}
+		if err := os.Rename(entry.Destination, path); err != nil {
+			return newPathError("rename", entry.Destination, err)
+		}
+	} else {
+		keep := filepath.Join(v.baseDir, entry.KeepPath)
+		if err := compareFiles(path, keep); err != nil {
+			return err
+		}
+		if err := copyFile(keep, path, entry); err != nil {
+			return err
+		}
+	}
+	return v.deleteKey(keyForJournal(entry.Run, entry.Path))
+}
+
+// Replaces the file at path with a copy of src, with the mode and
+// modification time journaled in entry, or those of src for entries which
+// have none. The copy is made next to path and renamed over it.
+func copyFile(src string, path string, entry *protos.JournalEntry) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return newPathError("stat", src, err)
+	}
+	mode, modTime := info.Mode().Perm(), info.ModTime()
+	if entry.Mode != 0 || entry.ModTimeNs != 0 {
+		mode, modTime = os.FileMode(entry.Mode), time.Unix(0, entry.ModTimeNs)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return newPathError("open", src, err)
+	}
+	defer in.Close()
+	tmp := filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.restore-%d", filepath.Base(path), os.Getpid()))
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return newPathError("create", tmp, err)
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// the umask applies to the mode given to create.
+		err = os.Chmod(tmp, mode)
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, modTime, modTime)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return newPathError("copy", path, err)
+	}
+	return nil
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
@@ -0,0 +1,183 @@
+package fileindexer
+
+import (
+	"fmt"
+	"github.com/idlecat/fileindexer/protos"
+	"math"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// KeepPolicy chooses which copy of a file dedup keeps. Each rule in turn
+// narrows the copies down to those it ranks best, until one is left. Of the
+// copies left after the last rule, the first in name order is kept.
+type KeepPolicy struct {
+	lines []string
+	rules []keepRule
+}
+
+type keepRule struct {
+	name string
+	// Returns the rank of a copy, those of the lowest rank are left.
+	rank func(relativePath string, meta *protos.FileMeta) int64
+}
+
+// Base names cameras and phones give photos and videos, e.g. IMG_1234.JPG,
+// without the " (1)" or " - Copy" added to copies.
+var cameraName = regexp.MustCompile(`(?i)^(IMG|DSC[FN]?|PXL|MVI|VID|GOPR|GX|DJI|SAM|P)_?[0-9][0-9_]*\.[a-z0-9]+$`)
+
+// Parses keep rules, one per line. Blank lines and lines starting with "#"
+// are ignored. Rules are:
+//
+//	oldest, newest         copies of the oldest, or newest, modification time
+//	shortest-path          copies of the fewest dirs deep, then shortest path
+//	longest-path           the other way round
+//	prefer REGEXP          copies whose path matches
+//	avoid REGEXP           copies whose path does not match
+//	camera-name            copies named as a camera names files
+func ParseKeepPolicy(lines []string) (*KeepPolicy, error) {
+	p := &KeepPolicy{}
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		name, arg := line, ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			name, arg = line[:i], strings.TrimSpace(line[i:])
+		}
+		if arg != "" && name != "prefer" && name != "avoid" {
+			return nil, fmt.Errorf("keep rule %q takes no argument", line)
+		}
+		rule := keepRule{name: line}
+		switch name {
+		case "oldest":
+			rule.rank = func(relativePath string, meta *protos.FileMeta) int64 {
+				if meta == nil {
+					return math.MaxInt64
+				}
+				return meta.ModTimeNs
+			}
+		case "newest":
+			rule.rank = func(relativePath string, meta *protos.FileMeta) int64 {
+				if meta == nil {
+					return math.MaxInt64
+				}
+				return -meta.ModTimeNs
+			}
+		case "shortest-path":
+			rule.rank = func(relativePath string, meta *protos.FileMeta) int64 {
+				return int64(strings.Count(relativePath, "/"))<<32 + int64(len(relativePath))
+			}
+		case "longest-path":
+			rule.rank = func(relativePath string, meta *protos.FileMeta) int64 {
+				return -(int64(strings.Count(relativePath, "/"))<<32 + int64(len(relativePath)))
+			}
+		case "prefer", "avoid":
+			if arg == "" {
+				return nil, fmt.Errorf("keep rule %q needs a regexp", line)
+			}
+			re, err := regexp.Compile(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid keep rule %q: %v", line, err)
+			}
+			// matches rank 0 for prefer, 1 for avoid.
+			avoid := name == "avoid"
+			rule.rank = func(relativePath string, meta *protos.FileMeta) int64 {
+				if re.MatchString(relativePath) != avoid {
+					return 0
+				}
+				return 1
+			}
+		case "camera-name":
+			rule.rank = func(relativePath string, meta *protos.FileMeta) int64 {
+				if cameraName.MatchString(path.Base(relativePath)) {
+					return 0
+				}
+				return 1
+			}
+		default:
+			return nil, fmt.Errorf("unknown keep rule %q", line)
+		}
+		p.lines = append(p.lines, line)
+		p.rules = append(p.rules, rule)
+	}
+	return p, nil
+}
+
+// Returns the rules as lines to be parsed again.
+func (p *KeepPolicy) Lines() []string {
+	if p == nil {
+		return nil
+	}
+	return append([]string(nil), p.lines...)
+}
+
+// Returns a policy which keeps the copies under the first of dirs with any,
+// as DedupFiles does, before applying the rules of p.
+func (p *KeepPolicy) WithDirOrder(dirs []string) *KeepPolicy {
+	if len(dirs) == 0 {
+		return p
+	}
+	rule := keepRule{
+		name: "dirOrder",
+		rank: func(relativePath string, meta *protos.FileMeta) int64 {
+			for i, dir := range dirs {
+				if inDir(relativePath, dir) {
+					return int64(i)
+				}
+			}
+			return int64(len(dirs))
+		},
+	}
+	withDirs := &KeepPolicy{rules: []keepRule{rule}}
+	if p != nil {
+		withDirs.lines = p.Lines()
+		withDirs.rules = append(withDirs.rules, p.rules...)
+	}
+	return withDirs
+}
+
+// Returns the copy of paths to keep, and for each rule which narrowed the
+// copies down, how. metas are the entries of paths, nil if not indexed.
+func (p *KeepPolicy) Choose(paths []string, metas []*protos.FileMeta) (string, []string) {
+	left := make([]int, len(paths))
+	for i := range paths {
+		left[i] = i
+	}
+	reasons := []string{}
+	var rules []keepRule
+	if p != nil {
+		rules = p.rules
+	}
+	for _, rule := range rules {
+		if len(left) == 1 {
+			break
+		}
+		best := []int{}
+		var bestRank int64
+		for _, i := range left {
+			rank := rule.rank(paths[i], metas[i])
+			if len(best) == 0 || rank < bestRank {
+				best, bestRank = []int{i}, rank
+			} else if rank == bestRank {
+				best = append(best, i)
+			}
+		}
+		if len(best) < len(left) {
+			reasons = append(reasons, fmt.Sprintf("%s: %d of %d left", rule.name, len(best), len(left)))
+		}
+		left = best
+	}
+	keep := left[0]
+	for _, i := range left {
+		if paths[i] < paths[keep] {
+			keep = i
+		}
+	}
+	if len(left) > 1 {
+		reasons = append(reasons, fmt.Sprintf("name order: 1 of %d left", len(left)))
+	}
+	return paths[keep], reasons
+}
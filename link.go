@@ -0,0 +1,110 @@
+package fileindexer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Ways of getting rid of a duplicate.
+const (
+	// Moves the duplicate out of the base dir, see RemoveFileSafely.
+	DEDUP_MOVE = iota
+	// Replaces the duplicate with a hard link of the file kept.
+	DEDUP_HARDLINK
+	// Replaces the duplicate with a copy sharing the blocks of the file kept,
+	// on file systems which support it, such as btrfs and XFS.
+	DEDUP_REFLINK
+	// Replaces the duplicate with a relative symlink to the file kept.
+	DEDUP_SYMLINK
+)
+
+// Replaces the file at relativePath under baseDir with a link of keepPath by
+// strategy, which is one of DEDUP_HARDLINK, DEDUP_REFLINK and DEDUP_SYMLINK.
+// The link is made next to the file and renamed over it, so the file is
+// never missing. Nothing is done if both are links of the same file already.
+// If keepPath is a symlink, the file it links to is linked, which must be
+// under baseDir.
+func ReplaceWithLink(relativePath string, keepPath string, baseDir string, strategy int) error {
+	path := filepath.Join(baseDir, relativePath)
+	keep := filepath.Join(baseDir, keepPath)
+	info, err := os.Stat(path)
+	if err != nil {
+		return newPathError("stat", path, err)
+	}
+	keepInfo, err := os.Stat(keep)
+	if err != nil {
+		return newPathError("stat", keep, err)
+	}
+	if os.SameFile(info, keepInfo) {
+		return nil
+	}
+	// symlinks are indexed as their targets, so the file kept may be one.
+	if keep, err = linkTarget(keep, baseDir); err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.dedup-%d", filepath.Base(path), os.Getpid()))
+	switch strategy {
+	case DEDUP_HARDLINK:
+		err = os.Link(keep, tmp)
+	case DEDUP_REFLINK:
+		err = reflink(keep, tmp, info)
+	case DEDUP_SYMLINK:
+		var target string
+		if target, err = filepath.Rel(filepath.Dir(path), keep); err == nil {
+			err = os.Symlink(target, tmp)
+		}
+	default:
+		err = fmt.Errorf("unknown dedup strategy %d", strategy)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return newPathError("link", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return newPathError("rename", tmp, err)
+	}
+	return nil
+}
+
+// Returns the file path links to, through any symlinks, as a path under
+// baseDir. Fails with an error of kind ErrMismatch if it is outside.
+func linkTarget(path string, baseDir string) (string, error) {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", newPathError("readlink", path, err)
+	}
+	root, err := filepath.EvalSymlinks(baseDir)
+	if err != nil {
+		return "", newPathError("readlink", baseDir, err)
+	}
+	relativePath, err := filepath.Rel(root, target)
+	if up := filepath.ToSlash(relativePath); err != nil || up == ".." || strings.HasPrefix(up, "../") {
+		return "", &PathError{Op: "link", Path: path, Kind: ErrMismatch,
+			Err: fmt.Errorf("links to %s, outside %s", target, baseDir)}
+	}
+	return filepath.Join(baseDir, relativePath), nil
+}
+
+// Returns paths grouped by the file they are links of, as last indexed, in
+// the order of paths. Paths which are not indexed are groups of their own.
+func (v *Indexer) GroupLinks(paths []string) ([][]string, error) {
+	groups := [][]string{}
+	groupOf := make(map[fileId]int)
+	for _, path := range paths {
+		meta, err := v.getFileMeta(path)
+		if err != nil {
+			return nil, err
+		}
+		id := linkId(path, meta)
+		if i, ok := groupOf[id]; ok {
+			groups[i] = append(groups[i], path)
+			continue
+		}
+		groupOf[id] = len(groups)
+		groups = append(groups, []string{path})
+	}
+	return groups, nil
+}
@@ -0,0 +1,202 @@
+package fileindexer
+
+import (
+	"errors"
+	"fmt"
+	"github.com/idlecat/fileindexer/protos"
+	"log"
+	"strings"
+)
+
+// Schema version of indexes written by this package. Any change of the keys
+// or of meta.proto which older versions would misread needs a new version
+// and a migration step.
+const SCHEMA_VERSION = 5
+
+type migration struct {
+	// Schema version of the index after the step.
+	version     int32
+	description string
+	migrate     func(v *Indexer) error
+}
+
+// Migration steps in order. A step may be run again if the process dies
+// before its version is written.
+var migrations = []migration{
+	{1, "tag md5 digests with the hash algorithm", (*Indexer).upgradeLegacyHashes},
+	{2, "build the size index", (*Indexer).buildSizeIndex},
+	{3, "set the default quick hash size and rules", (*Indexer).setDefaults},
+	{4, "move times to nanosecond fields", (*Indexer).migrateTimes},
+	{5, "compute dir counts, duplicate totals and content hashes", (*Indexer).buildDirStats},
+}
+
+// Returns the schema version of an index. It is inferred for indexes created
+// before versions were kept.
+func schemaVersion(meta *protos.DbMeta) int32 {
+	switch {
+	case meta.SchemaVersion != 0:
+		return meta.SchemaVersion
+	case meta.HashAlgorithm == "":
+		return 0
+	case !meta.SizeIndexed:
+		return 1
+	case meta.QuickHashKiB == 0 || len(meta.Rules) == 0:
+		return 2
+	case !meta.NsTimes:
+		return 3
+	}
+	return 4
+}
+
+func newSchemaTooNewError(indexDir string, version int32) *PathError {
+	err := fmt.Errorf("schema version %d is newer than %d of this program", version, SCHEMA_VERSION)
+	return &PathError{Op: "open", Path: indexDir, Kind: ErrSchemaTooNew, Err: err}
+}
+
+// Runs the migration steps the index needs, then repairs it if an update was
+// interrupted.
+func (v *Indexer) upgrade(indexDir string) error {
+	version := schemaVersion(v.dbMeta)
+	if version > SCHEMA_VERSION {
+		return newSchemaTooNewError(indexDir, version)
+	}
+	for _, step := range migrations {
+		if step.version <= version {
+			continue
+		}
+		log.Printf("Migrating index to schema version %d: %s", step.version, step.description)
+		if err := step.migrate(v); err != nil {
+			return err
+		}
+		v.dbMeta.SchemaVersion = step.version
+		if err := v.putKeyValue(KEY_DB_META, v.dbMeta); err != nil {
+			return err
+		}
+	}
+	if v.needsRepair() {
+		// dirs are hashed when repaired.
+		hasher, err := GetHasher(v.dbMeta.HashAlgorithm)
+		if err != nil {
+			return err
+		}
+		v.hasher = hasher
+		return v.Repair()
+	}
+	return nil
+}
+
+// Returns the migration steps opening the index would run, without changing
+// it.
+func PendingMigrations(backend string, indexDir string) ([]string, error) {
+	db, err := OpenStore(backend, indexDir, &StoreOptions{MustExist: true, ReadOnly: true})
+	if err != nil {
+		return nil, &PathError{Op: "open", Path: indexDir, Kind: ErrNotFound, Err: err}
+	}
+	defer db.Close()
+	v := Indexer{db: db}
+	meta, err := v.getDbMeta()
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		return nil, &PathError{Op: "open", Path: indexDir, Kind: ErrNotFound, Err: errors.New("no db meta found")}
+	}
+	version := schemaVersion(meta)
+	if version > SCHEMA_VERSION {
+		return nil, newSchemaTooNewError(indexDir, version)
+	}
+	pending := []string{}
+	for _, step := range migrations {
+		if step.version > version {
+			pending = append(pending, fmt.Sprintf("%d: %s", step.version, step.description))
+		}
+	}
+	return pending, nil
+}
+
+// Indexes created before hash algorithms were pluggable store untagged md5
+// sums in FileMeta.md5Sum and as hash keys. Tags them in place, no file is
+// rehashed.
+func (v *Indexer) upgradeLegacyHashes() error {
+	var putErr error
+	err := v.Iter(func(path string, meta *protos.FileMeta) bool {
+		if meta.IsDir || meta.Md5Sum == "" {
+			return true
+		}
+		meta.Hash = DEFAULT_HASH + ":" + meta.Md5Sum
+		meta.Md5Sum = ""
+		putErr = v.putKeyValue(keyForPath(path), meta)
+		return putErr == nil
+	})
+	if err == nil {
+		err = putErr
+	}
+	if err != nil {
+		return err
+	}
+	err = v.iterPrefix(string(PREFIX_HASH), func(key string, value []byte) (bool, error) {
+		if strings.IndexByte(key, ':') >= 0 {
+			return true, nil
+		}
+		newKey := keyForHash(DEFAULT_HASH + ":" + key[1:])
+		if err := v.db.Put([]byte(newKey), value); err != nil {
+			return false, newDbError("put", newKey, err)
+		}
+		return true, v.deleteKey(key)
+	})
+	if err != nil {
+		return err
+	}
+	v.dbMeta.HashAlgorithm = DEFAULT_HASH
+	return v.putKeyValue(KEY_DB_META, v.dbMeta)
+}
+
+// Indexes created before quick hashes and rules have neither set.
+func (v *Indexer) setDefaults() error {
+	if v.dbMeta.QuickHashKiB == 0 {
+		v.dbMeta.QuickHashKiB = DEFAULT_QUICK_HASH_KIB
+	}
+	if len(v.dbMeta.Rules) == 0 {
+		// what shouldSkipPath used to skip.
+		v.dbMeta.Rules = DefaultRules().Lines()
+	}
+	return v.putKeyValue(KEY_DB_META, v.dbMeta)
+}
+
+// Moves times in seconds to the nanosecond fields. Files are not rehashed,
+// see unchanged.
+func (v *Indexer) migrateTimes() error {
+	batching := v.beginBatch()
+	var putErr error
+	err := v.Iter(func(path string, meta *protos.FileMeta) bool {
+		if meta.ModTimeNs == 0 {
+			meta.ModTimeNs = int64(meta.ModTime) * 1e9
+		}
+		meta.ModTime = 0
+		if dirInfo := meta.DirInfo; dirInfo != nil {
+			if dirInfo.UpdateTimeStartNs == 0 {
+				dirInfo.UpdateTimeStartNs = int64(dirInfo.UpdateTimeStart) * 1e9
+				dirInfo.UpdateTimeEndNs = int64(dirInfo.UpdateTimeEnd) * 1e9
+			}
+			dirInfo.UpdateTimeStart = 0
+			dirInfo.UpdateTimeEnd = 0
+		}
+		if putErr = v.putKeyValue(keyForPath(path), meta); putErr == nil {
+			putErr = v.taskApplied()
+		}
+		return putErr == nil
+	})
+	if err == nil {
+		err = putErr
+	}
+	if err == nil {
+		v.dbMeta.NsTimes = true
+		err = v.putKeyValue(KEY_DB_META, v.dbMeta)
+	}
+	if batching {
+		if endErr := v.endBatch(); err == nil {
+			err = endErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,156 @@
+package fileindexer
+
+import (
+	"github.com/idlecat/fileindexer/protos"
+	"os"
+	"sync"
+)
+
+// updateTask is either a file to be indexed or the end of a directory whose
+// children have all been submitted.
+type updateTask struct {
+	path string
+	info os.FileInfo
+	// Indexed meta of a file, nil for new files. Meta to be written for a
+	// directory.
+	meta *protos.FileMeta
+	// Totals of a directory, filled while its children are applied.
+	rInfo *RepositoryInfo
+	// Totals of the parent directory.
+	parent   *RepositoryInfo
+	needHash bool
+	// The file is hashed only if it is as indexed in meta, else err is of
+	// kind ErrMismatch.
+	checkUnchanged bool
+	digest         string
+	// Quick hash of the file. When needQuickHash is set, digest is filled as
+	// well if the quick hash covers the whole file.
+	needQuickHash bool
+	quickDigest   string
+	err           error
+	done          chan struct{}
+	// Applies the task instead of indexing the file or dir.
+	apply func(task *updateTask) error
+}
+
+// updatePipeline hashes files on a bounded pool of workers while all db
+// writes happen on one goroutine in walk order, so the index ends up exactly
+// as after a serial update.
+type updatePipeline struct {
+	v       *Indexer
+	workers int
+	jobs    chan *updateTask
+	ordered chan *updateTask
+	wg      sync.WaitGroup
+	applied chan struct{}
+	// First error returned by apply. Later tasks are dropped once it is set.
+	errLock sync.Mutex
+	err     error
+}
+
+func newUpdatePipeline(v *Indexer, workers int) *updatePipeline {
+	p := &updatePipeline{v: v, workers: workers}
+	if workers <= 1 {
+		return p
+	}
+	p.jobs = make(chan *updateTask, workers*4)
+	p.ordered = make(chan *updateTask, workers*64)
+	p.applied = make(chan struct{})
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for task := range p.jobs {
+				p.hash(task)
+				close(task.done)
+			}
+		}()
+	}
+	go func() {
+		for task := range p.ordered {
+			<-task.done
+			if p.getError() == nil {
+				p.setError(p.apply(task))
+			}
+		}
+		close(p.applied)
+	}()
+	return p
+}
+
+// Queues a task. Returns the first error of applied tasks, so the caller can
+// stop submitting.
+func (p *updatePipeline) submit(task *updateTask) error {
+	if err := p.getError(); err != nil {
+		return err
+	}
+	if p.workers <= 1 {
+		p.hash(task)
+		p.setError(p.apply(task))
+		return p.getError()
+	}
+	task.done = make(chan struct{})
+	if task.needHash || task.needQuickHash {
+		p.jobs <- task
+	} else {
+		close(task.done)
+	}
+	p.ordered <- task
+	return nil
+}
+
+// Waits until all submitted tasks are applied. Returns the first error.
+func (p *updatePipeline) close() error {
+	if p.workers > 1 {
+		close(p.jobs)
+		close(p.ordered)
+		p.wg.Wait()
+		<-p.applied
+	}
+	return p.getError()
+}
+
+func (p *updatePipeline) getError() error {
+	p.errLock.Lock()
+	defer p.errLock.Unlock()
+	return p.err
+}
+
+func (p *updatePipeline) setError(err error) {
+	p.errLock.Lock()
+	defer p.errLock.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+func (p *updatePipeline) hash(task *updateTask) {
+	if task.checkUnchanged && (task.needHash || task.needQuickHash) {
+		if _, task.err = statUnchanged(task.path, task.meta, "hash"); task.err != nil {
+			return
+		}
+	}
+	if task.needQuickHash {
+		task.quickDigest, task.digest, task.err = QuickHashFile(
+			task.path, task.meta.Size, p.v.dbMeta.QuickHashKiB, p.v.hasher)
+	} else if task.needHash {
+		task.digest, task.err = HashFile(task.path, p.v.hasher)
+	}
+}
+
+func (p *updatePipeline) apply(task *updateTask) error {
+	var err error
+	if task.apply != nil {
+		err = task.apply(task)
+	} else if task.info.IsDir() {
+		err = p.v.applyDir(task)
+	} else {
+		var rInfo *RepositoryInfo
+		rInfo, err = p.v.applyFile(task)
+		task.parent.Add(rInfo)
+	}
+	if err != nil {
+		return err
+	}
+	return p.v.taskApplied()
+}
@@ -0,0 +1,115 @@
+package fileindexer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+)
+
+// Plan is what dedup would do, written for review before it is applied.
+// Groups are in hash order and paths in name order, so plans made from
+// different updates of an index can be diffed.
+type Plan struct {
+	// Sequence of the update the plan was made from.
+	Sequence int32 `json:"sequence"`
+	// How removed files are deduped: move, hardlink, reflink or symlink.
+	Strategy string       `json:"strategy"`
+	Groups   []*PlanGroup `json:"groups"`
+}
+
+// PlanGroup is a set of copies, of which one is kept.
+type PlanGroup struct {
+	Hash   string   `json:"hash"`
+	Size   int64    `json:"size"`
+	Keep   string   `json:"keep"`
+	Remove []string `json:"remove"`
+	// How the keep policy chose the copy kept.
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// Writes plan as indented JSON, sorting groups and paths first.
+func WritePlan(filePath string, plan *Plan) error {
+	sort.Slice(plan.Groups, func(i, j int) bool {
+		return plan.Groups[i].Hash < plan.Groups[j].Hash
+	})
+	for _, group := range plan.Groups {
+		sort.Strings(group.Remove)
+	}
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return newPathError("marshal", filePath, err)
+	}
+	if err := ioutil.WriteFile(filePath, append(data, '\n'), 0666); err != nil {
+		return newPathError("write", filePath, err)
+	}
+	return nil
+}
+
+// Reads a plan, which may have been edited, and checks it, see Check.
+func ReadPlan(filePath string) (*Plan, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, newPathError("read", filePath, err)
+	}
+	var plan Plan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, &PathError{Op: "unmarshal", Path: filePath, Kind: ErrCorruptRecord, Err: err}
+	}
+	if err := plan.Check(); err != nil {
+		return nil, &PathError{Op: "check", Path: filePath, Kind: ErrCorruptRecord, Err: err}
+	}
+	return &plan, nil
+}
+
+// Returns an error if a group has no copy kept, or if a path is in the plan
+// twice, such as the copy kept of a group also being removed. Applying such
+// a plan could remove every copy of a file.
+func (plan *Plan) Check() error {
+	seen := make(map[string]string)
+	for _, group := range plan.Groups {
+		if group.Keep == "" {
+			return fmt.Errorf("group %s keeps no copy", group.Hash)
+		}
+		for _, path := range append([]string{group.Keep}, group.Remove...) {
+			cleaned := filepath.ToSlash(filepath.Clean(path))
+			if hash, ok := seen[cleaned]; ok {
+				return fmt.Errorf("%s is in group %s and again in group %s", path, hash, group.Hash)
+			}
+			seen[cleaned] = group.Hash
+		}
+	}
+	return nil
+}
+
+// Checks that the file at relativePath is still as indexed, with digest, and
+// hashes it again to make sure its content still has digest. A mismatch is
+// returned as an error of kind ErrMismatch and recorded, as by
+// VerifyDuplicate.
+func (v *Indexer) VerifyHash(relativePath string, digest string) error {
+	meta, err := v.getFileMeta(relativePath)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(v.baseDir, relativePath)
+	if meta != nil && meta.Hash != digest {
+		err = &PathError{Op: "verify", Path: path, Kind: ErrMismatch, Err: fmt.Errorf("indexed with another hash")}
+	} else if _, err = v.statIndexed(relativePath); err == nil {
+		algorithm, _ := SplitDigest(digest)
+		var hasher Hasher
+		if hasher, err = GetHasher(algorithm); err != nil {
+			return err
+		}
+		var current string
+		if current, err = HashFile(path, hasher); err != nil {
+			err = newPathError("hash", path, err)
+		} else if current != digest {
+			err = &PathError{Op: "verify", Path: path, Kind: ErrMismatch, Err: fmt.Errorf("content changed")}
+		}
+	}
+	if err == nil {
+		return nil
+	}
+	return v.recordMismatch(relativePath, err)
+}
@@ -13,6 +13,9 @@ It has these top-level messages:
 	DirInfo
 	DbMeta
 	FilePaths
+	ErrorRecord
+	JournalEntry
+	DedupDecision
 */
 package protos
 
@@ -39,6 +42,14 @@ type FileMeta struct {
 	Sequence     int32    `protobuf:"varint,5,opt,name=sequence" json:"sequence,omitempty"`
 	DirInfo      *DirInfo `protobuf:"bytes,6,opt,name=dirInfo" json:"dirInfo,omitempty"`
 	RelativePath string   `protobuf:"bytes,7,opt,name=relativePath" json:"relativePath,omitempty"`
+	Hash         string   `protobuf:"bytes,8,opt,name=hash" json:"hash,omitempty"`
+	Unhashed     bool     `protobuf:"varint,9,opt,name=unhashed" json:"unhashed,omitempty"`
+	QuickHash    string   `protobuf:"bytes,10,opt,name=quickHash" json:"quickHash,omitempty"`
+	ModTimeNs    int64    `protobuf:"varint,11,opt,name=modTimeNs" json:"modTimeNs,omitempty"`
+	CtimeNs      int64    `protobuf:"varint,12,opt,name=ctimeNs" json:"ctimeNs,omitempty"`
+	Inode        uint64   `protobuf:"varint,13,opt,name=inode" json:"inode,omitempty"`
+	Device       uint64   `protobuf:"varint,14,opt,name=device" json:"device,omitempty"`
+	Nlink        uint64   `protobuf:"varint,15,opt,name=nlink" json:"nlink,omitempty"`
 }
 
 func (m *FileMeta) Reset()                    { *m = FileMeta{} }
@@ -54,10 +65,19 @@ func (m *FileMeta) GetDirInfo() *DirInfo {
 }
 
 type DirInfo struct {
-	UpdateTimeStart int32 `protobuf:"varint,1,opt,name=updateTimeStart" json:"updateTimeStart,omitempty"`
-	UpdateTimeEnd   int32 `protobuf:"varint,2,opt,name=updateTimeEnd" json:"updateTimeEnd,omitempty"`
-	TotalFileSize   int64 `protobuf:"varint,3,opt,name=totalFileSize" json:"totalFileSize,omitempty"`
-	TotalFileCount  int32 `protobuf:"varint,4,opt,name=totalFileCount" json:"totalFileCount,omitempty"`
+	UpdateTimeStart    int32  `protobuf:"varint,1,opt,name=updateTimeStart" json:"updateTimeStart,omitempty"`
+	UpdateTimeEnd      int32  `protobuf:"varint,2,opt,name=updateTimeEnd" json:"updateTimeEnd,omitempty"`
+	TotalFileSize      int64  `protobuf:"varint,3,opt,name=totalFileSize" json:"totalFileSize,omitempty"`
+	TotalFileCount     int32  `protobuf:"varint,4,opt,name=totalFileCount" json:"totalFileCount,omitempty"`
+	UpdateTimeStartNs  int64  `protobuf:"varint,5,opt,name=updateTimeStartNs" json:"updateTimeStartNs,omitempty"`
+	UpdateTimeEndNs    int64  `protobuf:"varint,6,opt,name=updateTimeEndNs" json:"updateTimeEndNs,omitempty"`
+	TotalDirCount      int32  `protobuf:"varint,7,opt,name=totalDirCount" json:"totalDirCount,omitempty"`
+	DuplicateFileCount int32  `protobuf:"varint,8,opt,name=duplicateFileCount" json:"duplicateFileCount,omitempty"`
+	DuplicateFileSize  int64  `protobuf:"varint,9,opt,name=duplicateFileSize" json:"duplicateFileSize,omitempty"`
+	UniqueFileSize     int64  `protobuf:"varint,10,opt,name=uniqueFileSize" json:"uniqueFileSize,omitempty"`
+	ContentHash        string `protobuf:"bytes,11,opt,name=contentHash" json:"contentHash,omitempty"`
+	CopiedFileCount    int32  `protobuf:"varint,12,opt,name=copiedFileCount" json:"copiedFileCount,omitempty"`
+	CopiedFileSize     int64  `protobuf:"varint,13,opt,name=copiedFileSize" json:"copiedFileSize,omitempty"`
 }
 
 func (m *DirInfo) Reset()                    { *m = DirInfo{} }
@@ -66,8 +86,17 @@ func (*DirInfo) ProtoMessage()               {}
 func (*DirInfo) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{1} }
 
 type DbMeta struct {
-	BaseDir  string `protobuf:"bytes,1,opt,name=baseDir" json:"baseDir,omitempty"`
-	Sequence int32  `protobuf:"varint,2,opt,name=sequence" json:"sequence,omitempty"`
+	BaseDir          string   `protobuf:"bytes,1,opt,name=baseDir" json:"baseDir,omitempty"`
+	Sequence         int32    `protobuf:"varint,2,opt,name=sequence" json:"sequence,omitempty"`
+	HashAlgorithm    string   `protobuf:"bytes,3,opt,name=hashAlgorithm" json:"hashAlgorithm,omitempty"`
+	SizeIndexed      bool     `protobuf:"varint,4,opt,name=sizeIndexed" json:"sizeIndexed,omitempty"`
+	QuickHashKiB     int32    `protobuf:"varint,5,opt,name=quickHashKiB" json:"quickHashKiB,omitempty"`
+	Rules            []string `protobuf:"bytes,6,rep,name=rules" json:"rules,omitempty"`
+	UpdatingSequence int32    `protobuf:"varint,7,opt,name=updatingSequence" json:"updatingSequence,omitempty"`
+	RepairedSequence int32    `protobuf:"varint,8,opt,name=repairedSequence" json:"repairedSequence,omitempty"`
+	UpdatingRules    []string `protobuf:"bytes,9,rep,name=updatingRules" json:"updatingRules,omitempty"`
+	NsTimes          bool     `protobuf:"varint,10,opt,name=nsTimes" json:"nsTimes,omitempty"`
+	SchemaVersion    int32    `protobuf:"varint,11,opt,name=schemaVersion" json:"schemaVersion,omitempty"`
 }
 
 func (m *DbMeta) Reset()                    { *m = DbMeta{} }
@@ -85,36 +114,116 @@ func (m *FilePaths) String() string            { return proto.CompactTextString(
 func (*FilePaths) ProtoMessage()               {}
 func (*FilePaths) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
 
+type ErrorRecord struct {
+	Path     string `protobuf:"bytes,1,opt,name=path" json:"path,omitempty"`
+	Op       string `protobuf:"bytes,2,opt,name=op" json:"op,omitempty"`
+	Kind     string `protobuf:"bytes,3,opt,name=kind" json:"kind,omitempty"`
+	Message  string `protobuf:"bytes,4,opt,name=message" json:"message,omitempty"`
+	Sequence int32  `protobuf:"varint,6,opt,name=sequence" json:"sequence,omitempty"`
+	TimeNs   int64  `protobuf:"varint,7,opt,name=timeNs" json:"timeNs,omitempty"`
+}
+
+func (m *ErrorRecord) Reset()                    { *m = ErrorRecord{} }
+func (m *ErrorRecord) String() string            { return proto.CompactTextString(m) }
+func (*ErrorRecord) ProtoMessage()               {}
+func (*ErrorRecord) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
+
+type JournalEntry struct {
+	Run         int64  `protobuf:"varint,1,opt,name=run" json:"run,omitempty"`
+	Path        string `protobuf:"bytes,2,opt,name=path" json:"path,omitempty"`
+	Destination string `protobuf:"bytes,3,opt,name=destination" json:"destination,omitempty"`
+	KeepPath    string `protobuf:"bytes,4,opt,name=keepPath" json:"keepPath,omitempty"`
+	Hash        string `protobuf:"bytes,5,opt,name=hash" json:"hash,omitempty"`
+	TimeNs      int64  `protobuf:"varint,6,opt,name=timeNs" json:"timeNs,omitempty"`
+	Strategy    int32  `protobuf:"varint,7,opt,name=strategy" json:"strategy,omitempty"`
+	Pending     bool   `protobuf:"varint,8,opt,name=pending" json:"pending,omitempty"`
+	Mode        uint32 `protobuf:"varint,9,opt,name=mode" json:"mode,omitempty"`
+	ModTimeNs   int64  `protobuf:"varint,10,opt,name=modTimeNs" json:"modTimeNs,omitempty"`
+}
+
+func (m *JournalEntry) Reset()                    { *m = JournalEntry{} }
+func (m *JournalEntry) String() string            { return proto.CompactTextString(m) }
+func (*JournalEntry) ProtoMessage()               {}
+func (*JournalEntry) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{5} }
+
+type DedupDecision struct {
+	Hash     string   `protobuf:"bytes,1,opt,name=hash" json:"hash,omitempty"`
+	Action   int32    `protobuf:"varint,2,opt,name=action" json:"action,omitempty"`
+	KeepPath string   `protobuf:"bytes,3,opt,name=keepPath" json:"keepPath,omitempty"`
+	Paths    []string `protobuf:"bytes,4,rep,name=paths" json:"paths,omitempty"`
+	TimeNs   int64    `protobuf:"varint,5,opt,name=timeNs" json:"timeNs,omitempty"`
+}
+
+func (m *DedupDecision) Reset()                    { *m = DedupDecision{} }
+func (m *DedupDecision) String() string            { return proto.CompactTextString(m) }
+func (*DedupDecision) ProtoMessage()               {}
+func (*DedupDecision) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{6} }
+
 func init() {
 	proto.RegisterType((*FileMeta)(nil), "protos.FileMeta")
 	proto.RegisterType((*DirInfo)(nil), "protos.DirInfo")
 	proto.RegisterType((*DbMeta)(nil), "protos.DbMeta")
 	proto.RegisterType((*FilePaths)(nil), "protos.FilePaths")
+	proto.RegisterType((*ErrorRecord)(nil), "protos.ErrorRecord")
+	proto.RegisterType((*JournalEntry)(nil), "protos.JournalEntry")
+	proto.RegisterType((*DedupDecision)(nil), "protos.DedupDecision")
 }
 
 func init() { proto.RegisterFile("meta.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 321 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x5c, 0x92, 0x41, 0x4b, 0xf3, 0x30,
-	0x18, 0xc7, 0xc9, 0xba, 0xb6, 0xdb, 0xf3, 0xbe, 0x3a, 0x78, 0x10, 0x09, 0x9e, 0x42, 0x11, 0x89,
-	0x97, 0x1d, 0x14, 0x8f, 0x7a, 0x71, 0x0a, 0x1e, 0x04, 0xc9, 0xfc, 0x02, 0x99, 0x7d, 0x86, 0x81,
-	0xb5, 0x99, 0x4d, 0xea, 0xc1, 0x2f, 0xe4, 0xe7, 0xf1, 0x1b, 0x49, 0xd2, 0x75, 0xd2, 0x9d, 0x9a,
-	0xff, 0x2f, 0x4d, 0xfb, 0xfc, 0x7f, 0x2d, 0x40, 0x45, 0x5e, 0xcf, 0xb7, 0x8d, 0xf5, 0x16, 0xb3,
-	0x78, 0x71, 0xc5, 0x0f, 0x83, 0xc9, 0xa3, 0xd9, 0xd0, 0x33, 0x79, 0x8d, 0x08, 0x63, 0x67, 0xbe,
-	0x88, 0x33, 0xc1, 0x64, 0xa2, 0xe2, 0x1a, 0x4f, 0x20, 0x35, 0x6e, 0x61, 0x1a, 0x3e, 0x12, 0x4c,
-	0x4e, 0x54, 0x17, 0xf0, 0x14, 0xb2, 0xaa, 0xbc, 0x59, 0xb6, 0x15, 0x4f, 0x04, 0x93, 0x53, 0xb5,
-	0x4b, 0xc8, 0x21, 0xaf, 0x6c, 0xf9, 0x6a, 0x2a, 0xe2, 0x63, 0xc1, 0x64, 0xaa, 0xfa, 0x88, 0x67,
-	0x30, 0x71, 0xf4, 0xd1, 0x52, 0xfd, 0x46, 0x3c, 0x8d, 0x5b, 0xfb, 0x8c, 0x97, 0x90, 0x97, 0xa6,
-	0x79, 0xaa, 0xd7, 0x96, 0x67, 0x82, 0xc9, 0x7f, 0x57, 0xb3, 0x6e, 0x4a, 0x37, 0x5f, 0x74, 0x58,
-	0xf5, 0xfb, 0x58, 0xc0, 0xff, 0x86, 0x36, 0xda, 0x9b, 0x4f, 0x7a, 0xd1, 0xfe, 0x9d, 0xe7, 0xf1,
-	0xf5, 0x03, 0x56, 0x7c, 0x33, 0xc8, 0x77, 0x07, 0x51, 0xc2, 0xac, 0xdd, 0x96, 0xda, 0x53, 0x18,
-	0x62, 0xe9, 0x75, 0xe3, 0x63, 0xbb, 0x54, 0x1d, 0x62, 0x3c, 0x87, 0xa3, 0x3f, 0xf4, 0x50, 0x97,
-	0xb1, 0x70, 0xaa, 0x86, 0x30, 0xdc, 0xe5, 0xad, 0xd7, 0x9b, 0xe0, 0x6c, 0x19, 0x5c, 0x25, 0xd1,
-	0xd5, 0x10, 0xe2, 0x05, 0x1c, 0xef, 0xc1, 0xbd, 0x6d, 0x6b, 0xbf, 0xb3, 0x71, 0x40, 0x8b, 0x3b,
-	0xc8, 0x16, 0xab, 0xa8, 0x9e, 0x43, 0xbe, 0xd2, 0x8e, 0x82, 0x68, 0x16, 0x2b, 0xf5, 0x71, 0x20,
-	0x6e, 0x34, 0x14, 0x57, 0xdc, 0xc2, 0x34, 0x3c, 0x2c, 0xb4, 0x76, 0xe1, 0x4b, 0x6d, 0xc3, 0x82,
-	0x33, 0x91, 0xc8, 0xa9, 0xea, 0x42, 0x38, 0xbe, 0xee, 0x67, 0x1d, 0xc5, 0x59, 0xf7, 0x79, 0xd5,
-	0xfd, 0x04, 0xd7, 0xbf, 0x01, 0x00, 0x00, 0xff, 0xff, 0xb8, 0x32, 0x9d, 0x9e, 0x19, 0x02, 0x00,
-	0x00,
+	// 846 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x6c, 0x55, 0xcf, 0x6f, 0x2b, 0x35,
+	0x10, 0xd6, 0x26, 0xd9, 0x64, 0xd7, 0x69, 0xda, 0x62, 0xa1, 0xa7, 0x15, 0xe2, 0x10, 0x45, 0x4f,
+	0x28, 0x20, 0xd4, 0x03, 0x88, 0x23, 0x07, 0x20, 0x45, 0xbc, 0x87, 0xa8, 0x90, 0x8b, 0xb8, 0xbb,
+	0xeb, 0x79, 0x89, 0xd5, 0xc4, 0xde, 0xda, 0xde, 0x27, 0xca, 0x1d, 0xfe, 0x07, 0xc4, 0x81, 0xff,
+	0x14, 0xa1, 0x19, 0xef, 0x8f, 0xec, 0x96, 0x53, 0xfc, 0x7d, 0xf6, 0x6a, 0xbe, 0x99, 0x6f, 0x66,
+	0xc2, 0xd8, 0x09, 0x82, 0xbc, 0xa9, 0x9c, 0x0d, 0x96, 0xcf, 0xe9, 0xc7, 0x6f, 0xfe, 0x9e, 0xb2,
+	0xec, 0x7b, 0x7d, 0x84, 0x9f, 0x20, 0x48, 0xce, 0xd9, 0xcc, 0xeb, 0xdf, 0xa1, 0x48, 0xd6, 0xc9,
+	0x76, 0x2a, 0xe8, 0xcc, 0x3f, 0x64, 0xa9, 0xf6, 0x3b, 0xed, 0x8a, 0xc9, 0x3a, 0xd9, 0x66, 0x22,
+	0x02, 0xfe, 0x8a, 0xcd, 0x4f, 0xea, 0xab, 0xfb, 0xfa, 0x54, 0x4c, 0xd7, 0xc9, 0x36, 0x17, 0x0d,
+	0xe2, 0x05, 0x5b, 0x9c, 0xac, 0xfa, 0x45, 0x9f, 0xa0, 0x98, 0xad, 0x93, 0x6d, 0x2a, 0x5a, 0xc8,
+	0x3f, 0x62, 0x99, 0x87, 0xa7, 0x1a, 0x4c, 0x09, 0x45, 0x4a, 0x57, 0x1d, 0xe6, 0x9f, 0xb2, 0x85,
+	0xd2, 0xee, 0x8d, 0x79, 0x67, 0x8b, 0xf9, 0x3a, 0xd9, 0x2e, 0xbf, 0xb8, 0x8a, 0x2a, 0xfd, 0xcd,
+	0x2e, 0xd2, 0xa2, 0xbd, 0xe7, 0x1b, 0x76, 0xe1, 0xe0, 0x28, 0x83, 0x7e, 0x0f, 0x3f, 0xcb, 0x70,
+	0x28, 0x16, 0x14, 0x7e, 0xc0, 0x61, 0x1a, 0x07, 0xe9, 0x0f, 0x45, 0x46, 0x77, 0x74, 0xc6, 0xf0,
+	0xb5, 0xc1, 0x13, 0xa8, 0x22, 0xa7, 0x4c, 0x3a, 0xcc, 0x3f, 0x66, 0xf9, 0x53, 0xad, 0xcb, 0xc7,
+	0x1f, 0xf0, 0x23, 0x46, 0x1f, 0xf5, 0x04, 0xde, 0x36, 0x39, 0xdc, 0xf9, 0x62, 0x49, 0x95, 0xe9,
+	0x09, 0x4c, 0xb8, 0x0c, 0xf1, 0xee, 0x82, 0xee, 0x5a, 0x48, 0x85, 0x33, 0x56, 0x41, 0xb1, 0x5a,
+	0x27, 0xdb, 0x99, 0x88, 0x00, 0x0b, 0xa7, 0xe0, 0xbd, 0x2e, 0xa1, 0xb8, 0x24, 0xba, 0x41, 0xf8,
+	0xda, 0x1c, 0xb5, 0x79, 0x2c, 0xae, 0xe2, 0x6b, 0x02, 0x9b, 0x7f, 0x66, 0x6c, 0xd1, 0x94, 0x80,
+	0x6f, 0xd9, 0x55, 0x5d, 0x29, 0x19, 0x00, 0x23, 0xdf, 0x07, 0xe9, 0x02, 0xf9, 0x94, 0x8a, 0x31,
+	0xcd, 0x5f, 0xb3, 0x55, 0x4f, 0xdd, 0x1a, 0x45, 0xd6, 0xa5, 0x62, 0x48, 0xe2, 0xab, 0x60, 0x83,
+	0x3c, 0xa2, 0xfb, 0xf7, 0xe8, 0xfa, 0x94, 0xf4, 0x0f, 0x49, 0xfe, 0x09, 0xbb, 0xec, 0x88, 0xef,
+	0x6c, 0x6d, 0x42, 0xe3, 0xeb, 0x88, 0xe5, 0x9f, 0xb3, 0x0f, 0x46, 0x32, 0xee, 0x3c, 0xf9, 0x3c,
+	0x15, 0x2f, 0x2f, 0x86, 0xb9, 0xdc, 0x1a, 0x75, 0xe7, 0xc9, 0xf8, 0xa9, 0x18, 0xd3, 0x9d, 0xca,
+	0x9d, 0x76, 0x31, 0xfc, 0x22, 0xe6, 0x32, 0x20, 0xf9, 0x0d, 0xe3, 0xaa, 0xae, 0x8e, 0xba, 0x94,
+	0x01, 0x7a, 0xa5, 0x19, 0x3d, 0xfd, 0x9f, 0x1b, 0x54, 0x3b, 0x60, 0x29, 0xff, 0x3c, 0xaa, 0x7d,
+	0x71, 0x81, 0x35, 0xa8, 0x8d, 0x7e, 0xaa, 0xfb, 0xa7, 0x8c, 0x9e, 0x8e, 0x58, 0xbe, 0x66, 0xcb,
+	0xd2, 0x9a, 0x00, 0x26, 0x50, 0x27, 0x2d, 0xa9, 0x93, 0xce, 0x29, 0xcc, 0xbb, 0xb4, 0x95, 0x06,
+	0xd5, 0x8b, 0xbc, 0x88, 0x1e, 0x8e, 0x68, 0x8c, 0xd9, 0x53, 0x14, 0x73, 0x15, 0x63, 0x0e, 0xd9,
+	0xcd, 0xbf, 0x13, 0x36, 0xdf, 0x3d, 0xd0, 0xf4, 0x16, 0x6c, 0xf1, 0x20, 0x3d, 0xe0, 0xac, 0x26,
+	0x14, 0xba, 0x85, 0x83, 0xd9, 0x9b, 0x8c, 0x66, 0xef, 0x35, 0x5b, 0xe1, 0x18, 0x7c, 0x73, 0xdc,
+	0x5b, 0xa7, 0xc3, 0xa1, 0x1d, 0xe8, 0x21, 0x89, 0xa9, 0xe1, 0x36, 0x78, 0x63, 0x14, 0xfc, 0x06,
+	0x8a, 0x7a, 0x20, 0x13, 0xe7, 0x14, 0x0e, 0x66, 0x37, 0x33, 0x3f, 0xea, 0x6f, 0x9b, 0x19, 0x1f,
+	0x70, 0xd8, 0xe4, 0xae, 0x3e, 0x02, 0x9a, 0x3d, 0xdd, 0xe6, 0x22, 0x02, 0xfe, 0x19, 0xbb, 0x26,
+	0xd7, 0xb5, 0xd9, 0xdf, 0xb7, 0x2a, 0xa3, 0xcb, 0x2f, 0x78, 0x7c, 0xeb, 0xa0, 0x92, 0xda, 0x81,
+	0xea, 0xde, 0x46, 0x9b, 0x5f, 0xf0, 0xdd, 0x18, 0x68, 0xb3, 0x17, 0x14, 0x35, 0xa7, 0xa8, 0x43,
+	0x12, 0xab, 0x66, 0x3c, 0xf6, 0x9b, 0x27, 0x57, 0x33, 0xd1, 0x42, 0xfc, 0xde, 0x97, 0x07, 0x38,
+	0xc9, 0x5f, 0xc1, 0x79, 0x6d, 0x0d, 0x19, 0x9a, 0x8a, 0x21, 0xb9, 0xf9, 0x9a, 0xe5, 0x68, 0x06,
+	0x2e, 0x1e, 0x9a, 0xf9, 0x0a, 0x0f, 0x45, 0x12, 0x13, 0x24, 0x80, 0xe5, 0x7f, 0xd7, 0xba, 0x38,
+	0x21, 0x17, 0x3b, 0xbc, 0xf9, 0x2b, 0x61, 0xcb, 0x5b, 0xe7, 0xac, 0x13, 0x50, 0x5a, 0xa7, 0x70,
+	0x77, 0xe1, 0x47, 0x8d, 0x83, 0x74, 0xe6, 0x97, 0x6c, 0x62, 0x2b, 0xfa, 0x32, 0x17, 0x13, 0x5b,
+	0xe1, 0x9b, 0x47, 0x6d, 0x54, 0xe3, 0x14, 0x9d, 0x69, 0xf1, 0x82, 0xf7, 0x72, 0x1f, 0x17, 0x6f,
+	0x2e, 0x5a, 0x38, 0x30, 0x7f, 0x3e, 0x32, 0xff, 0x15, 0x9b, 0x37, 0xcb, 0x6b, 0x41, 0xba, 0x1a,
+	0xf4, 0x76, 0x96, 0xa5, 0xd7, 0xf3, 0xcd, 0x9f, 0x13, 0x76, 0xf1, 0xd6, 0xd6, 0xce, 0xc8, 0xe3,
+	0xad, 0x09, 0xee, 0x99, 0x5f, 0xb3, 0xa9, 0xab, 0x4d, 0xf3, 0xf7, 0x80, 0xc7, 0x4e, 0xee, 0xe4,
+	0x4c, 0xee, 0x9a, 0x2d, 0x15, 0xf8, 0xa0, 0x8d, 0x0c, 0x58, 0xb5, 0xa8, 0xf2, 0x9c, 0x42, 0x49,
+	0x8f, 0x00, 0x15, 0x2d, 0xf0, 0xa8, 0xb6, 0xc3, 0xdd, 0xf2, 0x4e, 0xcf, 0x96, 0x77, 0x2f, 0x73,
+	0x7e, 0x2e, 0x93, 0x52, 0x0b, 0x4e, 0x06, 0xd8, 0x3f, 0x37, 0x1d, 0xd3, 0x61, 0x2c, 0x48, 0x05,
+	0x46, 0x69, 0xb3, 0xa7, 0x06, 0xc9, 0x44, 0x0b, 0x31, 0xc2, 0xc9, 0xaa, 0x38, 0xef, 0x2b, 0x41,
+	0xe7, 0xe1, 0x92, 0x67, 0xa3, 0x25, 0xbf, 0xf9, 0x23, 0x61, 0xab, 0x1d, 0xa8, 0xba, 0xda, 0x41,
+	0xa9, 0xd1, 0xf5, 0x4e, 0x65, 0x32, 0x54, 0x29, 0x4b, 0x4a, 0x39, 0xce, 0x58, 0x83, 0x06, 0xd9,
+	0x4e, 0x47, 0xd9, 0x76, 0x0d, 0x33, 0x3b, 0x6f, 0x98, 0x3e, 0xdf, 0xf4, 0x3c, 0xdf, 0x87, 0xf8,
+	0xa7, 0xfd, 0xe5, 0x7f, 0x03, 0x00, 0x55, 0xcd, 0x14, 0xe7, 0xc9, 0x07, 0x00, 0x00,
 }
@@ -0,0 +1,153 @@
+package fileindexer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/idlecat/fileindexer/protos"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const DEFAULT_QUICK_HASH_KIB = 64
+
+// Returns quick hash of a file: digest of its size, the first and the last kib
+// KiB. If the file is not larger than 2*kib KiB it is read once and its full
+// digest is returned as well, otherwise the full digest is empty.
+func QuickHashFile(filePath string, size int64, kib int32, hasher Hasher) (string, string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	quick := hasher.New()
+	sizeBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(sizeBytes, uint64(size))
+	quick.Write(sizeBytes)
+
+	sample := int64(kib) * 1024
+	if size <= 2*sample {
+		full := hasher.New()
+		if _, err := io.Copy(io.MultiWriter(quick, full), file); err != nil {
+			return "", "", err
+		}
+		return TagDigest(hasher.Name(), quick.Sum(nil)), TagDigest(hasher.Name(), full.Sum(nil)), nil
+	}
+	if _, err := io.Copy(quick, io.NewSectionReader(file, 0, sample)); err != nil {
+		return "", "", err
+	}
+	if _, err := io.Copy(quick, io.NewSectionReader(file, size-sample, sample)); err != nil {
+		return "", "", err
+	}
+	return TagDigest(hasher.Name(), quick.Sum(nil)), "", nil
+}
+
+// Sets how many KiB from the head and the tail of a file go into its quick
+// hash. Like the hash algorithm it can only be changed on a new index.
+func (v *Indexer) SetQuickHashKiB(kib int32) error {
+	if kib <= 0 {
+		return fmt.Errorf("invalid quick hash size %d KiB", kib)
+	}
+	if kib == v.dbMeta.QuickHashKiB {
+		return nil
+	}
+	if v.readingSequence != 0 {
+		return fmt.Errorf("index uses quick hash of %d KiB", v.dbMeta.QuickHashKiB)
+	}
+	v.dbMeta.QuickHashKiB = kib
+	return nil
+}
+
+func keyForQuickHash(quickHash string) string {
+	return string(PREFIX_QUICK_HASH) + quickHash
+}
+
+func (v *Indexer) addQuickHash(quickHash string, fileSize int64, relativePath string) error {
+	return v.addPath(keyForQuickHash(quickHash), fileSize, relativePath)
+}
+
+func (v *Indexer) removeQuickHash(quickHash string, relativePath string) error {
+	found, err := v.removePath(keyForQuickHash(quickHash), relativePath)
+	if err == nil && !found {
+		log.Printf("quick hash not found for %s", relativePath)
+	}
+	return err
+}
+
+func (v *Indexer) GetFilesByQuickHash(quickHash string) (int64, []string, error) {
+	var paths protos.FilePaths
+	found, err := v.getProto(keyForQuickHash(quickHash), &paths)
+	if !found {
+		return 0, nil, err
+	}
+	return paths.FileSize, paths.Paths, nil
+}
+
+type IterQuickHashFunc func(quickHash string, fileSize int64, paths []string) bool
+
+func (v *Indexer) IterQuickHash(iterFunc IterQuickHashFunc) error {
+	return v.iterPaths(PREFIX_QUICK_HASH, func(key string, paths *protos.FilePaths) bool {
+		return iterFunc(key[1:], paths.FileSize, paths.Paths)
+	})
+}
+
+// Quick hashes the given files if they have no quick hash. Hashed files need
+// one too, to be compared with unhashed files of the same size. Files
+// changed since they were indexed are left alone, as in EnsureHashed.
+func (v *Indexer) EnsureQuickHashed(relativePaths []string) error {
+	err := v.runPipeline(func() error {
+		for _, relativePath := range relativePaths {
+			meta, err := v.getFileMeta(relativePath)
+			if err != nil {
+				return err
+			}
+			if meta == nil || v.isCurrentDigest(meta.QuickHash) {
+				continue
+			}
+			err = v.pipeline.submit(&updateTask{
+				path:           filepath.Join(v.baseDir, relativePath),
+				meta:           meta,
+				needQuickHash:  true,
+				checkUnchanged: true,
+				apply:          v.applyQuickHash,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// small files are hashed in full.
+	return v.updateDirHashes()
+}
+
+func (v *Indexer) applyQuickHash(task *updateTask) error {
+	if task.err != nil {
+		return v.failPath(hashError(task))
+	}
+	relativePath := v.getRelativePath(task.path)
+	meta := task.meta
+	if meta.QuickHash != "" {
+		if err := v.removeQuickHash(meta.QuickHash, relativePath); err != nil {
+			return err
+		}
+	}
+	meta.QuickHash = task.quickDigest
+	if err := v.addQuickHash(meta.QuickHash, meta.Size, relativePath); err != nil {
+		return err
+	}
+	if task.digest != "" && meta.Unhashed {
+		// the quick hash covered the whole file.
+		meta.Hash = task.digest
+		meta.Unhashed = false
+		if err := v.addHash(meta.Hash, meta, relativePath); err != nil {
+			return err
+		}
+	}
+	return v.putKeyValue(keyForPath(relativePath), meta)
+}
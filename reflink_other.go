@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package fileindexer
+
+import (
+	"errors"
+	"os"
+)
+
+// Reflinks are only made on Linux.
+func reflink(src string, tmp string, info os.FileInfo) error {
+	return errors.New("reflinks are not supported on this platform")
+}
@@ -0,0 +1,162 @@
+package fileindexer
+
+import (
+	"fmt"
+	"github.com/idlecat/fileindexer/protos"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Returns whether an update was interrupted and its entries are not repaired
+// yet.
+func (v *Indexer) needsRepair() bool {
+	return v.dbMeta.UpdatingSequence != 0 &&
+		v.dbMeta.RepairedSequence != v.dbMeta.UpdatingSequence
+}
+
+// Rebuilds the hash, size, quick hash and dir hash indexes from the file and
+// dir entries, then the totals of dirs. Used when an update was interrupted,
+// as indexes written by older versions may be out of step with the files
+// then. Entries left by the interrupted update are removed by the next
+// update.
+func (v *Indexer) Repair() error {
+	log.Printf("Repairing index of interrupted update %d", v.dbMeta.UpdatingSequence)
+	entries := []*protos.FileMeta{}
+	indexKeys := []string{}
+	err := v.Iter(func(path string, meta *protos.FileMeta) bool {
+		meta.RelativePath = path
+		entries = append(entries, meta)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, prefix := range []byte{PREFIX_HASH, PREFIX_SIZE, PREFIX_QUICK_HASH, PREFIX_DIR_HASH} {
+		err := v.iterPrefix(string(prefix), func(key string, value []byte) (bool, error) {
+			indexKeys = append(indexKeys, key)
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	batching := v.beginBatch()
+	v.deferDirStats = true
+	err = v.rebuildIndexes(indexKeys, entries)
+	v.deferDirStats = false
+	if err == nil {
+		err = v.updateDirStats("")
+	}
+	if batching {
+		if endErr := v.endBatch(); err == nil {
+			err = endErr
+		}
+	}
+	return err
+}
+
+func (v *Indexer) rebuildIndexes(indexKeys []string, entries []*protos.FileMeta) error {
+	for _, key := range indexKeys {
+		if err := v.deleteKey(key); err != nil {
+			return err
+		}
+	}
+	for _, meta := range entries {
+		if err := v.addIndexes(meta); err != nil {
+			return err
+		}
+	}
+	v.dbMeta.RepairedSequence = v.dbMeta.UpdatingSequence
+	return v.putKeyValue(KEY_DB_META, v.dbMeta)
+}
+
+// Adds a file to the indexes its meta says it is in, as applyFile does.
+func (v *Indexer) addIndexes(meta *protos.FileMeta) error {
+	if meta.IsDir {
+		if meta.DirInfo == nil || meta.DirInfo.ContentHash == "" {
+			return nil
+		}
+		return v.addPath(keyForDirHash(meta.DirInfo.ContentHash), meta.DirInfo.TotalFileSize, meta.RelativePath)
+	}
+	if err := v.addSize(meta.Size, meta.RelativePath); err != nil {
+		return err
+	}
+	if meta.Hash != "" {
+		if err := v.addHash(meta.Hash, meta, meta.RelativePath); err != nil {
+			return err
+		}
+	}
+	if meta.QuickHash != "" {
+		if err := v.addQuickHash(meta.QuickHash, meta.Size, meta.RelativePath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checks that the hash, size, quick hash and dir hash indexes list exactly
+// the indexed files and dirs. Returns an error of kind ErrCorruptRecord otherwise.
+func (v *Indexer) Check() error {
+	expected := make(map[string][]string)
+	err := v.Iter(func(path string, meta *protos.FileMeta) bool {
+		if meta.IsDir {
+			if meta.DirInfo != nil && meta.DirInfo.ContentHash != "" {
+				key := keyForDirHash(meta.DirInfo.ContentHash)
+				expected[key] = append(expected[key], path)
+			}
+			return true
+		}
+		expected[keyForSize(meta.Size)] = append(expected[keyForSize(meta.Size)], path)
+		if meta.Hash != "" {
+			expected[keyForHash(meta.Hash)] = append(expected[keyForHash(meta.Hash)], path)
+		}
+		if meta.QuickHash != "" {
+			key := keyForQuickHash(meta.QuickHash)
+			expected[key] = append(expected[key], path)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, prefix := range []byte{PREFIX_HASH, PREFIX_SIZE, PREFIX_QUICK_HASH, PREFIX_DIR_HASH} {
+		var mismatch error
+		err := v.iterPaths(prefix, func(key string, paths *protos.FilePaths) bool {
+			if !samePaths(expected[key], paths.Paths) {
+				mismatch = fmt.Errorf("indexed %v, expected %v", paths.Paths, expected[key])
+				mismatch = newCorruptRecordError(key, mismatch)
+				return false
+			}
+			delete(expected, key)
+			return true
+		})
+		if err == nil {
+			err = mismatch
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for key, paths := range expected {
+		return newCorruptRecordError(key, fmt.Errorf("missing entry for %s", strings.Join(paths, ", ")))
+	}
+	return nil
+}
+
+func samePaths(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
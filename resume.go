@@ -0,0 +1,148 @@
+package fileindexer
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/idlecat/fileindexer/protos"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Returns whether Update continues an interrupted update, which it does when
+// the rules have not changed since.
+func (v *Indexer) canResume() bool {
+	if v.dbMeta.UpdatingSequence == 0 {
+		return false
+	}
+	rules, err := ParseRules(v.dbMeta.UpdatingRules)
+	return err == nil && v.rules.Equal(rules)
+}
+
+// Returns totals of dir if the resumed update has completed it, nil
+// otherwise. A dir gets the sequence of the update only after all its
+// children, so its entries are kept as they are and it is not walked again.
+func (v *Indexer) completedDir(dir string, parent *RepositoryInfo) (*RepositoryInfo, error) {
+	relativePath := v.getRelativePath(dir)
+	meta, err := v.getFileMeta(relativePath)
+	if err != nil || meta == nil || !meta.IsDir || meta.Sequence != v.writingSequence {
+		return nil, err
+	}
+	v.keepErrorsUnder(relativePath)
+	rInfo := &RepositoryInfo{
+		FileCount: meta.DirInfo.TotalFileCount,
+		FileSize:  meta.DirInfo.TotalFileSize,
+		DirCount:  meta.DirInfo.TotalDirCount,
+	}
+	// added to parent in walk order, as applyDir does.
+	err = v.pipeline.submit(&updateTask{path: dir, apply: func(task *updateTask) error {
+		if parent != nil {
+			parent.Add(rInfo)
+			parent.DirCount += 1
+		}
+		return nil
+	}})
+	return rInfo, err
+}
+
+// Keeps paths under relativePath recorded as failed, as they are not walked
+// again.
+func (v *Indexer) keepErrorsUnder(relativePath string) {
+	v.skippedLock.Lock()
+	defer v.skippedLock.Unlock()
+	for path := range v.staleErrors {
+		if relativePath == "" || path == relativePath || strings.HasPrefix(path, relativePath+"/") {
+			delete(v.staleErrors, path)
+		}
+	}
+}
+
+// Removes entries directly under dir which the interrupted update indexed
+// and which are gone, excluded or changed type now. They have the sequence
+// of the update, so they would not be removed when it is committed. Removed
+// files are counted in rInfo.
+func (v *Indexer) removeVanished(dir string, infos []os.FileInfo, rInfo *RepositoryInfo) error {
+	isDir := make(map[string]bool)
+	for _, info := range infos {
+		if !v.isExcluded(filepath.Join(dir, info.Name()), info.IsDir()) {
+			isDir[info.Name()] = info.IsDir()
+		}
+	}
+	relativeDir := v.getRelativePath(dir)
+	vanished := []*protos.FileMeta{}
+	err := v.iterChildren(relativeDir, func(path string, meta *protos.FileMeta) bool {
+		if meta.Sequence != v.writingSequence {
+			return true
+		}
+		if wasDir, ok := isDir[filepath.Base(path)]; !ok || wasDir != meta.IsDir {
+			meta.RelativePath = path
+			vanished = append(vanished, meta)
+		}
+		return true
+	})
+	if err != nil || len(vanished) == 0 {
+		return err
+	}
+	// removed before the children are applied, on the applying goroutine.
+	return v.pipeline.submit(&updateTask{path: dir, apply: func(task *updateTask) error {
+		delta := RepositoryInfo{}
+		for _, meta := range vanished {
+			if err := v.removeTree(meta.RelativePath, meta, &delta); err != nil {
+				return err
+			}
+			if meta.IsDir {
+				rInfo.RemovedDirCount += 1
+			}
+		}
+		rInfo.RemovedFileCount -= delta.FileCount
+		rInfo.RemovedFileSize -= delta.FileSize
+		return nil
+	}})
+}
+
+// Iterates entries directly under relativeDir. Entries further down are
+// skipped without being read. Pending writes are seen as by iterPrefix.
+func (v *Indexer) iterChildren(relativeDir string, iterFunc IterFunc) error {
+	prefix := keyForPath(relativeDir + "/")
+	if relativeDir == "" {
+		prefix = keyForPath("")
+	}
+	start := []byte(prefix)
+	for start != nil {
+		var next []byte
+		var unmarshalErr error
+		err := v.db.Iterate([]byte(prefix), start, func(k []byte, value []byte) bool {
+			key := string(k)
+			name := key[len(prefix):]
+			if name == "" {
+				// the root dir itself.
+				return true
+			} else if i := strings.IndexByte(name, '/'); i >= 0 {
+				// '0' follows '/', so this goes on past the entries of the
+				// child.
+				next = []byte(prefix + name[:i] + "0")
+				return false
+			}
+			value, deleted := v.withPending(k, value)
+			if deleted {
+				return true
+			}
+			var meta protos.FileMeta
+			if unmarshalErr = proto.Unmarshal(value, &meta); unmarshalErr != nil {
+				unmarshalErr = newCorruptRecordError(key, unmarshalErr)
+				return false
+			}
+			if !iterFunc(key[1:], &meta) {
+				next = nil
+				return false
+			}
+			return true
+		})
+		if err != nil {
+			return newDbError("iterate", prefix, err)
+		} else if unmarshalErr != nil {
+			return unmarshalErr
+		}
+		start = next
+	}
+	return nil
+}
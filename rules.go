@@ -0,0 +1,165 @@
+package fileindexer
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Rules decide which files and dirs are left out of an index. Patterns follow
+// gitignore: the last matching pattern wins, "!" re-includes, a trailing "/"
+// matches dirs only, a pattern with a "/" is anchored at the base dir and
+// "**" matches any number of dirs. Contents of an excluded dir are not
+// visited, so they can't be re-included.
+type Rules struct {
+	lines []string
+	rules []rule
+}
+
+type rule struct {
+	negate  bool
+	dirOnly bool
+	// Path components to match, "**" matches zero or more of them.
+	parts []string
+}
+
+// Returns rules which leave out the index db and Synology thumbnail dirs.
+func DefaultRules() *Rules {
+	rules, _ := ParseRules([]string{"/fileIndexerDb", "@eaDir"})
+	return rules
+}
+
+// Parses gitignore-style lines. Blank lines and lines starting with "#" are
+// ignored.
+func ParseRules(lines []string) (*Rules, error) {
+	r := &Rules{}
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		pattern := line
+		rule := rule{}
+		if pattern[0] == '!' {
+			rule.negate = true
+			pattern = pattern[1:]
+		} else if pattern[0] == '\\' {
+			// escaped leading "!" or "#".
+			pattern = pattern[1:]
+		}
+		if strings.HasSuffix(pattern, "/") {
+			rule.dirOnly = true
+			pattern = strings.TrimRight(pattern, "/")
+		}
+		anchored := strings.Contains(pattern, "/")
+		pattern = strings.TrimLeft(pattern, "/")
+		if pattern == "" {
+			return nil, fmt.Errorf("invalid rule %q", line)
+		}
+		if !anchored {
+			rule.parts = append(rule.parts, "**")
+		}
+		for _, part := range strings.Split(pattern, "/") {
+			if _, err := path.Match(part, ""); err != nil {
+				return nil, fmt.Errorf("invalid rule %q: %v", line, err)
+			}
+			rule.parts = append(rule.parts, part)
+		}
+		r.lines = append(r.lines, line)
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+// Returns the rules as lines to be parsed again, without blank lines and
+// comments.
+func (r *Rules) Lines() []string {
+	if r == nil {
+		return nil
+	}
+	return append([]string(nil), r.lines...)
+}
+
+// Returns whether both have the same patterns in the same order.
+func (r *Rules) Equal(other *Rules) bool {
+	a, b := r.Lines(), other.Lines()
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns whether the path relative to the base dir is excluded. Nil rules
+// exclude nothing.
+func (r *Rules) Excluded(relativePath string, isDir bool) bool {
+	if r == nil || relativePath == "" {
+		return false
+	}
+	parts := strings.Split(filepath.ToSlash(relativePath), "/")
+	excluded := false
+	for _, rule := range r.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if matchParts(rule.parts, parts) {
+			excluded = !rule.negate
+		}
+	}
+	return excluded
+}
+
+func matchParts(pattern []string, parts []string) bool {
+	if len(pattern) == 0 {
+		return len(parts) == 0
+	}
+	if pattern[0] == "**" {
+		if len(pattern) == 1 {
+			// a trailing "**" matches what is inside, not the dir itself.
+			return len(parts) > 0
+		}
+		for i := 0; i <= len(parts); i++ {
+			if matchParts(pattern[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	if matched, _ := path.Match(pattern[0], parts[0]); !matched {
+		return false
+	}
+	return matchParts(pattern[1:], parts[1:])
+}
+
+// Sets rules for the following updates. Returns true if they differ from the
+// rules of the last update, in which case the next update adds newly included
+// paths and removes newly excluded ones.
+func (v *Indexer) SetRules(rules *Rules) bool {
+	v.rules = rules
+	return v.readingSequence != 0 && !rules.Equal(v.committedRules())
+}
+
+func (v *Indexer) GetRules() *Rules {
+	return v.rules
+}
+
+// Returns rules of the last update.
+func (v *Indexer) committedRules() *Rules {
+	rules, err := ParseRules(v.dbMeta.Rules)
+	if err != nil {
+		return nil
+	}
+	return rules
+}
+
+func (v *Indexer) isExcluded(path string, isDir bool) bool {
+	return v.rules.Excluded(v.getRelativePath(path), isDir)
+}
@@ -0,0 +1,289 @@
+package fileindexer
+
+import (
+	"fmt"
+	"github.com/idlecat/fileindexer/protos"
+	"log"
+	"path/filepath"
+)
+
+func keyForSize(size int64) string {
+	// zero padded, so sizes are iterated in ascending order.
+	return fmt.Sprintf("%c%020d", PREFIX_SIZE, size)
+}
+
+func (v *Indexer) addSize(size int64, relativePath string) error {
+	return v.addPath(keyForSize(size), size, relativePath)
+}
+
+func (v *Indexer) removeSize(size int64, relativePath string) error {
+	found, err := v.removePath(keyForSize(size), relativePath)
+	if err == nil && !found {
+		log.Printf("size not found for %s", relativePath)
+	}
+	return err
+}
+
+func (v *Indexer) GetFilesBySize(size int64) ([]string, error) {
+	var paths protos.FilePaths
+	found, err := v.getProto(keyForSize(size), &paths)
+	if !found {
+		return nil, err
+	}
+	return paths.Paths, nil
+}
+
+type IterSizeFunc func(fileSize int64, paths []string) bool
+
+func (v *Indexer) IterSize(iterFunc IterSizeFunc) error {
+	return v.iterPaths(PREFIX_SIZE, func(key string, paths *protos.FilePaths) bool {
+		return iterFunc(paths.FileSize, paths.Paths)
+	})
+}
+
+func (v *Indexer) buildSizeIndex() error {
+	files := []*protos.FileMeta{}
+	err := v.Iter(func(path string, meta *protos.FileMeta) bool {
+		if !meta.IsDir {
+			meta.RelativePath = path
+			files = append(files, meta)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, meta := range files {
+		if err := v.addSize(meta.Size, meta.RelativePath); err != nil {
+			return err
+		}
+	}
+	v.dbMeta.SizeIndexed = true
+	return v.putKeyValue(KEY_DB_META, v.dbMeta)
+}
+
+// Hashes unhashed files whose size collides with another file. In
+// HASH_QUICK_FIRST mode only those whose quick hash collides as well.
+func (v *Indexer) HashCollisions() error {
+	paths := []string{}
+	err := v.IterSize(func(fileSize int64, group []string) bool {
+		if len(group) > 1 {
+			paths = append(paths, group...)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if v.hashMode == HASH_QUICK_FIRST {
+		if err := v.EnsureQuickHashed(paths); err != nil {
+			return err
+		}
+		paths = paths[:0]
+		err := v.IterQuickHash(func(quickHash string, fileSize int64, group []string) bool {
+			if len(group) > 1 {
+				paths = append(paths, group...)
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return v.EnsureHashed(paths)
+}
+
+// Like HashCollisions, but only for files of the given size.
+func (v *Indexer) hashSizeCollisions(size int64) error {
+	paths, err := v.GetFilesBySize(size)
+	if err != nil || len(paths) < 2 {
+		return err
+	}
+	if v.hashMode == HASH_QUICK_FIRST {
+		if err := v.EnsureQuickHashed(paths); err != nil {
+			return err
+		}
+		groups := make(map[string][]string)
+		for _, path := range paths {
+			meta, err := v.getFileMeta(path)
+			if err != nil {
+				return err
+			}
+			if meta != nil && meta.QuickHash != "" {
+				groups[meta.QuickHash] = append(groups[meta.QuickHash], path)
+			}
+		}
+		paths = paths[:0]
+		for _, group := range groups {
+			if len(group) > 1 {
+				paths = append(paths, group...)
+			}
+		}
+	}
+	return v.EnsureHashed(paths)
+}
+
+// Hashes files of this and the other index which may have the same content,
+// so duplicates between them are found by hash.
+func (v *Indexer) HashCollisionsWith(other *Indexer) error {
+	useQuickHash := v.hashMode == HASH_QUICK_FIRST &&
+		v.dbMeta.QuickHashKiB == other.dbMeta.QuickHashKiB
+	type group struct {
+		paths []string
+		files []string
+	}
+	groups := []group{}
+	var lookupErr error
+	err := other.IterSize(func(fileSize int64, paths []string) bool {
+		var files []string
+		files, lookupErr = v.GetFilesBySize(fileSize)
+		if len(files) > 0 {
+			groups = append(groups, group{paths, files})
+		}
+		return lookupErr == nil
+	})
+	if err == nil {
+		err = lookupErr
+	}
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		if useQuickHash {
+			if g.paths, g.files, err = v.matchQuickHashes(other, g.paths, g.files); err != nil {
+				return err
+			}
+		}
+		if err := other.EnsureHashed(g.paths); err != nil {
+			return err
+		}
+		if err := v.EnsureHashed(g.files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns paths of the other index and files of this index whose quick
+// hashes match.
+func (v *Indexer) matchQuickHashes(other *Indexer, paths []string, files []string) ([]string, []string, error) {
+	if err := other.EnsureQuickHashed(paths); err != nil {
+		return nil, nil, err
+	}
+	if err := v.EnsureQuickHashed(files); err != nil {
+		return nil, nil, err
+	}
+	matchedPaths := []string{}
+	matchedFiles := []string{}
+	for _, p := range paths {
+		meta, err := other.getFileMeta(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		if meta == nil || meta.QuickHash == "" {
+			continue
+		}
+		_, quickFiles, err := v.GetFilesByQuickHash(meta.QuickHash)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(quickFiles) > 0 {
+			matchedPaths = append(matchedPaths, p)
+			matchedFiles = append(matchedFiles, quickFiles...)
+		}
+	}
+	return matchedPaths, matchedFiles, nil
+}
+
+// Hashes the given files if they are indexed as unhashed. Files changed
+// since they were indexed stay unhashed, and fail with an error of kind
+// ErrMismatch, see the error policy.
+func (v *Indexer) EnsureHashed(relativePaths []string) error {
+	err := v.runPipeline(func() error {
+		for _, relativePath := range relativePaths {
+			meta, err := v.getFileMeta(relativePath)
+			if err != nil {
+				return err
+			}
+			if meta == nil || !meta.Unhashed {
+				continue
+			}
+			err = v.pipeline.submit(&updateTask{
+				path:           filepath.Join(v.baseDir, relativePath),
+				meta:           meta,
+				needHash:       true,
+				checkUnchanged: true,
+				apply:          v.applyHash,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// hashes of the dirs of files hashed now.
+	return v.updateDirHashes()
+}
+
+func (v *Indexer) applyHash(task *updateTask) error {
+	if task.err != nil {
+		// the file stays unhashed.
+		return v.failPath(hashError(task))
+	}
+	relativePath := v.getRelativePath(task.path)
+	meta := task.meta
+	meta.Hash = task.digest
+	meta.Unhashed = false
+	if err := v.putKeyValue(keyForPath(relativePath), meta); err != nil {
+		return err
+	}
+	return v.addHash(meta.Hash, meta, relativePath)
+}
+
+// Returns the error of a task which failed to hash its file.
+func hashError(task *updateTask) *PathError {
+	if err, ok := task.err.(*PathError); ok {
+		return err
+	}
+	return newPathError("hash", task.path, task.err)
+}
+
+// Returns digest of a file and the indexed files with the same content.
+// Indexed files of the same size are hashed first if needed. The file itself
+// is not hashed, and the digest is empty, if no indexed file has its size, or
+// its quick hash in HASH_QUICK_FIRST mode.
+func (v *Indexer) LookupFile(filePath string, size int64) (string, []string, error) {
+	candidates, err := v.GetFilesBySize(size)
+	if len(candidates) == 0 {
+		return "", nil, err
+	}
+	digest := ""
+	if v.hashMode == HASH_QUICK_FIRST {
+		if err := v.EnsureQuickHashed(candidates); err != nil {
+			return "", nil, err
+		}
+		quickDigest, fullDigest, err := QuickHashFile(filePath, size, v.dbMeta.QuickHashKiB, v.hasher)
+		if err != nil {
+			return "", nil, newPathError("hash", filePath, err)
+		}
+		_, candidates, err = v.GetFilesByQuickHash(quickDigest)
+		if len(candidates) == 0 {
+			return "", nil, err
+		}
+		digest = fullDigest
+	}
+	if err := v.EnsureHashed(candidates); err != nil {
+		return "", nil, err
+	}
+	if digest == "" {
+		digest, err = HashFile(filePath, v.hasher)
+		if err != nil {
+			return "", nil, newPathError("hash", filePath, err)
+		}
+	}
+	_, paths, err := v.GetFilesByHash(digest)
+	return digest, paths, err
+}
@@ -0,0 +1,87 @@
+package fileindexer
+
+import (
+	"fmt"
+	"github.com/idlecat/fileindexer/protos"
+	"os"
+)
+
+// Returns whether a file is unchanged since it was indexed. Besides size and
+// modification time, status change time and inode are compared where the
+// platform provides them, so changes within the same second, or with the
+// modification time restored, are noticed as well. A new ctime is ignored
+// if the link count changed on the same inode and device, as it does for the
+// file kept by a hardlink dedup, so that file is not hashed again.
+func unchanged(meta *protos.FileMeta, info os.FileInfo) bool {
+	if meta.Size != info.Size() || !sameModTime(meta, info) {
+		return false
+	}
+	ctimeNs, inode, device, nlink := statSys(info)
+	if meta.CtimeNs == 0 && ctimeNs != 0 {
+		return true
+	}
+	if meta.Inode != inode {
+		return false
+	}
+	return meta.CtimeNs == ctimeNs ||
+		meta.Nlink != 0 && meta.Nlink != nlink && meta.Device == device
+}
+
+// Returns whether info has the modification time of meta, to the second
+// for times migrated from modTime, which have no ctime either.
+func sameModTime(meta *protos.FileMeta, info os.FileInfo) bool {
+	if ctimeNs, _, _, _ := statSys(info); meta.CtimeNs == 0 && ctimeNs != 0 {
+		return meta.ModTimeNs/1e9 == info.ModTime().Unix()
+	}
+	return meta.ModTimeNs == info.ModTime().UnixNano()
+}
+
+// Returns the file info of the file at path, which must have the size and
+// modification time of meta. Fails op with an error of kind ErrMismatch if
+// not.
+func statUnchanged(path string, meta *protos.FileMeta, op string) (os.FileInfo, error) {
+	// symlinks are indexed as their targets.
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, newPathError("stat", path, err)
+	}
+	if info.Size() != meta.Size || !sameModTime(meta, info) {
+		return nil, &PathError{Op: op, Path: path, Kind: ErrMismatch, Err: fmt.Errorf("changed since indexed")}
+	}
+	return info, nil
+}
+
+// Sets times, inode, device and link count of meta from info.
+func setStat(meta *protos.FileMeta, info os.FileInfo) {
+	meta.ModTimeNs = info.ModTime().UnixNano()
+	meta.CtimeNs, meta.Inode, meta.Device, meta.Nlink = statSys(info)
+}
+
+// Returns the file a symlink links to, or info itself for other files and
+// for dangling symlinks.
+func followSymlink(path string, info os.FileInfo) os.FileInfo {
+	if info.Mode()&os.ModeSymlink == 0 {
+		return info
+	}
+	if target, err := os.Stat(path); err == nil && !target.IsDir() {
+		return target
+	}
+	return info
+}
+
+// Identifies the file a path is a link of.
+type fileId struct {
+	device uint64
+	inode  uint64
+	// Set instead for a file of unknown inode, which stands for itself.
+	path string
+}
+
+// Returns the file relativePath is a link of. Files indexed before devices
+// were kept are files of their own.
+func linkId(relativePath string, meta *protos.FileMeta) fileId {
+	if meta == nil || meta.Inode == 0 || meta.Device == 0 {
+		return fileId{path: relativePath}
+	}
+	return fileId{device: meta.Device, inode: meta.Inode}
+}
@@ -0,0 +1,18 @@
+//go:build linux || openbsd
+// +build linux openbsd
+
+package fileindexer
+
+import (
+	"os"
+	"syscall"
+)
+
+// Returns status change time in nanoseconds, inode, device and link count of
+// a file.
+func statSys(info os.FileInfo) (int64, uint64, uint64, uint64) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Ctim.Nano(), uint64(stat.Ino), uint64(stat.Dev), uint64(stat.Nlink)
+	}
+	return 0, 0, 0, 0
+}
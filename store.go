@@ -0,0 +1,129 @@
+package fileindexer
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// Store is the key value store an index is kept in. Keys are ordered
+// bytewise.
+type Store interface {
+	// Returns found false if key is not in the store.
+	Get(key []byte) (value []byte, found bool, err error)
+	Put(key []byte, value []byte) error
+	Delete(key []byte) error
+	// Calls iterFunc for keys starting with prefix in order, from the first
+	// one not before start, until it returns false. key and value are only
+	// valid during the call. The store may be written by iterFunc.
+	Iterate(prefix []byte, start []byte, iterFunc func(key []byte, value []byte) bool) error
+	// Applies all writes of batch at once.
+	Write(batch *Batch) error
+	Close() error
+}
+
+type StoreOptions struct {
+	// Fails with an error of kind ErrNotFound if the store doesn't exist,
+	// instead of creating it.
+	MustExist bool
+	ReadOnly  bool
+}
+
+const (
+	BACKEND_LEVELDB = "leveldb"
+	// Single file index, see go.etcd.io/bbolt.
+	BACKEND_BOLT = "bolt"
+	// Kept in memory until closed. For tests and one-off runs.
+	BACKEND_MEMORY = "memory"
+)
+
+var storeOpeners = map[string]func(path string, options *StoreOptions) (Store, error){
+	BACKEND_LEVELDB: openLeveldbStore,
+	BACKEND_BOLT:    openBoltStore,
+	BACKEND_MEMORY:  openMemoryStore,
+}
+
+// Returns names of the supported backends, sorted.
+func BackendNames() []string {
+	names := make([]string, 0, len(storeOpeners))
+	for name := range storeOpeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Opens the store of the named backend at path.
+func OpenStore(backend string, path string, options *StoreOptions) (Store, error) {
+	open, ok := storeOpeners[backend]
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %s, supported: %v", backend, BackendNames())
+	}
+	if options == nil {
+		options = &StoreOptions{}
+	}
+	return open(path, options)
+}
+
+// Batch collects writes to be applied to a Store at once.
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+func (b *Batch) Put(key []byte, value []byte) {
+	b.ops = append(b.ops, batchOp{key: key, value: value})
+}
+
+func (b *Batch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{key: key, delete: true})
+}
+
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+func (b *Batch) Reset() {
+	b.ops = nil
+}
+
+type keyValue struct {
+	key   []byte
+	value []byte
+}
+
+// Number of entries read at once by stores which can't be written while
+// being read.
+const iterateChunk = 1024
+
+// Implements Store.Iterate for stores which read entries by chunks. read
+// returns up to limit entries with prefix from key from on, copied.
+func iterateChunks(prefix []byte, start []byte, read func(from []byte, limit int) ([]keyValue, error),
+	iterFunc func(key []byte, value []byte) bool) error {
+	from := prefix
+	if bytes.Compare(start, prefix) > 0 {
+		from = start
+	}
+	for {
+		entries, err := read(from, iterateChunk)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !iterFunc(entry.key, entry.value) {
+				return nil
+			}
+		}
+		if len(entries) < iterateChunk {
+			return nil
+		}
+		// the key right after the last one.
+		last := entries[len(entries)-1].key
+		from = append(last[:len(last):len(last)], 0)
+	}
+}
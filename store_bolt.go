@@ -0,0 +1,110 @@
+package fileindexer
+
+import (
+	"bytes"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"time"
+)
+
+// All entries are kept in one bucket.
+var boltBucket = []byte("index")
+
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(path string, options *StoreOptions) (Store, error) {
+	if options.MustExist {
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+	}
+	db, err := bolt.Open(path, 0666, &bolt.Options{
+		// another process has the index open.
+		Timeout:  time.Second,
+		ReadOnly: options.ReadOnly,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !options.ReadOnly {
+		err = db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(boltBucket)
+			return err
+		})
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &boltStore{db}, nil
+}
+
+func (s *boltStore) Get(key []byte) (value []byte, found bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket(boltBucket); bucket != nil {
+			if v := bucket.Get(key); v != nil {
+				// only valid during the transaction.
+				value = append([]byte{}, v...)
+				found = true
+			}
+		}
+		return nil
+	})
+	return value, found, err
+}
+
+func (s *boltStore) Put(key []byte, value []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put(key, value)
+	})
+}
+
+func (s *boltStore) Delete(key []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete(key)
+	})
+}
+
+// Entries are read by chunks, as a write transaction may not be started
+// while a read transaction is open.
+func (s *boltStore) Iterate(prefix []byte, start []byte, iterFunc func(key []byte, value []byte) bool) error {
+	return iterateChunks(prefix, start, func(from []byte, limit int) ([]keyValue, error) {
+		entries := []keyValue{}
+		err := s.db.View(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(boltBucket)
+			if bucket == nil {
+				return nil
+			}
+			cursor := bucket.Cursor()
+			for k, v := cursor.Seek(from); k != nil && bytes.HasPrefix(k, prefix) && len(entries) < limit; k, v = cursor.Next() {
+				entries = append(entries, keyValue{append([]byte{}, k...), append([]byte{}, v...)})
+			}
+			return nil
+		})
+		return entries, err
+	}, iterFunc)
+}
+
+func (s *boltStore) Write(batch *Batch) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		for _, op := range batch.ops {
+			var err error
+			if op.delete {
+				err = bucket.Delete(op.key)
+			} else {
+				err = bucket.Put(op.key, op.value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,74 @@
+package fileindexer
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+type leveldbStore struct {
+	db *leveldb.DB
+}
+
+func openLeveldbStore(path string, options *StoreOptions) (Store, error) {
+	db, err := leveldb.OpenFile(path, &opt.Options{
+		ErrorIfMissing: options.MustExist,
+		ReadOnly:       options.ReadOnly,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &leveldbStore{db}, nil
+}
+
+func (s *leveldbStore) Get(key []byte) ([]byte, bool, error) {
+	value, err := s.db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (s *leveldbStore) Put(key []byte, value []byte) error {
+	return s.db.Put(key, value, nil)
+}
+
+func (s *leveldbStore) Delete(key []byte) error {
+	return s.db.Delete(key, nil)
+}
+
+// The iterator reads a snapshot, so writes meanwhile are not seen.
+func (s *leveldbStore) Iterate(prefix []byte, start []byte, iterFunc func(key []byte, value []byte) bool) error {
+	iter := s.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+	var ok bool
+	if start != nil {
+		ok = iter.Seek(start)
+	} else {
+		ok = iter.First()
+	}
+	for ; ok; ok = iter.Next() {
+		if !iterFunc(iter.Key(), iter.Value()) {
+			break
+		}
+	}
+	return iter.Error()
+}
+
+func (s *leveldbStore) Write(batch *Batch) error {
+	var b leveldb.Batch
+	for _, op := range batch.ops {
+		if op.delete {
+			b.Delete(op.key)
+		} else {
+			b.Put(op.key, op.value)
+		}
+	}
+	return s.db.Write(&b, nil)
+}
+
+func (s *leveldbStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,100 @@
+package fileindexer
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type memoryStore struct {
+	lock sync.Mutex
+	// Sorted keys of values.
+	keys   []string
+	values map[string][]byte
+}
+
+func openMemoryStore(path string, options *StoreOptions) (Store, error) {
+	if options.MustExist {
+		// nothing is kept once closed.
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	return &memoryStore{values: make(map[string][]byte)}, nil
+}
+
+func (s *memoryStore) Get(key []byte) ([]byte, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	value, found := s.values[string(key)]
+	return value, found, nil
+}
+
+func (s *memoryStore) Put(key []byte, value []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.put(string(key), value)
+	return nil
+}
+
+func (s *memoryStore) put(key string, value []byte) {
+	if _, found := s.values[key]; !found {
+		i := sort.SearchStrings(s.keys, key)
+		s.keys = append(s.keys, "")
+		copy(s.keys[i+1:], s.keys[i:])
+		s.keys[i] = key
+	}
+	s.values[key] = append([]byte{}, value...)
+}
+
+func (s *memoryStore) Delete(key []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.delete(string(key))
+	return nil
+}
+
+func (s *memoryStore) delete(key string) {
+	if _, found := s.values[key]; !found {
+		return
+	}
+	i := sort.SearchStrings(s.keys, key)
+	s.keys = append(s.keys[:i], s.keys[i+1:]...)
+	delete(s.values, key)
+}
+
+func (s *memoryStore) Iterate(prefix []byte, start []byte, iterFunc func(key []byte, value []byte) bool) error {
+	return iterateChunks(prefix, start, func(from []byte, limit int) ([]keyValue, error) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		entries := []keyValue{}
+		for i := sort.SearchStrings(s.keys, string(from)); i < len(s.keys) && len(entries) < limit; i++ {
+			key := s.keys[i]
+			if !strings.HasPrefix(key, string(prefix)) {
+				break
+			}
+			entries = append(entries, keyValue{[]byte(key), s.values[key]})
+		}
+		return entries, nil
+	}, iterFunc)
+}
+
+func (s *memoryStore) Write(batch *Batch) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, op := range batch.ops {
+		if op.delete {
+			s.delete(string(op.key))
+		} else {
+			s.put(string(op.key), op.value)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.keys = nil
+	s.values = nil
+	return nil
+}
@@ -2,12 +2,11 @@ package fileindexer
 
 import (
 	"bufio"
-	"crypto/md5"
-	"encoding/hex"
-	"io"
+	"fmt"
+	"github.com/idlecat/fileindexer/protos"
 	"io/ioutil"
-	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -20,67 +19,73 @@ const (
 
 type DirScanFunc func(path string, info os.FileInfo) int
 
-func ScanDir(dir string, callback DirScanFunc) {
+func ScanDir(dir string, callback DirScanFunc) error {
+	return ScanDirWithRules(dir, nil, callback)
+}
+
+// Scans dir like ScanDir, leaving out paths excluded by rules relative to
+// dir.
+func ScanDirWithRules(dir string, rules *Rules, callback DirScanFunc) error {
 	fileInfo, err := os.Lstat(dir)
 	if err != nil {
-		log.Fatal("Lstat failed on " + dir)
+		return newPathError("lstat", dir, err)
 	}
-	scanDirInternal(dir, fileInfo, callback)
+	return scanDirInternal(dir, "", fileInfo, rules, callback)
 }
 
-func scanDirInternal(dir string, info os.FileInfo, callback DirScanFunc) {
+func scanDirInternal(dir string, relativeDir string, info os.FileInfo, rules *Rules, callback DirScanFunc) error {
 	ret := callback(dir, info)
 	if ret == STOP_SCAN_THIS_DIR {
-		return
+		return nil
 	}
 	infos, err := ioutil.ReadDir(dir)
 	if err != nil {
-		log.Fatal("readDir failed on " + dir)
+		return newPathError("readdir", dir, err)
 	}
 
 	for _, info := range infos {
 		path := filepath.Join(dir, info.Name())
+		relativePath := filepath.Join(relativeDir, info.Name())
+		if rules.Excluded(relativePath, info.IsDir()) {
+			continue
+		}
 		if info.IsDir() {
-			scanDirInternal(path, info, callback)
+			if err := scanDirInternal(path, relativePath, info, rules, callback); err != nil {
+				return err
+			}
 		} else {
 			callback(path, info)
 		}
 	}
+	return nil
 }
 
-func HashFile(filePath string) (string, error) {
-	var ret string
-	file, err := os.Open(filePath)
-	if err != nil {
-		return ret, err
-	}
-	defer file.Close()
-	hash := md5.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		return ret, err
-	}
-	hashInBytes := hash.Sum(nil)[:16]
-	ret = hex.EncodeToString(hashInBytes)
-	return ret, nil
-}
-
-func RemoveFileSafely(relativePath string, origDir string, destDir string) {
+// Fails with an error of kind ErrMismatch, rather than replacing it, if
+// something was moved to the destination before.
+func RemoveFileSafely(relativePath string, origDir string, destDir string) error {
 	// Move origDir/path_to_file/file to destDir/path_to_file/file
 	pathToFile := filepath.Dir(relativePath)
 	err := os.MkdirAll(filepath.Join(destDir, pathToFile), os.ModeDir|0700)
 	if err != nil {
-		log.Fatal("Failed to create dest dir:", pathToFile)
+		return newPathError("mkdir", filepath.Join(destDir, pathToFile), err)
+	}
+	dest := filepath.Join(destDir, relativePath)
+	if _, err := os.Lstat(dest); err == nil {
+		return &PathError{Op: "rename", Path: dest, Kind: ErrMismatch, Err: os.ErrExist}
+	} else if !os.IsNotExist(err) {
+		return newPathError("lstat", dest, err)
 	}
-	err = os.Rename(filepath.Join(origDir, relativePath), filepath.Join(destDir, relativePath))
+	err = os.Rename(filepath.Join(origDir, relativePath), dest)
 	if err != nil {
-		log.Fatal("Failed to move file:", relativePath)
+		return newPathError("rename", filepath.Join(origDir, relativePath), err)
 	}
+	return nil
 }
 
-func ReadLinesFromFile(filePath string) []string {
+func ReadLinesFromFile(filePath string) ([]string, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
-		log.Fatal(err)
+		return nil, newPathError("open", filePath, err)
 	}
 	defer file.Close()
 
@@ -90,17 +95,77 @@ func ReadLinesFromFile(filePath string) []string {
 	for scanner.Scan() {
 		lines = append(lines, scanner.Text())
 	}
-	return lines
+	if err := scanner.Err(); err != nil {
+		return nil, newPathError("read", filePath, err)
+	}
+	return lines, nil
+}
+
+// Returns whether file is dir of dirOrder, or under it. dir matches whole
+// path components, which may be glob patterns as in rules, so "Photos/2014"
+// does not match "Photos/2014-old". A blank dir matches nothing.
+func inDir(file string, dir string) bool {
+	dir = strings.Trim(filepath.ToSlash(strings.TrimSpace(dir)), "/")
+	if dir == "" {
+		return false
+	}
+	pattern := strings.Split(dir, "/")
+	parts := strings.Split(file, "/")
+	for i := len(parts); i > 0; i-- {
+		if matchParts(pattern, parts[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parses dirOrder lines, dropping blank lines and lines starting with "#".
+func ParseDirOrder(lines []string) ([]string, error) {
+	dirs := []string{}
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		for _, part := range strings.Split(strings.Trim(filepath.ToSlash(line), "/"), "/") {
+			if _, err := path.Match(part, ""); err != nil {
+				return nil, fmt.Errorf("invalid dirOrder entry %q: %v", line, err)
+			}
+		}
+		dirs = append(dirs, line)
+	}
+	return dirs, nil
+}
+
+// Returns the entries of dirOrder which match no indexed path.
+func (v *Indexer) UnmatchedDirs(dirOrder []string) ([]string, error) {
+	unmatched := []string{}
+	for _, dir := range dirOrder {
+		matched := false
+		err := v.Iter(func(relativePath string, meta *protos.FileMeta) bool {
+			matched = inDir(relativePath, dir)
+			return !matched
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !matched {
+			unmatched = append(unmatched, dir)
+		}
+	}
+	return unmatched, nil
 }
 
-// Returns files to be removed.
+// Returns files to be removed. Files under the first entry of dirOrder
+// which has any are kept, see inDir, and the first of them in name order
+// if there are several.
 func DedupFiles(dupFiles []string, dirOrder []string) []string {
 	filesToRemove := []string{}
 	if len(dirOrder) > 0 {
 		fileIdxToKeep := make(map[int]int)
 		for _, dir := range dirOrder {
 			for index, file := range dupFiles {
-				if strings.HasPrefix(file, dir) {
+				if inDir(file, dir) {
 					fileIdxToKeep[index] = 1
 				}
 			}
@@ -0,0 +1,95 @@
+package fileindexer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const VERIFY_BLOCK_SIZE = 64 * 1024
+
+// Checks, before relativePath is removed as a copy of keepPath, that both
+// are still as indexed, with the same size and modification time, and that
+// their contents are the same byte for byte. A mismatch is returned as an
+// error of kind ErrMismatch and recorded for relativePath, see IterErrors,
+// until the next update.
+func (v *Indexer) VerifyDuplicate(relativePath string, keepPath string) error {
+	info, err := v.statIndexed(relativePath)
+	if err == nil {
+		var keepInfo os.FileInfo
+		if keepInfo, err = v.statIndexed(keepPath); err == nil && !os.SameFile(info, keepInfo) {
+			err = compareFiles(filepath.Join(v.baseDir, relativePath), filepath.Join(v.baseDir, keepPath))
+		}
+	}
+	if err == nil {
+		return nil
+	}
+	return v.recordMismatch(relativePath, err)
+}
+
+// Records err of a failed check for relativePath, unless it is a db error,
+// and returns it.
+func (v *Indexer) recordMismatch(relativePath string, err error) error {
+	pathErr, ok := err.(*PathError)
+	if !ok || pathErr.Kind == ErrDb || pathErr.Kind == ErrCorruptRecord {
+		return err
+	}
+	record := *pathErr
+	record.Path = filepath.Join(v.baseDir, relativePath)
+	if dbErr := v.recordError(&record); dbErr != nil {
+		return dbErr
+	}
+	return err
+}
+
+// Returns the file info of an indexed file, which must not have changed
+// since it was indexed.
+func (v *Indexer) statIndexed(relativePath string) (os.FileInfo, error) {
+	path := filepath.Join(v.baseDir, relativePath)
+	meta, err := v.getFileMeta(relativePath)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil || meta.IsDir {
+		return nil, &PathError{Op: "verify", Path: path, Kind: ErrMismatch, Err: fmt.Errorf("not an indexed file")}
+	}
+	return statUnchanged(path, meta, "verify")
+}
+
+// Returns an error of kind ErrMismatch unless the files at a and b have the
+// same content.
+func compareFiles(a string, b string) error {
+	fileA, err := os.Open(a)
+	if err != nil {
+		return newPathError("open", a, err)
+	}
+	defer fileA.Close()
+	fileB, err := os.Open(b)
+	if err != nil {
+		return newPathError("open", b, err)
+	}
+	defer fileB.Close()
+	bufA := make([]byte, VERIFY_BLOCK_SIZE)
+	bufB := make([]byte, VERIFY_BLOCK_SIZE)
+	var offset int64
+	for {
+		nA, errA := io.ReadFull(fileA, bufA)
+		if errA != nil && errA != io.EOF && errA != io.ErrUnexpectedEOF {
+			return newPathError("read", a, errA)
+		}
+		nB, errB := io.ReadFull(fileB, bufB)
+		if errB != nil && errB != io.EOF && errB != io.ErrUnexpectedEOF {
+			return newPathError("read", b, errB)
+		}
+		if nA != nB || !bytes.Equal(bufA[:nA], bufB[:nB]) {
+			return &PathError{Op: "verify", Path: a, Kind: ErrMismatch,
+				Err: fmt.Errorf("content differs from %s in bytes %d to %d", b, offset, offset+int64(nA))}
+		}
+		if errA != nil {
+			return nil
+		}
+		offset += int64(nA)
+	}
+}
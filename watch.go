@@ -0,0 +1,240 @@
+package fileindexer
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"github.com/idlecat/fileindexer/protos"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const DEFAULT_WATCH_DELAY = time.Second
+
+// Sets how long Watch waits for a path to settle before indexing it, so a
+// file being written is hashed once. Defaults to DEFAULT_WATCH_DELAY.
+func (v *Indexer) SetWatchDelay(delay time.Duration) {
+	v.watchDelay = delay
+}
+
+// Keeps the index up to date with changes under the base dir until stop is
+// closed. The index is reconciled with an Update first. While watching,
+// paths which can't be indexed are recorded and skipped whatever the error
+// policy, as they are mostly files removed while being written.
+func (v *Indexer) Watch(stop <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return newPathError("watch", v.baseDir, err)
+	}
+	defer watcher.Close()
+	// watches are added first, so nothing changed during the Update is missed.
+	if err := v.watchTree(watcher, v.baseDir); err != nil {
+		return err
+	}
+	if err := v.Update(); err != nil {
+		return err
+	}
+
+	errorPolicy := v.errorPolicy
+	v.errorPolicy = ON_ERROR_SKIP
+	defer func() { v.errorPolicy = errorPolicy }()
+	delay := v.watchDelay
+	if delay == 0 {
+		delay = DEFAULT_WATCH_DELAY
+	}
+	pending := make(map[string]bool)
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-stop:
+			return v.applyChanges(watcher, pending)
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			pending[event.Name] = true
+			settled = time.After(delay)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			if err != fsnotify.ErrEventOverflow {
+				return newPathError("watch", v.baseDir, err)
+			}
+			log.Print("Watch events overflowed, updating the whole index")
+			pending = make(map[string]bool)
+			if err := v.Update(); err != nil {
+				return err
+			}
+		case <-settled:
+			settled = nil
+			if err := v.applyChanges(watcher, pending); err != nil {
+				return err
+			}
+			pending = make(map[string]bool)
+		}
+	}
+}
+
+// Adds watches for dir and its subdirs which are not excluded.
+func (v *Indexer) watchTree(watcher *fsnotify.Watcher, dir string) error {
+	if err := watcher.Add(dir); err != nil {
+		return v.failPath(newPathError("watch", dir, err))
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return v.failPath(newPathError("readdir", dir, err))
+	}
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		if info.IsDir() && !v.isExcluded(path, true) {
+			if err := v.watchTree(watcher, path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Indexes relativePaths again, and everything under those which are dirs,
+// without walking the base dir, as Watch does for changed paths. Totals of
+// their ancestors are updated.
+func (v *Indexer) UpdatePaths(relativePaths []string) error {
+	pending := make(map[string]bool)
+	for _, relativePath := range relativePaths {
+		pending[filepath.Join(v.baseDir, relativePath)] = true
+	}
+	return v.applyChanges(nil, pending)
+}
+
+// Indexes changed paths, parents before their children. New dirs are
+// watched unless watcher is nil.
+func (v *Indexer) applyChanges(watcher *fsnotify.Watcher, pending map[string]bool) error {
+	if len(pending) == 0 {
+		return nil
+	}
+	paths := make([]string, 0, len(pending))
+	for path := range pending {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	log.Printf("Applying changes of %d paths", len(paths))
+	return v.withCommittedSequence(func() error {
+		sizes := make(map[int64]bool)
+		for _, path := range paths {
+			// each change is written at once, with the totals of its
+			// ancestors.
+			v.beginBatch()
+			err := v.applyChange(watcher, path, sizes)
+			if endErr := v.endBatch(); err == nil {
+				err = endErr
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if v.hashMode != HASH_ALL {
+			for size := range sizes {
+				if err := v.hashSizeCollisions(size); err != nil {
+					return err
+				}
+			}
+		}
+		return v.updateDirHashes()
+	})
+}
+
+// Brings the index of path in line with the file system. Sizes of indexed
+// files are added to sizes.
+func (v *Indexer) applyChange(watcher *fsnotify.Watcher, path string, sizes map[int64]bool) error {
+	relativePath := v.getRelativePath(path)
+	if relativePath == "" {
+		return nil
+	}
+	meta, err := v.getFileMeta(relativePath)
+	if err != nil {
+		return err
+	}
+	info, statErr := os.Lstat(path)
+	if statErr != nil && !os.IsNotExist(statErr) {
+		return v.failPath(newPathError("lstat", path, statErr))
+	}
+	// renamed to an excluded name counts as removed.
+	exists := statErr == nil && !v.isExcluded(path, info.IsDir())
+
+	delta := RepositoryInfo{}
+	if meta != nil && (!exists || meta.IsDir != info.IsDir()) {
+		if err := v.removeTree(relativePath, meta, &delta); err != nil {
+			return err
+		}
+		meta = nil
+	}
+	if exists && info.IsDir() && meta == nil {
+		if watcher != nil {
+			if err := v.watchTree(watcher, path); err != nil {
+				return err
+			}
+		}
+		err = v.runPipeline(func() error {
+			_, err := v.updateDir(path, info, &delta)
+			return err
+		})
+		if err == nil {
+			// duplicates under the new dir, which is iterated from the db.
+			if err = v.flushBatch(); err == nil {
+				err = v.updateDirStats(relativePath)
+			}
+		}
+	} else if exists && !info.IsDir() {
+		added := RepositoryInfo{}
+		err = v.runPipeline(func() error {
+			return v.updateFile(path, info, &added)
+		})
+		if err == nil && added.FileCount == 0 && meta != nil {
+			// failed and recorded, the stale entry goes.
+			meta.RelativePath = relativePath
+			err = v.removeItem(meta)
+		}
+		if meta != nil {
+			delta.FileCount -= 1
+			delta.FileSize -= meta.Size
+		}
+		delta.Add(&added)
+		sizes[info.Size()] = true
+	}
+	if err != nil {
+		return err
+	}
+	return v.addToAncestors(relativePath, &delta)
+}
+
+// Removes a file, or a dir and everything under it, from the index. Removed
+// totals are subtracted from delta.
+func (v *Indexer) removeTree(relativePath string, meta *protos.FileMeta, delta *RepositoryInfo) error {
+	items := []*protos.FileMeta{meta}
+	meta.RelativePath = relativePath
+	if meta.IsDir {
+		err := v.IterDir(relativePath, func(path string, meta *protos.FileMeta) bool {
+			meta.RelativePath = path
+			items = append(items, meta)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, item := range items {
+		if item.IsDir {
+			delta.DirCount -= 1
+		} else {
+			delta.FileCount -= 1
+			delta.FileSize -= item.Size
+		}
+		if err := v.removeItem(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}